@@ -18,11 +18,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package nncp
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -36,10 +39,16 @@ type Call struct {
 	Xx             TRxTx
 	RxRate         int
 	TxRate         int
+	RxLimit        int64
+	TxLimit        int64
 	Addr           *string
 	OnlineDeadline time.Duration
 	MaxOnlineTime  time.Duration
+	Parallel       int
 	WhenTxExists   bool
+	WhenTxNice     *uint8
+	WhenTxSize     int64
+	WhenTxInterval time.Duration
 	NoCK           bool
 	MCDIgnore      bool
 
@@ -53,19 +62,102 @@ type Call struct {
 	AutoTossNoACK  bool
 }
 
+// Call the node, establishing parallel number of simultaneous SP
+// connections. Packets are distributed between them, so none of them is
+// transferred twice. Call is good only if all connections are. Address
+// of the last successful call is tried first, call's result is saved
+// in node's CallState, unless only listing is requested or connection
+// is made by external UCSPI-TCP client.
 func (ctx *Ctx) CallNode(
 	node *Node,
 	addrs []string,
 	nice uint8,
 	xxOnly TRxTx,
 	rxRate, txRate int,
+	rxLimit, txLimit int64,
 	onlineDeadline, maxOnlineTime time.Duration,
 	listOnly bool,
 	noCK bool,
 	onlyPkts map[[MTHSize]byte]bool,
+	parallel int,
 ) (isGood bool) {
+	les := LEs{{"Node", node.Id}}
+	started := time.Now()
+	cs, err := ctx.CallStateRead(node.Id)
+	if err != nil {
+		ctx.LogE("call-state", les, err, func(les LEs) string {
+			return "Reading call state of " + node.Name
+		})
+		cs = &CallState{}
+	}
+	addrs = cs.addrsOrder(addrs)
+	if parallel < 1 {
+		parallel = 1
+	}
+	// Sessions of the call share the locks, both ours and the remote one's
+	var group [16]byte
+	if parallel > 1 {
+		if _, err = io.ReadFull(rand.Reader, group[:]); err != nil {
+			ctx.LogE("call-parallel", les, err, func(les LEs) string {
+				return "Generating parallel call group for " + node.Name
+			})
+			return false
+		}
+	}
+	goods := make([]bool, parallel)
+	connected := make([]string, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func(i int) {
+			goods[i], connected[i] = ctx.callNode(
+				node, addrs, nice, xxOnly, rxRate, txRate, rxLimit, txLimit,
+				onlineDeadline, maxOnlineTime, listOnly, noCK, onlyPkts,
+				i, parallel, group,
+			)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	isGood = true
+	var addr string
+	for i, good := range goods {
+		isGood = isGood && good
+		if connected[i] != "" {
+			addr = connected[i]
+		}
+	}
+	if listOnly || (len(addrs) == 1 && addrs[0] == UCSPITCPClient) {
+		return
+	}
+	cs.attempted(started, time.Now(), addr, isGood, node.BackoffMax)
+	if err = ctx.callStateWrite(node.Id, cs); err != nil {
+		ctx.LogE("call-state", les, err, func(les LEs) string {
+			return "Saving call state of " + node.Name
+		})
+	}
+	return
+}
+
+func (ctx *Ctx) callNode(
+	node *Node,
+	addrs []string,
+	nice uint8,
+	xxOnly TRxTx,
+	rxRate, txRate int,
+	rxLimit, txLimit int64,
+	onlineDeadline, maxOnlineTime time.Duration,
+	listOnly bool,
+	noCK bool,
+	onlyPkts map[[MTHSize]byte]bool,
+	partIdx, partNum int,
+	partGroup [16]byte,
+) (isGood bool, connected string) {
 	for _, addr := range addrs {
 		les := LEs{{"Node", node.Id}, {"Addr", addr}}
+		if partNum > 1 {
+			les = append(les, LE{"Conn", partIdx})
+		}
 		ctx.LogD("calling", les, func(les LEs) string {
 			return fmt.Sprintf("Calling %s (%s)", node.Name, addr)
 		})
@@ -86,8 +178,22 @@ func (ctx *Ctx) CallNode(
 			if addr == "" {
 				addr = UCSPITCPClient
 			}
+		} else if IsQUICAddr(addr) {
+			if proxyNeeded(node.Proxy, strings.TrimPrefix(addr, QUICScheme)) {
+				// Supported proxies can not carry UDP, but connecting
+				// directly would silently bypass the proxy
+				err = QUICProxied
+			} else {
+				conn, err = QUICDial(addr)
+			}
+		} else if IsWSAddr(addr) {
+			conn, err = WSDial(addr, node.Proxy)
+		} else if IsUnixAddr(addr) {
+			conn, err = UnixDial(addr)
 		} else if strings.HasPrefix(addr, "yggdrasilc://") {
 			conn, err = nncpYggdrasil.NewConn(ctx.YggdrasilAliases, addr)
+		} else if proxyNeeded(node.Proxy, addr) {
+			conn, err = ProxyDial(node.Proxy, addr)
 		} else {
 			conn, err = net.Dial("tcp", addr)
 		}
@@ -109,9 +215,15 @@ func (ctx *Ctx) CallNode(
 			xxOnly:         xxOnly,
 			rxRate:         rxRate,
 			txRate:         txRate,
+			rxLimit:        rxLimit,
+			txLimit:        txLimit,
 			listOnly:       listOnly,
 			NoCK:           noCK,
+			Addr:           addr,
 			onlyPkts:       onlyPkts,
+			partIdx:        partIdx,
+			partNum:        partNum,
+			partGroup:      partGroup,
 		}
 		if err = state.StartI(conn); err == nil {
 			ctx.LogI("call-started", les, func(les LEs) string {
@@ -139,6 +251,7 @@ func (ctx *Ctx) CallNode(
 				)
 			})
 			conn.Close()
+			connected = addr
 			break
 		} else {
 			ctx.LogE("call-started", les, err, func(les LEs) string {
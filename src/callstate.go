@@ -0,0 +1,169 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.cypherpunks.ru/recfile"
+)
+
+const (
+	CallStateFile = "call.state"
+
+	CallBackoffMin        = time.Minute
+	DefaultCallBackoffMax = time.Hour
+)
+
+// State of the online calls to the node. It is stored in the node's
+// spool, so it survives restarts.
+type CallState struct {
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastAddr    string
+	Failures    int
+	Backoff     time.Time
+}
+
+// Calls backoff duration after specified number of consecutive
+// failures: exponentially growing, with jitter, limited with max.
+func CallBackoff(failures int, max time.Duration) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if max < CallBackoffMin {
+		max = CallBackoffMin
+	}
+	backoff := CallBackoffMin
+	for i := 1; i < failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Randomly spread in [backoff/2, backoff) range, so simultaneously
+	// failed calls are not retried simultaneously
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// Is the call postponed because of the failed previous ones?
+func (cs *CallState) BackingOff(now time.Time) bool {
+	return now.Before(cs.Backoff)
+}
+
+// Account the call attempt. addr is the address the connection was
+// established with, if any. Call is successful only if it is good:
+// established connection is not enough for that.
+func (cs *CallState) attempted(
+	started, now time.Time,
+	addr string,
+	isGood bool,
+	max time.Duration,
+) {
+	cs.LastAttempt = started
+	if addr != "" {
+		cs.LastAddr = addr
+	}
+	if addr == "" || !isGood {
+		cs.Failures++
+		cs.Backoff = now.Add(CallBackoff(cs.Failures, max))
+		return
+	}
+	cs.LastSuccess = now
+	cs.Failures = 0
+	cs.Backoff = time.Time{}
+}
+
+// Reorder addresses, placing the last succeeded one first.
+func (cs *CallState) addrsOrder(addrs []string) []string {
+	if cs.LastAddr == "" {
+		return addrs
+	}
+	ordered := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr == cs.LastAddr {
+			ordered = append(ordered, addr)
+		}
+	}
+	if len(ordered) == 0 {
+		return addrs
+	}
+	for _, addr := range addrs {
+		if addr != cs.LastAddr {
+			ordered = append(ordered, addr)
+		}
+	}
+	return ordered
+}
+
+func (cs *CallState) fields() []recfile.Field {
+	fields := []recfile.Field{
+		recTime("LastAttempt", cs.LastAttempt),
+		{Name: "Failures", Value: strconv.Itoa(cs.Failures)},
+	}
+	if !cs.LastSuccess.IsZero() {
+		fields = append(fields, recTime("LastSuccess", cs.LastSuccess))
+	}
+	if cs.LastAddr != "" {
+		fields = append(fields, recfile.Field{Name: "LastAddr", Value: cs.LastAddr})
+	}
+	if !cs.Backoff.IsZero() {
+		fields = append(fields, recTime("Backoff", cs.Backoff))
+	}
+	return fields
+}
+
+// Read the state of the calls to the node. Empty state is returned if
+// it was never called.
+func (ctx *Ctx) CallStateRead(nodeId *NodeId) (*CallState, error) {
+	m, err := recRead(filepath.Join(ctx.Spool, nodeId.String(), CallStateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &CallState{}, nil
+		}
+		return nil, err
+	}
+	cs := CallState{LastAddr: m["LastAddr"]}
+	if cs.LastAttempt, err = recTimeParse(m, "LastAttempt"); err != nil {
+		return nil, err
+	}
+	if cs.Failures, err = strconv.Atoi(m["Failures"]); err != nil {
+		return nil, err
+	}
+	if _, exists := m["LastSuccess"]; exists {
+		if cs.LastSuccess, err = recTimeParse(m, "LastSuccess"); err != nil {
+			return nil, err
+		}
+	}
+	if _, exists := m["Backoff"]; exists {
+		if cs.Backoff, err = recTimeParse(m, "Backoff"); err != nil {
+			return nil, err
+		}
+	}
+	return &cs, nil
+}
+
+func (ctx *Ctx) callStateWrite(nodeId *NodeId, cs *CallState) error {
+	return recWrite(
+		filepath.Join(ctx.Spool, nodeId.String()), CallStateFile, cs.fields(),
+	)
+}
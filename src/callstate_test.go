@@ -0,0 +1,108 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestCallBackoff(t *testing.T) {
+	f := func(failures uint8, maxMinutes uint8) bool {
+		max := time.Duration(maxMinutes) * time.Minute
+		backoff := CallBackoff(int(failures), max)
+		if failures == 0 {
+			return backoff == 0
+		}
+		if max < CallBackoffMin {
+			max = CallBackoffMin
+		}
+		expected := CallBackoffMin
+		for i := 1; i < int(failures) && expected < max; i++ {
+			expected *= 2
+		}
+		if expected > max {
+			expected = max
+		}
+		return backoff >= expected/2 && backoff < expected
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCallState(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testcallstate")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	node, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{Spool: spool}
+	cs, err := ctx.CallStateRead(node.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.LastAttempt.IsZero() || cs.BackingOff(time.Now()) {
+		t.Fatal("non empty initial state")
+	}
+	addrs := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(cs.addrsOrder(addrs), addrs) {
+		t.Fatal("addresses are reordered")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	cs.attempted(now, now, "b", true, time.Hour)
+	cs.attempted(now, now, "", false, time.Hour)
+	// Established, but not good connection is a failure too
+	cs.attempted(now, now, "b", false, time.Hour)
+	if cs.Failures != 2 || !cs.BackingOff(now) || cs.BackingOff(now.Add(2*time.Minute)) {
+		t.Fatal("bad backoff", cs)
+	}
+	if err = ctx.callStateWrite(node.Id, cs); err != nil {
+		t.Fatal(err)
+	}
+	csRead, err := ctx.CallStateRead(node.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !csRead.LastAttempt.Equal(cs.LastAttempt) ||
+		!csRead.LastSuccess.Equal(cs.LastSuccess) ||
+		!csRead.Backoff.Equal(cs.Backoff) ||
+		csRead.LastAddr != "b" || csRead.Failures != 2 {
+		t.Fatal("state differs", cs, csRead)
+	}
+	if !reflect.DeepEqual(csRead.addrsOrder(addrs), []string{"b", "a", "c"}) {
+		t.Fatal("last address is not first")
+	}
+	if !reflect.DeepEqual(csRead.addrsOrder([]string{"d"}), []string{"d"}) {
+		t.Fatal("unknown last address is added")
+	}
+
+	csRead.attempted(now, now, "c", true, time.Hour)
+	if csRead.Failures != 0 || csRead.BackingOff(now) || csRead.LastAddr != "c" {
+		t.Fatal("success does not reset backoff", csRead)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"path/filepath"
+	"time"
+)
+
+const DefaultCallWhenTxInterval = time.Minute
+
+// Is the call triggered by the outbound queue: it contains the packet
+// with niceness not greater than WhenTxNice or their total size is at
+// least WhenTxSize. Only packets transferable with the call's
+// niceness are taken into account.
+func (call *Call) TxTriggered(ctx *Ctx, nodeId *NodeId) bool {
+	if call.WhenTxNice == nil && call.WhenTxSize == 0 {
+		return false
+	}
+	triggered := false
+	var size int64
+	for job := range ctx.Jobs(nodeId, TTx) {
+		if job.PktEnc.Nice > call.Nice {
+			continue
+		}
+		if call.WhenTxNice != nil && job.PktEnc.Nice <= *call.WhenTxNice {
+			triggered = true
+		}
+		size += job.Size
+	}
+	return triggered || (call.WhenTxSize > 0 && size >= call.WhenTxSize)
+}
+
+// Watch node's outbound queue and signal when it triggers the call, but
+// not more often than call's WhenTxInterval. Watching is finished when
+// stop is closed.
+func (ctx *Ctx) CallTxWatch(
+	nodeId *NodeId,
+	call *Call,
+	stop chan struct{},
+) (chan struct{}, error) {
+	dw, err := ctx.NewDirWatcher(
+		filepath.Join(ctx.Spool, nodeId.String(), string(TTx)),
+		time.Second,
+	)
+	if err != nil {
+		return nil, err
+	}
+	trigger := make(chan struct{}, 1)
+	go func() {
+		var last time.Time
+		var recheck <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				dw.Close()
+				return
+			case <-dw.C:
+			case <-recheck:
+				recheck = nil
+			}
+			if !call.TxTriggered(ctx, nodeId) {
+				continue
+			}
+			if wait := call.WhenTxInterval - time.Since(last); wait > 0 {
+				if recheck == nil {
+					recheck = time.After(wait)
+				}
+				continue
+			}
+			last = time.Now()
+			select {
+			case trigger <- struct{}{}:
+			default:
+				// Previous trigger is not processed yet
+			}
+		}
+	}()
+	return trigger, nil
+}
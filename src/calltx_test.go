@@ -0,0 +1,102 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCallTxTriggered(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testcalltx")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   make(map[NodeId]*Node),
+		Alias:   make(map[string]*NodeId),
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	node := nodeOur.Their()
+	ctx.Neigh[*nodeOur.Id] = node
+
+	whenTxNice := uint8(64)
+	byNice := &Call{Nice: 255, WhenTxNice: &whenTxNice}
+	bySize := &Call{Nice: 255, WhenTxSize: 2048}
+	lowNice := &Call{Nice: 32, WhenTxNice: &whenTxNice, WhenTxSize: 1}
+	for _, call := range []*Call{byNice, bySize, lowNice, {Nice: 255}} {
+		if call.TxTriggered(&ctx, node.Id) {
+			t.Fatal("triggered by empty queue")
+		}
+	}
+
+	tx := func(nice uint8) {
+		if err := ctx.TxExec(
+			node, nice, nice, "sendmail", nil, bytes.NewReader(nil),
+			1024, MaxFileSize, false, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx(200)
+	if byNice.TxTriggered(&ctx, node.Id) || bySize.TxTriggered(&ctx, node.Id) {
+		t.Fatal("triggered by single low priority packet")
+	}
+	tx(50)
+	if !byNice.TxTriggered(&ctx, node.Id) {
+		t.Fatal("not triggered by high priority packet")
+	}
+	if !bySize.TxTriggered(&ctx, node.Id) {
+		t.Fatal("not triggered by queue size")
+	}
+	if lowNice.TxTriggered(&ctx, node.Id) {
+		t.Fatal("triggered by not transferable packets")
+	}
+
+	bySize.WhenTxInterval = time.Hour
+	stop := make(chan struct{})
+	trigger, err := ctx.CallTxWatch(node.Id, bySize, stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-trigger:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not triggered")
+	}
+	tx(50)
+	select {
+	case <-trigger:
+		t.Fatal("triggered more often than interval")
+	case <-time.After(2 * time.Second):
+	}
+	close(stop)
+}
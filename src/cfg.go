@@ -39,6 +39,7 @@ const (
 	CfgSpoolEnv = "NNCPSPOOL"
 	CfgLogEnv   = "NNCPLOG"
 	CfgNoSync   = "NNCPNOSYNC"
+	CfgProxyEnv = "NNCPPROXY"
 )
 
 var (
@@ -56,15 +57,28 @@ type NodeJSON struct {
 	Incoming *string             `json:"incoming,omitempty"`
 	Exec     map[string][]string `json:"exec,omitempty"`
 	Freq     *NodeFreqJSON       `json:"freq,omitempty"`
+	Quota    *NodeQuotaJSON      `json:"quota,omitempty"`
+	Transit  *NodeTransitJSON    `json:"transit,omitempty"`
 	Via      []string            `json:"via,omitempty"`
 	Calls    []CallJSON          `json:"calls,omitempty"`
+	Receipt  bool                `json:"receipt,omitempty"`
+	MCDv1    bool                `json:"mcd-v1,omitempty"`
 
 	Addrs map[string]string `json:"addrs,omitempty"`
+	Proxy *string           `json:"proxy,omitempty"`
 
-	RxRate         *int  `json:"rxrate,omitempty"`
-	TxRate         *int  `json:"txrate,omitempty"`
-	OnlineDeadline *uint `json:"onlinedeadline,omitempty"`
-	MaxOnlineTime  *uint `json:"maxonlinetime,omitempty"`
+	RxRate         *int    `json:"rxrate,omitempty"`
+	TxRate         *int    `json:"txrate,omitempty"`
+	RxLimit        *uint64 `json:"rxlimit,omitempty"`
+	TxLimit        *uint64 `json:"txlimit,omitempty"`
+	OnlineDeadline *uint   `json:"onlinedeadline,omitempty"`
+	MaxOnlineTime  *uint   `json:"maxonlinetime,omitempty"`
+	Expire         *uint   `json:"expire,omitempty"`
+	Resend         *uint   `json:"resend,omitempty"`
+	ResendMax      *uint   `json:"resend-max,omitempty"`
+	BackoffMax     *uint   `json:"backoff-max,omitempty"`
+
+	RateSchedule []RateScheduleJSON `json:"rate-schedule,omitempty"`
 }
 
 type NodeFreqJSON struct {
@@ -74,16 +88,42 @@ type NodeFreqJSON struct {
 	MaxSize *uint64 `json:"maxsize,omitempty"`
 }
 
+type NodeTransitJSON struct {
+	Dsts    []string `json:"dsts,omitempty"`
+	MaxSize *uint64  `json:"maxsize,omitempty"`
+	Nice    *string  `json:"nice,omitempty"`
+	Daily   *uint64  `json:"daily,omitempty"`
+}
+
+type NodeQuotaJSON struct {
+	RxSize *uint64 `json:"rxsize,omitempty"`
+	RxPkts *uint64 `json:"rxpkts,omitempty"`
+	TxSize *uint64 `json:"txsize,omitempty"`
+	TxPkts *uint64 `json:"txpkts,omitempty"`
+}
+
+type RateScheduleJSON struct {
+	Cron    string  `json:"cron"`
+	RxLimit *uint64 `json:"rxlimit,omitempty"`
+	TxLimit *uint64 `json:"txlimit,omitempty"`
+}
+
 type CallJSON struct {
 	Cron           string  `json:"cron"`
 	Nice           *string `json:"nice,omitempty"`
 	Xx             *string `json:"xx,omitempty"`
 	RxRate         *int    `json:"rxrate,omitempty"`
 	TxRate         *int    `json:"txrate,omitempty"`
+	RxLimit        *uint64 `json:"rxlimit,omitempty"`
+	TxLimit        *uint64 `json:"txlimit,omitempty"`
 	Addr           *string `json:"addr,omitempty"`
 	OnlineDeadline *uint   `json:"onlinedeadline,omitempty"`
 	MaxOnlineTime  *uint   `json:"maxonlinetime,omitempty"`
+	Parallel       *uint   `json:"parallel,omitempty"`
 	WhenTxExists   bool    `json:"when-tx-exists,omitempty"`
+	WhenTxNice     *string `json:"when-tx-nice,omitempty"`
+	WhenTxSize     *uint64 `json:"when-tx-size,omitempty"`
+	WhenTxInterval *uint   `json:"when-tx-interval,omitempty"`
 	NoCK           bool    `json:"nock,omitempty"`
 	MCDIgnore      bool    `json:"mcd-ignore,omitempty"`
 
@@ -131,13 +171,17 @@ type AreaJSON struct {
 }
 
 type CfgJSON struct {
-	Spool string  `json:"spool"`
-	Log   string  `json:"log"`
-	Umask *string `json:"umask,omitempty"`
+	Spool     string  `json:"spool"`
+	Log       string  `json:"log"`
+	LogFormat *string `json:"log-format,omitempty"`
+	Umask     *string `json:"umask,omitempty"`
 
 	OmitPrgrs bool `json:"noprogress,omitempty"`
 	NoHdr     bool `json:"nohdr,omitempty"`
 
+	RxLimit *uint64 `json:"rxlimit,omitempty"`
+	TxLimit *uint64 `json:"txlimit,omitempty"`
+
 	MCDRxIfis []string       `json:"mcd-listen,omitempty"`
 	MCDTxIfis map[string]int `json:"mcd-send,omitempty"`
 
@@ -220,6 +264,41 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 		}
 	}
 
+	var quota Quota
+	if cfg.Quota != nil {
+		q := cfg.Quota
+		if q.RxSize != nil {
+			quota.RxSize = int64(*q.RxSize) * 1024
+		}
+		if q.RxPkts != nil {
+			quota.RxPkts = int64(*q.RxPkts)
+		}
+		if q.TxSize != nil {
+			quota.TxSize = int64(*q.TxSize) * 1024
+		}
+		if q.TxPkts != nil {
+			quota.TxPkts = int64(*q.TxPkts)
+		}
+	}
+
+	var transit *Transit
+	if cfg.Transit != nil {
+		t := cfg.Transit
+		transit = &Transit{Nice: 255}
+		if t.MaxSize != nil {
+			transit.MaxSize = int64(*t.MaxSize) * 1024
+		}
+		if t.Nice != nil {
+			transit.Nice, err = NicenessParse(*t.Nice)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if t.Daily != nil {
+			transit.Daily = int64(*t.Daily) * 1024
+		}
+	}
+
 	defRxRate := 0
 	if cfg.RxRate != nil && *cfg.RxRate > 0 {
 		defRxRate = *cfg.RxRate
@@ -228,6 +307,13 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 	if cfg.TxRate != nil && *cfg.TxRate > 0 {
 		defTxRate = *cfg.TxRate
 	}
+	var defRxLimit, defTxLimit int64
+	if cfg.RxLimit != nil {
+		defRxLimit = int64(*cfg.RxLimit) * 1024
+	}
+	if cfg.TxLimit != nil {
+		defTxLimit = int64(*cfg.TxLimit) * 1024
+	}
 
 	defOnlineDeadline := DefaultDeadline
 	if cfg.OnlineDeadline != nil {
@@ -241,6 +327,43 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 		defMaxOnlineTime = time.Duration(*cfg.MaxOnlineTime) * time.Second
 	}
 
+	var expire time.Duration
+	if cfg.Expire != nil {
+		expire = time.Duration(*cfg.Expire) * time.Second
+	}
+
+	var resend time.Duration
+	if cfg.Resend != nil {
+		resend = time.Duration(*cfg.Resend) * time.Second
+	}
+	resendMax := DefaultResendMax
+	if cfg.ResendMax != nil {
+		resendMax = int(*cfg.ResendMax)
+	}
+
+	backoffMax := DefaultCallBackoffMax
+	if cfg.BackoffMax != nil {
+		backoffMax = time.Duration(*cfg.BackoffMax) * time.Second
+	}
+
+	var rateSchedule []*RateSchedule
+	for _, rsCfg := range cfg.RateSchedule {
+		expr, err := cronexpr.Parse(rsCfg.Cron)
+		if err != nil {
+			return nil, err
+		}
+		rs := RateSchedule{Cron: expr}
+		if rsCfg.RxLimit != nil {
+			i := int64(*rsCfg.RxLimit) * 1024
+			rs.RxLimit = &i
+		}
+		if rsCfg.TxLimit != nil {
+			i := int64(*rsCfg.TxLimit) * 1024
+			rs.TxLimit = &i
+		}
+		rateSchedule = append(rateSchedule, &rs)
+	}
+
 	var calls []*Call
 	for _, callCfg := range cfg.Calls {
 		expr, err := cronexpr.Parse(callCfg.Cron)
@@ -276,6 +399,14 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 		if callCfg.TxRate != nil {
 			txRate = *callCfg.TxRate
 		}
+		rxLimit := defRxLimit
+		if callCfg.RxLimit != nil {
+			rxLimit = int64(*callCfg.RxLimit) * 1024
+		}
+		txLimit := defTxLimit
+		if callCfg.TxLimit != nil {
+			txLimit = int64(*callCfg.TxLimit) * 1024
+		}
 
 		var addr *string
 		if callCfg.Addr != nil {
@@ -300,6 +431,8 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 			Xx:             xx,
 			RxRate:         rxRate,
 			TxRate:         txRate,
+			RxLimit:        rxLimit,
+			TxLimit:        txLimit,
 			Addr:           addr,
 			OnlineDeadline: onlineDeadline,
 		}
@@ -307,7 +440,25 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 		if callCfg.MaxOnlineTime != nil {
 			call.MaxOnlineTime = time.Duration(*callCfg.MaxOnlineTime) * time.Second
 		}
+		call.Parallel = 1
+		if callCfg.Parallel != nil && *callCfg.Parallel > 1 {
+			call.Parallel = int(*callCfg.Parallel)
+		}
 		call.WhenTxExists = callCfg.WhenTxExists
+		if callCfg.WhenTxNice != nil {
+			whenTxNice, err := NicenessParse(*callCfg.WhenTxNice)
+			if err != nil {
+				return nil, err
+			}
+			call.WhenTxNice = &whenTxNice
+		}
+		if callCfg.WhenTxSize != nil {
+			call.WhenTxSize = int64(*callCfg.WhenTxSize) * 1024
+		}
+		call.WhenTxInterval = DefaultCallWhenTxInterval
+		if callCfg.WhenTxInterval != nil {
+			call.WhenTxInterval = time.Duration(*callCfg.WhenTxInterval) * time.Second
+		}
 		call.NoCK = callCfg.NoCK
 		call.MCDIgnore = callCfg.MCDIgnore
 		call.AutoToss = callCfg.AutoToss
@@ -332,14 +483,30 @@ func NewNode(name string, cfg NodeJSON) (*Node, error) {
 		FreqChunked:    freqChunked,
 		FreqMinSize:    freqMinSize,
 		FreqMaxSize:    freqMaxSize,
+		Quota:          quota,
+		Transit:        transit,
 		Calls:          calls,
 		Addrs:          cfg.Addrs,
+		Proxy:          os.Getenv(CfgProxyEnv),
 		RxRate:         defRxRate,
 		TxRate:         defTxRate,
+		RxLimit:        defRxLimit,
+		TxLimit:        defTxLimit,
+		RateSchedule:   rateSchedule,
 		OnlineDeadline: defOnlineDeadline,
 		MaxOnlineTime:  defMaxOnlineTime,
+		Receipt:        cfg.Receipt,
+		MCDv1:          cfg.MCDv1,
+		Expire:         expire,
+		Resend:         resend,
+		ResendMax:      resendMax,
+		BackoffMax:     backoffMax,
 	}
 	copy(node.ExchPub[:], exchPub)
+	if cfg.Proxy != nil {
+		// Explicitly empty value disables proxying
+		node.Proxy = *cfg.Proxy
+	}
 	if len(noisePub) > 0 {
 		node.NoisePub = new([32]byte)
 		copy(node.NoisePub[:], noisePub)
@@ -517,6 +684,15 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 	if !path.IsAbs(logPath) {
 		return nil, errors.New("Log path must be absolute")
 	}
+	logFormat := LogFormatRec
+	if cfgJSON.LogFormat != nil {
+		switch *cfgJSON.LogFormat {
+		case LogFormatRec, LogFormatJSON:
+			logFormat = *cfgJSON.LogFormat
+		default:
+			return nil, errors.New("Unknown log format: " + *cfgJSON.LogFormat)
+		}
+	}
 	var umaskForce *int
 	if cfgJSON.Umask != nil {
 		r, err := strconv.ParseUint(*cfgJSON.Umask, 8, 16)
@@ -534,9 +710,20 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 	if cfgJSON.NoHdr {
 		hdrUsage = false
 	}
+	for _, entry := range cfgJSON.MCDRxIfis {
+		if _, _, err := MCDTargetParse(entry); err != nil {
+			return nil, fmt.Errorf("mcd-listen: %w", err)
+		}
+	}
+	for entry := range cfgJSON.MCDTxIfis {
+		if _, _, err := MCDTargetParse(entry); err != nil {
+			return nil, fmt.Errorf("mcd-send: %w", err)
+		}
+	}
 	ctx := Ctx{
 		Spool:      spoolPath,
 		LogPath:    logPath,
+		LogFormat:  logFormat,
 		UmaskForce: umaskForce,
 		ShowPrgrs:  showPrgrs,
 		HdrUsage:   hdrUsage,
@@ -548,6 +735,12 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 
 		YggdrasilAliases: cfgJSON.YggdrasilAliases,
 	}
+	if cfgJSON.RxLimit != nil {
+		ctx.RxLimiter = NewRateLimiter(int64(*cfgJSON.RxLimit) * 1024)
+	}
+	if cfgJSON.TxLimit != nil {
+		ctx.TxLimiter = NewRateLimiter(int64(*cfgJSON.TxLimit) * 1024)
+	}
 	if cfgJSON.Notify != nil {
 		if cfgJSON.Notify.File != nil {
 			ctx.NotifyFile = cfgJSON.Notify.File
@@ -560,6 +753,7 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 		}
 	}
 	vias := make(map[NodeId][]string)
+	transitDsts := make(map[NodeId][]string)
 	for name, neighJSON := range cfgJSON.Neigh {
 		neigh, err := NewNode(name, neighJSON)
 		if err != nil {
@@ -571,6 +765,9 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 		}
 		ctx.Alias[name] = neigh.Id
 		vias[*neigh.Id] = neighJSON.Via
+		if neighJSON.Transit != nil && neighJSON.Transit.Dsts != nil {
+			transitDsts[*neigh.Id] = neighJSON.Transit.Dsts
+		}
 	}
 	ctx.SelfId = ctx.Alias["self"]
 	for neighId, viasRaw := range vias {
@@ -585,6 +782,17 @@ func Cfg2Ctx(cfgJSON *CfgJSON) (*Ctx, error) {
 			)
 		}
 	}
+	for neighId, dstsRaw := range transitDsts {
+		dsts := make(map[NodeId]struct{}, len(dstsRaw))
+		for _, dstRaw := range dstsRaw {
+			foundNode, err := ctx.FindNode(dstRaw)
+			if err != nil {
+				return nil, err
+			}
+			dsts[*foundNode.Id] = struct{}{}
+		}
+		ctx.Neigh[neighId].Transit.Dsts = dsts
+	}
 	ctx.AreaId2Area = make(map[AreaId]*Area, len(cfgJSON.Areas))
 	ctx.AreaName2Id = make(map[string]*AreaId, len(cfgJSON.Areas))
 	for name, areaJSON := range cfgJSON.Areas {
@@ -87,6 +87,9 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 	if err = cfgDirSave(cfg.Log, dst, "log"); err != nil {
 		return
 	}
+	if err = cfgDirSave(cfg.LogFormat, dst, "log-format"); err != nil {
+		return
+	}
 	if err = cfgDirSave(cfg.Umask, dst, "umask"); err != nil {
 		return
 	}
@@ -101,6 +104,13 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 		}
 	}
 
+	if err = cfgDirSave(cfg.RxLimit, dst, "rxlimit"); err != nil {
+		return
+	}
+	if err = cfgDirSave(cfg.TxLimit, dst, "txlimit"); err != nil {
+		return
+	}
+
 	if len(cfg.MCDRxIfis) > 0 {
 		if err = cfgDirSave(
 			strings.Join(cfg.MCDRxIfis, "\n"),
@@ -259,6 +269,68 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 			}
 		}
 
+		if n.Quota != nil {
+			if err = cfgDirMkdir(dst, "neigh", name, "quota"); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Quota.RxSize,
+				dst, "neigh", name, "quota", "rxsize",
+			); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Quota.RxPkts,
+				dst, "neigh", name, "quota", "rxpkts",
+			); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Quota.TxSize,
+				dst, "neigh", name, "quota", "txsize",
+			); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Quota.TxPkts,
+				dst, "neigh", name, "quota", "txpkts",
+			); err != nil {
+				return
+			}
+		}
+
+		if n.Transit != nil {
+			if err = cfgDirMkdir(dst, "neigh", name, "transit"); err != nil {
+				return
+			}
+			if len(n.Transit.Dsts) > 0 {
+				if err = cfgDirSave(
+					strings.Join(n.Transit.Dsts, "\n"),
+					dst, "neigh", name, "transit", "dsts",
+				); err != nil {
+					return
+				}
+			}
+			if err = cfgDirSave(
+				n.Transit.MaxSize,
+				dst, "neigh", name, "transit", "maxsize",
+			); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Transit.Nice,
+				dst, "neigh", name, "transit", "nice",
+			); err != nil {
+				return
+			}
+			if err = cfgDirSave(
+				n.Transit.Daily,
+				dst, "neigh", name, "transit", "daily",
+			); err != nil {
+				return
+			}
+		}
+
 		if len(n.Via) > 0 {
 			if err = cfgDirSave(
 				strings.Join(n.Via, "\n"),
@@ -279,18 +351,66 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 			}
 		}
 
+		if err = cfgDirSave(n.Proxy, dst, "neigh", name, "proxy"); err != nil {
+			return
+		}
+
 		if err = cfgDirSave(n.RxRate, dst, "neigh", name, "rxrate"); err != nil {
 			return
 		}
 		if err = cfgDirSave(n.TxRate, dst, "neigh", name, "txrate"); err != nil {
 			return
 		}
+		if err = cfgDirSave(n.RxLimit, dst, "neigh", name, "rxlimit"); err != nil {
+			return
+		}
+		if err = cfgDirSave(n.TxLimit, dst, "neigh", name, "txlimit"); err != nil {
+			return
+		}
 		if err = cfgDirSave(n.OnlineDeadline, dst, "neigh", name, "onlinedeadline"); err != nil {
 			return
 		}
 		if err = cfgDirSave(n.MaxOnlineTime, dst, "neigh", name, "maxonlinetime"); err != nil {
 			return
 		}
+		if err = cfgDirSave(n.Expire, dst, "neigh", name, "expire"); err != nil {
+			return
+		}
+		if err = cfgDirSave(n.Resend, dst, "neigh", name, "resend"); err != nil {
+			return
+		}
+		if err = cfgDirSave(n.ResendMax, dst, "neigh", name, "resend-max"); err != nil {
+			return
+		}
+		if err = cfgDirSave(n.BackoffMax, dst, "neigh", name, "backoff-max"); err != nil {
+			return
+		}
+		if n.Receipt {
+			if err = cfgDirTouch(dst, "neigh", name, "receipt"); err != nil {
+				return
+			}
+		}
+		if n.MCDv1 {
+			if err = cfgDirTouch(dst, "neigh", name, "mcd-v1"); err != nil {
+				return
+			}
+		}
+
+		for i, rs := range n.RateSchedule {
+			is := strconv.Itoa(i)
+			if err = cfgDirMkdir(dst, "neigh", name, "rate-schedule", is); err != nil {
+				return
+			}
+			if err = cfgDirSave(rs.Cron, dst, "neigh", name, "rate-schedule", is, "cron"); err != nil {
+				return
+			}
+			if err = cfgDirSave(rs.RxLimit, dst, "neigh", name, "rate-schedule", is, "rxlimit"); err != nil {
+				return
+			}
+			if err = cfgDirSave(rs.TxLimit, dst, "neigh", name, "rate-schedule", is, "txlimit"); err != nil {
+				return
+			}
+		}
 
 		for i, call := range n.Calls {
 			is := strconv.Itoa(i)
@@ -312,6 +432,12 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 			if err = cfgDirSave(call.TxRate, dst, "neigh", name, "calls", is, "txrate"); err != nil {
 				return
 			}
+			if err = cfgDirSave(call.RxLimit, dst, "neigh", name, "calls", is, "rxlimit"); err != nil {
+				return
+			}
+			if err = cfgDirSave(call.TxLimit, dst, "neigh", name, "calls", is, "txlimit"); err != nil {
+				return
+			}
 			if err = cfgDirSave(call.Addr, dst, "neigh", name, "calls", is, "addr"); err != nil {
 				return
 			}
@@ -321,11 +447,23 @@ func CfgToDir(dst string, cfg *CfgJSON) (err error) {
 			if err = cfgDirSave(call.MaxOnlineTime, dst, "neigh", name, "calls", is, "maxonlinetime"); err != nil {
 				return
 			}
+			if err = cfgDirSave(call.Parallel, dst, "neigh", name, "calls", is, "parallel"); err != nil {
+				return
+			}
 			if call.WhenTxExists {
 				if err = cfgDirTouch(dst, "neigh", name, "calls", is, "when-tx-exists"); err != nil {
 					return
 				}
 			}
+			if err = cfgDirSave(call.WhenTxNice, dst, "neigh", name, "calls", is, "when-tx-nice"); err != nil {
+				return
+			}
+			if err = cfgDirSave(call.WhenTxSize, dst, "neigh", name, "calls", is, "when-tx-size"); err != nil {
+				return
+			}
+			if err = cfgDirSave(call.WhenTxInterval, dst, "neigh", name, "calls", is, "when-tx-interval"); err != nil {
+				return
+			}
 			if call.NoCK {
 				if err = cfgDirTouch(dst, "neigh", name, "calls", is, "nock"); err != nil {
 					return
@@ -517,12 +655,32 @@ func DirToCfg(src string) (*CfgJSON, error) {
 		return nil, err
 	}
 
+	if cfg.LogFormat, err = cfgDirLoadOpt(src, "log-format"); err != nil {
+		return nil, err
+	}
 	if cfg.Umask, err = cfgDirLoadOpt(src, "umask"); err != nil {
 		return nil, err
 	}
 	cfg.OmitPrgrs = cfgDirExists(src, "noprogress")
 	cfg.NoHdr = cfgDirExists(src, "nohdr")
 
+	i64, err := cfgDirLoadIntOpt(src, "rxlimit")
+	if err != nil {
+		return nil, err
+	}
+	if i64 != nil {
+		i := uint64(*i64)
+		cfg.RxLimit = &i
+	}
+	i64, err = cfgDirLoadIntOpt(src, "txlimit")
+	if err != nil {
+		return nil, err
+	}
+	if i64 != nil {
+		i := uint64(*i64)
+		cfg.TxLimit = &i
+	}
+
 	sp, err := cfgDirLoadOpt(src, "mcd-listen")
 	if err != nil {
 		return nil, err
@@ -688,6 +846,80 @@ func DirToCfg(src string) (*CfgJSON, error) {
 			}
 		}
 
+		if cfgDirExists(src, "neigh", n, "quota") {
+			node.Quota = &NodeQuotaJSON{}
+			i64, err := cfgDirLoadIntOpt(src, "neigh", n, "quota", "rxsize")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Quota.RxSize = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "quota", "rxpkts")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Quota.RxPkts = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "quota", "txsize")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Quota.TxSize = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "quota", "txpkts")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Quota.TxPkts = &i
+			}
+		}
+
+		if cfgDirExists(src, "neigh", n, "transit") {
+			node.Transit = &NodeTransitJSON{}
+			dsts, err := cfgDirLoadOpt(src, "neigh", n, "transit", "dsts")
+			if err != nil {
+				return nil, err
+			}
+			if dsts != nil {
+				node.Transit.Dsts = strings.Split(*dsts, "\n")
+			}
+
+			i64, err := cfgDirLoadIntOpt(src, "neigh", n, "transit", "maxsize")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Transit.MaxSize = &i
+			}
+
+			if node.Transit.Nice, err = cfgDirLoadOpt(
+				src, "neigh", n, "transit", "nice",
+			); err != nil {
+				return nil, err
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "transit", "daily")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				node.Transit.Daily = &i
+			}
+		}
+
 		via, err := cfgDirLoadOpt(src, "neigh", n, "via")
 		if err != nil {
 			return nil, err
@@ -710,6 +942,9 @@ func DirToCfg(src string) (*CfgJSON, error) {
 				return nil, err
 			}
 		}
+		if node.Proxy, err = cfgDirLoadOpt(src, "neigh", n, "proxy"); err != nil {
+			return nil, err
+		}
 
 		i64, err := cfgDirLoadIntOpt(src, "neigh", n, "rxrate")
 		if err != nil {
@@ -729,6 +964,24 @@ func DirToCfg(src string) (*CfgJSON, error) {
 			node.TxRate = &i
 		}
 
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "rxlimit")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint64(*i64)
+			node.RxLimit = &i
+		}
+
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "txlimit")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint64(*i64)
+			node.TxLimit = &i
+		}
+
 		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "onlinedeadline")
 		if err != nil {
 			return nil, err
@@ -747,6 +1000,44 @@ func DirToCfg(src string) (*CfgJSON, error) {
 			node.MaxOnlineTime = &i
 		}
 
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "expire")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint(*i64)
+			node.Expire = &i
+		}
+
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "resend")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint(*i64)
+			node.Resend = &i
+		}
+
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "resend-max")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint(*i64)
+			node.ResendMax = &i
+		}
+
+		i64, err = cfgDirLoadIntOpt(src, "neigh", n, "backoff-max")
+		if err != nil {
+			return nil, err
+		}
+		if i64 != nil {
+			i := uint(*i64)
+			node.BackoffMax = &i
+		}
+		node.Receipt = cfgDirExists(src, "neigh", n, "receipt")
+		node.MCDv1 = cfgDirExists(src, "neigh", n, "mcd-v1")
+
 		fis2, err = ioutil.ReadDir(filepath.Join(src, "neigh", n, "calls"))
 		if err != nil && !os.IsNotExist(err) {
 			return nil, err
@@ -801,6 +1092,24 @@ func DirToCfg(src string) (*CfgJSON, error) {
 				call.TxRate = &i
 			}
 
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "calls", is, "rxlimit")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				call.RxLimit = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "calls", is, "txlimit")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				call.TxLimit = &i
+			}
+
 			if call.Addr, err = cfgDirLoadOpt(
 				src, "neigh", n, "calls", is, "addr",
 			); err != nil {
@@ -825,9 +1134,42 @@ func DirToCfg(src string) (*CfgJSON, error) {
 				call.MaxOnlineTime = &i
 			}
 
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "calls", is, "parallel")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint(*i64)
+				call.Parallel = &i
+			}
+
 			if cfgDirExists(src, "neigh", n, "calls", is, "when-tx-exists") {
 				call.WhenTxExists = true
 			}
+
+			if call.WhenTxNice, err = cfgDirLoadOpt(
+				src, "neigh", n, "calls", is, "when-tx-nice",
+			); err != nil {
+				return nil, err
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "calls", is, "when-tx-size")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				call.WhenTxSize = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "calls", is, "when-tx-interval")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint(*i64)
+				call.WhenTxInterval = &i
+			}
 			if cfgDirExists(src, "neigh", n, "calls", is, "nock") {
 				call.NoCK = true
 			}
@@ -857,6 +1199,51 @@ func DirToCfg(src string) (*CfgJSON, error) {
 			}
 			node.Calls = append(node.Calls, call)
 		}
+
+		fis2, err = ioutil.ReadDir(filepath.Join(src, "neigh", n, "rate-schedule"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		rsIdx := make([]int, 0, len(fis2))
+		for _, fi2 := range fis2 {
+			if !fi2.IsDir() {
+				continue
+			}
+			i, err := strconv.Atoi(fi2.Name())
+			if err != nil {
+				continue
+			}
+			rsIdx = append(rsIdx, i)
+		}
+		sort.Ints(rsIdx)
+		for _, i := range rsIdx {
+			rs := RateScheduleJSON{}
+			is := strconv.Itoa(i)
+			if rs.Cron, err = cfgDirLoadMust(
+				src, "neigh", n, "rate-schedule", is, "cron",
+			); err != nil {
+				return nil, err
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "rate-schedule", is, "rxlimit")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				rs.RxLimit = &i
+			}
+
+			i64, err = cfgDirLoadIntOpt(src, "neigh", n, "rate-schedule", is, "txlimit")
+			if err != nil {
+				return nil, err
+			}
+			if i64 != nil {
+				i := uint64(*i64)
+				rs.TxLimit = &i
+			}
+			node.RateSchedule = append(node.RateSchedule, rs)
+		}
 		cfg.Neigh[n] = node
 	}
 
@@ -187,7 +187,7 @@ func main() {
 				err = nncp.MagicNNCPEv4.TooOld()
 			case nncp.MagicNNCPEv5.B:
 				err = nncp.MagicNNCPEv5.TooOld()
-			case nncp.MagicNNCPEv6.B:
+			case nncp.MagicNNCPEv6.B, nncp.MagicNNCPEv7.B:
 			default:
 				err = errors.New("is not an encrypted packet")
 			}
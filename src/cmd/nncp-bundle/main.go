@@ -32,7 +32,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	xdr "github.com/davecgh/go-xdr/xdr2"
 	"github.com/dustin/go-humanize"
 	"go.cypherpunks.ru/nncp/v8"
 )
@@ -116,6 +115,7 @@ func main() {
 		bufStdout := bufio.NewWriter(os.Stdout)
 		tarWr := tar.NewWriter(bufStdout)
 		for nodeId := range nodeIds {
+			ctx.ResendLocked(&nodeId)
 			for job := range ctx.Jobs(&nodeId, nncp.TTx) {
 				pktName = filepath.Base(job.Path)
 				les := nncp.LEs{
@@ -180,10 +180,8 @@ func main() {
 					log.Fatalln("Error during stdout flushing:", err)
 				}
 				if *doDelete {
-					if err = os.Remove(job.Path); err != nil {
+					if err = ctx.TxSentRemove(ctx.Neigh[nodeId], job.Path); err != nil {
 						log.Fatalln("Error during deletion:", err)
-					} else if ctx.HdrUsage {
-						os.Remove(nncp.JobPath2Hdr(job.Path))
 					}
 				}
 				ctx.LogI(
@@ -198,6 +196,7 @@ func main() {
 						)
 					},
 				)
+				ctx.TrackTransmitted(&nodeId, pktName)
 			}
 		}
 		if err = tarWr.Close(); err != nil {
@@ -207,6 +206,7 @@ func main() {
 		bufStdin := bufio.NewReaderSize(os.Stdin, nncp.MTHBlockSize*2)
 		pktEncBuf := make([]byte, nncp.PktEncOverhead)
 		var pktEnc *nncp.PktEnc
+		var pktEncLen int
 		for {
 			peeked, err := bufStdin.Peek(nncp.MTHBlockSize)
 			if err != nil && err != io.EOF {
@@ -294,7 +294,8 @@ func main() {
 				)
 				continue
 			}
-			if _, err = xdr.Unmarshal(bytes.NewReader(pktEncBuf), &pktEnc); err != nil {
+			pktEnc, pktEncLen, err = nncp.PktEncUnmarshal(bytes.NewReader(pktEncBuf))
+			if err != nil {
 				ctx.LogD(
 					"bundle-rx",
 					append(les, nncp.LE{K: "Err", V: "Bad packet structure"}),
@@ -313,7 +314,7 @@ func main() {
 				err = nncp.MagicNNCPEv4.TooOld()
 			case nncp.MagicNNCPEv5.B:
 				err = nncp.MagicNNCPEv5.TooOld()
-			case nncp.MagicNNCPEv6.B:
+			case nncp.MagicNNCPEv6.B, nncp.MagicNNCPEv7.B:
 			default:
 				err = errors.New("Bad packet magic number")
 			}
@@ -422,6 +423,12 @@ func main() {
 				})
 				continue
 			}
+			if node := ctx.Neigh[*pktEnc.Sender]; node != nil {
+				if err = ctx.QuotaCheck(node, nncp.TRx, entry.Size); err != nil {
+					ctx.LogE("bundle-rx-quota", les, err, logMsg)
+					continue
+				}
+			}
 			if *doCheck {
 				if *dryRun {
 					hsh := nncp.MTHNew(entry.Size, 0)
@@ -497,7 +504,7 @@ func main() {
 						log.Fatalln("Error during syncing:", err)
 					}
 					if ctx.HdrUsage {
-						ctx.HdrWrite(pktEncBuf, dstPath)
+						ctx.HdrWrite(pktEncBuf[:pktEncLen], dstPath)
 					}
 				}
 			}
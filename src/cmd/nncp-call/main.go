@@ -22,9 +22,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 
@@ -50,8 +48,11 @@ func main() {
 		noCK        = flag.Bool("nock", false, "Do no checksum checking")
 		onlyPktsRaw = flag.String("pkts", "", "Recieve only that packets, comma separated")
 		mcdWait     = flag.Uint("mcd-wait", 0, "Wait for MCD for specified number of seconds")
+		parallel    = flag.Uint("parallel", 1, "Number of simultaneous connections")
 		rxRate      = flag.Int("rxrate", 0, "Maximal receive rate, pkts/sec")
 		txRate      = flag.Int("txrate", 0, "Maximal transmit rate, pkts/sec")
+		rxLimit     = flag.Uint64("rxlimit", 0, "Maximal receive rate, KiB/sec")
+		txLimit     = flag.Uint64("txlimit", 0, "Maximal transmit rate, KiB/sec")
 		spoolPath   = flag.String("spool", "", "Override path to spool")
 		logPath     = flag.String("log", "", "Override path to logfile")
 		quiet       = flag.Bool("quiet", false, "Print only errors")
@@ -129,6 +130,14 @@ func main() {
 	if *maxOnlineTimeSec != 0 {
 		maxOnlineTime = time.Duration(*maxOnlineTimeSec) * time.Second
 	}
+	rxLimitBytes := node.RxLimit
+	if *rxLimit != 0 {
+		rxLimitBytes = int64(*rxLimit) * 1024
+	}
+	txLimitBytes := node.TxLimit
+	if *txLimit != 0 {
+		txLimitBytes = int64(*txLimit) * 1024
+	}
 
 	var xxOnly nncp.TRxTx
 	if *rxOnly {
@@ -137,6 +146,10 @@ func main() {
 		xxOnly = nncp.TTx
 	}
 
+	if *parallel > 1 && (*ucspi || *listOnly) {
+		log.Fatalln("-parallel can not be used with -ucspi or -list")
+	}
+
 	var addrs []string
 	if *ucspi {
 		addrs = append(addrs, nncp.UCSPITCPClient)
@@ -155,33 +168,15 @@ func main() {
 	}
 
 	if *mcdWait > 0 {
-		ifis, err := net.Interfaces()
-		if err != nil {
-			log.Fatalln("Can not get network interfaces list:", err)
-		}
-		for _, ifiReString := range ctx.MCDRxIfis {
-			ifiRe, err := regexp.CompilePOSIX(ifiReString)
-			if err != nil {
-				log.Fatalf("Can not compile POSIX regexp \"%s\": %s", ifiReString, err)
-			}
-			for _, ifi := range ifis {
-				if ifiRe.MatchString(ifi.Name) {
-					if err = ctx.MCDRx(ifi.Name); err != nil {
-						log.Printf("Can not run MCD reception on %s: %s", ifi.Name, err)
-					}
-				}
-			}
+		if err = ctx.MCDRxStart(); err != nil {
+			log.Fatalln("Can not run MCD reception:", err)
 		}
 		addrs = nil
 		for i := int(*mcdWait); i > 0; i-- {
-			nncp.MCDAddrsM.RLock()
-			for _, mcdAddr := range nncp.MCDAddrs[*node.Id] {
-				addrs = append(addrs, mcdAddr.Addr.String())
-			}
+			addrs = nncp.MCDNodeAddrs(node.Id)
 			if len(addrs) > 0 {
 				break
 			}
-			nncp.MCDAddrsM.RUnlock()
 			time.Sleep(time.Second)
 		}
 		if len(addrs) == 0 {
@@ -209,7 +204,7 @@ func main() {
 	var autoTossFinish chan struct{}
 	var autoTossBadCode chan bool
 	if *autoToss {
-		autoTossFinish, autoTossBadCode = ctx.AutoToss(
+		autoTossFinish, autoTossBadCode, err = ctx.AutoToss(
 			node.Id,
 			nice,
 			*autoTossDoSeen,
@@ -220,6 +215,9 @@ func main() {
 			*autoTossNoArea,
 			*autoTossNoACK,
 		)
+		if err != nil {
+			log.Fatalln("Can not run auto tossing:", err)
+		}
 	}
 
 	badCode := !ctx.CallNode(
@@ -229,11 +227,14 @@ func main() {
 		xxOnly,
 		*rxRate,
 		*txRate,
+		rxLimitBytes,
+		txLimitBytes,
 		onlineDeadline,
 		maxOnlineTime,
 		*listOnly,
 		*noCK,
 		onlyPkts,
+		int(*parallel),
 	)
 
 	if *autoToss {
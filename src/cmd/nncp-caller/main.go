@@ -23,10 +23,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
-	"regexp"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.cypherpunks.ru/nncp/v8"
@@ -40,11 +40,56 @@ func usage() {
 	flag.PrintDefaults()
 }
 
+func nodesToCall(ctx *nncp.Ctx, nodeIds []string) ([]*nncp.Node, error) {
+	var nodes []*nncp.Node
+	if len(nodeIds) > 0 {
+		for _, nodeId := range nodeIds {
+			node, err := ctx.FindNode(nodeId)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NODE specified: %w", err)
+			}
+			if node.NoisePub == nil {
+				return nil, fmt.Errorf(
+					"node %s does not have online communication capability", nodeId,
+				)
+			}
+			if len(node.Calls) == 0 {
+				ctx.LogD(
+					"caller-no-calls",
+					nncp.LEs{{K: "Node", V: node.Id}},
+					func(les nncp.LEs) string {
+						return fmt.Sprintf("%s node has no calls, skipping", node.Name)
+					},
+				)
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	} else {
+		for _, node := range ctx.Neigh {
+			if len(node.Calls) == 0 {
+				ctx.LogD(
+					"caller-no-calls",
+					nncp.LEs{{K: "Node", V: node.Id}},
+					func(les nncp.LEs) string {
+						return fmt.Sprintf("%s node has no calls, skipping", node.Name)
+					},
+				)
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, nil
+}
+
 func main() {
 	var (
 		cfgPath   = flag.String("cfg", nncp.DefaultCfgPath, "Path to configuration file")
 		spoolPath = flag.String("spool", "", "Override path to spool")
 		logPath   = flag.String("log", "", "Override path to logfile")
+		metrics   = flag.String("metrics", "", "Serve HTTP metrics on that address")
+		control   = flag.String("control", "", "Serve control commands on that Unix socket path")
 		quiet     = flag.Bool("quiet", false, "Print only errors")
 		showPrgrs = flag.Bool("progress", false, "Force progress showing")
 		omitPrgrs = flag.Bool("noprogress", false, "Omit progress showing")
@@ -90,103 +135,128 @@ func main() {
 	}
 	ctx.Umask()
 
-	var nodes []*nncp.Node
-	if flag.NArg() > 0 {
-		for _, nodeId := range flag.Args() {
-			node, err := ctx.FindNode(nodeId)
-			if err != nil {
-				log.Fatalln("Invalid NODE specified:", err)
-			}
-			if node.NoisePub == nil {
-				log.Fatalln("Node", nodeId, "does not have online communication capability")
-			}
-			if len(node.Calls) == 0 {
-				ctx.LogD(
-					"caller-no-calls",
-					nncp.LEs{{K: "Node", V: node.Id}},
-					func(les nncp.LEs) string {
-						return fmt.Sprintf("%s node has no calls, skipping", node.Name)
-					},
-				)
-				continue
-			}
-			nodes = append(nodes, node)
+	if *metrics != "" {
+		if err = ctx.MetricsListen(*metrics); err != nil {
+			log.Fatalln("Can not serve metrics:", err)
 		}
-	} else {
-		for _, node := range ctx.Neigh {
-			if len(node.Calls) == 0 {
-				ctx.LogD(
-					"caller-no-calls",
-					nncp.LEs{{K: "Node", V: node.Id}},
-					func(les nncp.LEs) string {
-						return fmt.Sprintf("%s node has no calls, skipping", node.Name)
-					},
-				)
-				continue
-			}
-			nodes = append(nodes, node)
+	}
+	if *control != "" {
+		if err = ctx.ControlListen(*control); err != nil {
+			log.Fatalln("Can not serve control:", err)
 		}
 	}
 
-	ifis, err := net.Interfaces()
+	nodes, err := nodesToCall(ctx, flag.Args())
 	if err != nil {
-		log.Fatalln("Can not get network interfaces list:", err)
+		log.Fatalln(err)
 	}
-	for _, ifiReString := range ctx.MCDRxIfis {
-		ifiRe, err := regexp.CompilePOSIX(ifiReString)
-		if err != nil {
-			log.Fatalf("Can not compile POSIX regexp \"%s\": %s", ifiReString, err)
-		}
-		for _, ifi := range ifis {
-			if ifiRe.MatchString(ifi.Name) {
-				if err = ctx.MCDRx(ifi.Name); err != nil {
-					log.Printf("Can not run MCD reception on %s: %s", ifi.Name, err)
-				}
-			}
-		}
+
+	if err = ctx.MCDRxStart(); err != nil {
+		log.Fatalln("Can not run MCD reception:", err)
 	}
 
-	var wg sync.WaitGroup
-	for _, node := range nodes {
-		for i, call := range node.Calls {
-			wg.Add(1)
-			go func(node *nncp.Node, i int, call *nncp.Call) {
-				defer wg.Done()
-				var addrsFromCfg []string
-				if call.Addr == nil {
-					for _, addr := range node.Addrs {
-						addrsFromCfg = append(addrsFromCfg, addr)
+	// Nodes being called, tracked by their identifiers, as Node
+	// structures are recreated during the configuration reload
+	busy := make(map[nncp.NodeId]bool)
+	var busyM sync.Mutex
+
+	schedule := func(
+		ctx *nncp.Ctx,
+		nodes []*nncp.Node,
+		stop chan struct{},
+	) *sync.WaitGroup {
+		var wg sync.WaitGroup
+		for _, node := range nodes {
+			for i, call := range node.Calls {
+				wg.Add(1)
+				go func(node *nncp.Node, i int, call *nncp.Call) {
+					defer wg.Done()
+					var addrsFromCfg []string
+					if call.Addr == nil {
+						for _, addr := range node.Addrs {
+							addrsFromCfg = append(addrsFromCfg, addr)
+						}
+					} else {
+						addrsFromCfg = append(addrsFromCfg, *call.Addr)
 					}
-				} else {
-					addrsFromCfg = append(addrsFromCfg, *call.Addr)
-				}
-				les := nncp.LEs{{K: "Node", V: node.Id}, {K: "CallIndex", V: i}}
-				logMsg := func(les nncp.LEs) string {
-					return fmt.Sprintf("%s node, call %d", node.Name, i)
-				}
-				for {
-					n := time.Now()
-					t := call.Cron.Next(n)
-					ctx.LogD("caller-time", les, func(les nncp.LEs) string {
-						return logMsg(les) + ": " + t.String()
-					})
-					if t.IsZero() {
-						ctx.LogE("caller", les, errors.New("got zero time"), logMsg)
-						return
+					les := nncp.LEs{{K: "Node", V: node.Id}, {K: "CallIndex", V: i}}
+					logMsg := func(les nncp.LEs) string {
+						return fmt.Sprintf("%s node, call %d", node.Name, i)
 					}
-					time.Sleep(t.Sub(n))
-					node.Lock()
-					if node.Busy {
-						node.Unlock()
-						ctx.LogD("caller-busy", les, func(les nncp.LEs) string {
-							return logMsg(les) + ": busy"
+					trigger := ctx.Control.CallTrigger(node.Id, i)
+					defer ctx.Control.CallTriggerRelease(node.Id, i, trigger)
+					var txTrigger chan struct{}
+					if call.WhenTxNice != nil || call.WhenTxSize > 0 {
+						var err error
+						txTrigger, err = ctx.CallTxWatch(node.Id, call, stop)
+						if err != nil {
+							ctx.LogE("caller-tx-watch", les, err, logMsg)
+						}
+					}
+					for {
+						n := time.Now()
+						t := call.Cron.Next(n)
+						ctx.LogD("caller-time", les, func(les nncp.LEs) string {
+							return logMsg(les) + ": " + t.String()
 						})
-						continue
-					} else {
-						node.Busy = true
-						node.Unlock()
+						if t.IsZero() {
+							ctx.LogE("caller", les, errors.New("got zero time"), logMsg)
+							return
+						}
+						triggered := false
+						txTriggered := false
+						timer := time.NewTimer(t.Sub(n))
+						select {
+						case <-stop:
+							timer.Stop()
+							return
+						case <-timer.C:
+						case <-txTrigger:
+							timer.Stop()
+							txTriggered = true
+							ctx.LogD("caller-tx-triggered", les, func(les nncp.LEs) string {
+								return logMsg(les) + ": triggered by outbound queue"
+							})
+						case <-trigger:
+							timer.Stop()
+							triggered = true
+							ctx.LogI("caller-triggered", les, func(les nncp.LEs) string {
+								return logMsg(les) + ": triggered through control"
+							})
+						}
+						if !triggered && ctx.Control.Paused() {
+							ctx.LogD("caller-paused", les, func(les nncp.LEs) string {
+								return logMsg(les) + ": paused"
+							})
+							continue
+						}
+						if !triggered {
+							cs, err := ctx.CallStateRead(node.Id)
+							if err != nil {
+								ctx.LogE("caller-state", les, err, logMsg)
+							} else if cs.BackingOff(time.Now()) {
+								ctx.LogD("caller-backoff", les, func(les nncp.LEs) string {
+									return fmt.Sprintf(
+										"%s: backing off after %d failures till %s",
+										logMsg(les), cs.Failures, cs.Backoff,
+									)
+								})
+								continue
+							}
+						}
+						busyM.Lock()
+						if busy[*node.Id] {
+							busyM.Unlock()
+							ctx.LogD("caller-busy", les, func(les nncp.LEs) string {
+								return logMsg(les) + ": busy"
+							})
+							continue
+						}
+						busy[*node.Id] = true
+						busyM.Unlock()
+						ctx.ResendLocked(node.Id)
 
-						if call.WhenTxExists && call.Xx != "TRx" {
+						if call.WhenTxExists && call.Xx != "TRx" && !triggered && !txTriggered {
 							ctx.LogD("caller", les, func(les nncp.LEs) string {
 								return logMsg(les) + ": checking tx existence"
 							})
@@ -201,9 +271,9 @@ func main() {
 								ctx.LogD("caller-no-tx", les, func(les nncp.LEs) string {
 									return logMsg(les) + ": no tx"
 								})
-								node.Lock()
-								node.Busy = false
-								node.Unlock()
+								busyM.Lock()
+								delete(busy, *node.Id)
+								busyM.Unlock()
 								continue
 							}
 						}
@@ -211,7 +281,8 @@ func main() {
 						var autoTossFinish chan struct{}
 						var autoTossBadCode chan bool
 						if call.AutoToss || *autoToss {
-							autoTossFinish, autoTossBadCode = ctx.AutoToss(
+							var err error
+							autoTossFinish, autoTossBadCode, err = ctx.AutoToss(
 								node.Id,
 								call.Nice,
 								call.AutoTossDoSeen || *autoTossDoSeen,
@@ -222,19 +293,21 @@ func main() {
 								call.AutoTossNoArea || *autoTossNoArea,
 								call.AutoTossNoACK || *autoTossNoACK,
 							)
+							if err != nil {
+								ctx.LogE("caller-autotoss", les, err, func(les nncp.LEs) string {
+									return logMsg(les) + ": can not run auto tossing"
+								})
+							}
 						}
 
 						var addrs []string
 						if !call.MCDIgnore {
-							nncp.MCDAddrsM.RLock()
-							for _, mcdAddr := range nncp.MCDAddrs[*node.Id] {
+							for _, mcdAddr := range nncp.MCDNodeAddrs(node.Id) {
 								ctx.LogD("caller", les, func(les nncp.LEs) string {
-									return logMsg(les) + ": adding MCD address: " +
-										mcdAddr.Addr.String()
+									return logMsg(les) + ": adding MCD address: " + mcdAddr
 								})
-								addrs = append(addrs, mcdAddr.Addr.String())
+								addrs = append(addrs, mcdAddr)
 							}
-							nncp.MCDAddrsM.RUnlock()
 						}
 
 						ctx.CallNode(
@@ -244,26 +317,75 @@ func main() {
 							call.Xx,
 							call.RxRate,
 							call.TxRate,
+							call.RxLimit,
+							call.TxLimit,
 							call.OnlineDeadline,
 							call.MaxOnlineTime,
 							false,
 							call.NoCK,
 							nil,
+							call.Parallel,
 						)
 
-						if call.AutoToss || *autoToss {
+						if autoTossFinish != nil {
 							close(autoTossFinish)
 							<-autoTossBadCode
 						}
 
-						node.Lock()
-						node.Busy = false
-						node.Unlock()
+						busyM.Lock()
+						delete(busy, *node.Id)
+						busyM.Unlock()
 					}
-				}
-			}(node, i, call)
+				}(node, i, call)
+			}
+		}
+		return &wg
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan struct{})
+	wg := schedule(ctx, nodes, stop)
+	// Schedules of the previous configurations, still finishing their
+	// calls. Their contexts are released after that
+	var wgOld sync.WaitGroup
+	for {
+		done := make(chan struct{})
+		go func(wg *sync.WaitGroup) {
+			wg.Wait()
+			close(done)
+		}(wg)
+		select {
+		case <-done:
+			wgOld.Wait()
+			nncp.SPCheckerWg.Wait()
+			return
+		case <-hup:
+		}
+		ctx.LogI("caller-reload", nil, func(les nncp.LEs) string {
+			return "Reloading configuration"
+		})
+		newCtx, err := ctx.Reload()
+		if err == nil {
+			nodes, err = nodesToCall(newCtx, flag.Args())
+		}
+		if err != nil {
+			ctx.LogE("caller-reload", nil, err, func(les nncp.LEs) string {
+				return "Reloading configuration"
+			})
+			continue
 		}
+		newCtx.Umask()
+		ctx = newCtx
+		close(stop)
+		stop = make(chan struct{})
+		// Calls being made are not interrupted and finish with the old
+		// context, marking their nodes as busy until then
+		wgOld.Add(1)
+		go func(wg *sync.WaitGroup) {
+			wg.Wait()
+			wgOld.Done()
+		}(wg)
+		wg = schedule(ctx, nodes, stop)
 	}
-	wg.Wait()
-	nncp.SPCheckerWg.Wait()
 }
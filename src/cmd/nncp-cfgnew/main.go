@@ -203,6 +203,8 @@ func main() {
   # Interfaces regular expressions and intervals (in seconds) where to send
   # MCD announcements
   mcd-send: {.*: 10}
+  # Regular expression can be followed by discovery target, like
+  # IPv4 broadcast or multicast address: "eth0 255.255.255.255:5400"
 
   # Yggdrasil related aliases:
   # yggdrasil-aliases: {
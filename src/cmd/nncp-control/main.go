@@ -0,0 +1,71 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Control running NNCP daemon/caller.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"go.cypherpunks.ru/nncp/v8"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, nncp.UsageHeader())
+	fmt.Fprintf(os.Stderr, "nncp-control -- control running daemon/caller\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s -control PATH COMMAND [ARG ...]\nOptions:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(os.Stderr, `
+Commands:
+  list                 -- list active sessions
+  kill ID              -- terminate the session
+  call NODE [INDEX]    -- make the call immediately
+  pause                -- pause scheduled calls
+  resume               -- resume scheduled calls
+`)
+}
+
+func main() {
+	var (
+		control  = flag.String("control", "", "Path to daemon's/caller's control socket")
+		version  = flag.Bool("version", false, "Print version information")
+		warranty = flag.Bool("warranty", false, "Print warranty information")
+	)
+	log.SetFlags(log.Lshortfile)
+	flag.Usage = usage
+	flag.Parse()
+	if *warranty {
+		fmt.Println(nncp.Warranty)
+		return
+	}
+	if *version {
+		fmt.Println(nncp.VersionGet())
+		return
+	}
+	if *control == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+	out, err := nncp.ControlRequest(*control, flag.Args())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Print(out)
+}
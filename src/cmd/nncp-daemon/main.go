@@ -23,10 +23,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -54,6 +57,7 @@ func performSP(
 		Ctx:  ctx,
 		Nice: nice,
 		NoCK: noCK,
+		Addr: addr,
 	}
 	if err := state.StartR(conn); err == nil {
 		ctx.LogI(
@@ -106,36 +110,31 @@ func performSP(
 	close(nodeIdC)
 }
 
-func startMCDTx(ctx *nncp.Ctx, port int, zeroInterval bool) error {
-	ifis, err := net.Interfaces()
-	if err != nil {
-		return err
-	}
-	for ifiReString, secs := range ctx.MCDTxIfis {
-		ifiRe, err := regexp.CompilePOSIX(ifiReString)
-		if err != nil {
-			return err
-		}
-		var interval time.Duration
-		if !zeroInterval {
-			interval = time.Duration(secs) * time.Second
-		}
-		for _, ifi := range ifis {
-			if ifiRe.MatchString(ifi.Name) {
-				if err = ctx.MCDTx(ifi.Name, port, interval); err != nil {
-					return err
-				}
-			}
+// Requeue not acknowledged in time packets of all resending nodes.
+func resendAll(ctx *nncp.Ctx) {
+	for _, node := range ctx.Neigh {
+		if node.Resend != 0 {
+			ctx.ResendLocked(node.Id)
 		}
 	}
-	return nil
+}
+
+func startMCDTx(ctx *nncp.Ctx, ip net.IP, port int, zeroInterval bool) error {
+	var addrs []string
+	if ip != nil && !ip.IsUnspecified() {
+		addrs = []string{ip.String()}
+	}
+	return ctx.MCDTxStart(port, addrs, zeroInterval)
 }
 
 func main() {
 	var (
 		cfgPath   = flag.String("cfg", nncp.DefaultCfgPath, "Path to configuration file")
 		niceRaw   = flag.String("nice", nncp.NicenessFmt(255), "Minimal required niceness")
-		bind      = flag.String("bind", "[::]:5400", "Address to bind to")
+		bind      = flag.String("bind", "[::]:5400", "Address to bind to, or unix:///path")
+		bindMode  = flag.String("bind-mode", "", "Octal permissions of Unix domain socket")
+		wsBind    = flag.String("bind-ws", "", "Address to bind WebSocket HTTP listener to")
+		quicBind  = flag.String("bind-quic", "", "Address to bind QUIC listener to")
 		ucspi     = flag.Bool("ucspi", false, "Is it started as UCSPI-TCP server")
 		inetd     = flag.Bool("inetd", false, "Obsolete, use -ucspi")
 		yggdrasil = flag.String("yggdrasil", "", "Start Yggdrasil listener: yggdrasils://PRV[:PORT]?[bind=BIND][&pub=PUB][&peer=PEER][&mcast=REGEX[:PORT]]")
@@ -144,6 +143,10 @@ func main() {
 		mcdOnce   = flag.Bool("mcd-once", false, "Send MCDs once and quit")
 		spoolPath = flag.String("spool", "", "Override path to spool")
 		logPath   = flag.String("log", "", "Override path to logfile")
+		metrics   = flag.String("metrics", "", "Serve HTTP metrics on that address")
+		control   = flag.String("control", "", "Serve control commands on that Unix socket path")
+		rxLimit   = flag.Uint64("rxlimit", 0, "Maximal total receive rate, KiB/sec")
+		txLimit   = flag.Uint64("txlimit", 0, "Maximal total transmit rate, KiB/sec")
 		quiet     = flag.Bool("quiet", false, "Print only errors")
 		showPrgrs = flag.Bool("progress", false, "Force progress showing")
 		omitPrgrs = flag.Bool("noprogress", false, "Omit progress showing")
@@ -194,7 +197,19 @@ func main() {
 	if ctx.Self == nil {
 		log.Fatalln("Config lacks private keys")
 	}
-	ctx.Umask()
+	// Command line options are applied again after configuration reload
+	rxLimiter := nncp.NewRateLimiter(int64(*rxLimit) * 1024)
+	txLimiter := nncp.NewRateLimiter(int64(*txLimit) * 1024)
+	setup := func(ctx *nncp.Ctx) {
+		if rxLimiter != nil {
+			ctx.RxLimiter = rxLimiter
+		}
+		if txLimiter != nil {
+			ctx.TxLimiter = txLimiter
+		}
+		ctx.Umask()
+	}
+	setup(ctx)
 
 	if *ucspi {
 		os.Stderr.Close()
@@ -204,12 +219,14 @@ func main() {
 		if addr == "" {
 			addr = "PIPE"
 		}
+		resendAll(ctx)
 		go performSP(ctx, conn, addr, nice, *noCK, nodeIdC)
 		nodeId := <-nodeIdC
 		var autoTossFinish chan struct{}
 		var autoTossBadCode chan bool
 		if *autoToss && nodeId != nil {
-			autoTossFinish, autoTossBadCode = ctx.AutoToss(
+			var err error
+			autoTossFinish, autoTossBadCode, err = ctx.AutoToss(
 				nodeId,
 				nice,
 				*autoTossDoSeen,
@@ -220,9 +237,17 @@ func main() {
 				*autoTossNoArea,
 				*autoTossNoACK,
 			)
+			if err != nil {
+				ctx.LogE(
+					"daemon-autotoss", nncp.LEs{{K: "Node", V: nodeId}}, err,
+					func(les nncp.LEs) string {
+						return "Can not run auto tossing"
+					},
+				)
+			}
 		}
 		<-nodeIdC // call completion
-		if *autoToss && nodeId != nil {
+		if autoTossFinish != nil {
 			close(autoTossFinish)
 			<-autoTossBadCode
 		}
@@ -230,16 +255,91 @@ func main() {
 		return
 	}
 
+	if *metrics != "" {
+		if err = ctx.MetricsListen(*metrics); err != nil {
+			log.Fatalln("Can not serve metrics:", err)
+		}
+	}
+	if *control != "" {
+		if err = ctx.ControlListen(*control); err != nil {
+			log.Fatalln("Can not serve control:", err)
+		}
+	}
+
 	conns := make(chan net.Conn)
-	if *bind != "" {
+	sdLns, err := nncp.SystemdListeners()
+	if err != nil {
+		log.Fatalln("Can not use socket activation:", err)
+	}
+	if len(sdLns) > 0 {
+		port := 0
+		var ip net.IP
+		for _, ln := range sdLns {
+			if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+				ip, port = tcpAddr.IP, tcpAddr.Port
+				break
+			}
+		}
+		if port != 0 {
+			if err = startMCDTx(ctx, ip, port, *mcdOnce); err != nil {
+				log.Fatalln("Can not do MCD transmission:", err)
+			}
+			if *mcdOnce {
+				return
+			}
+		} else if *mcdOnce {
+			log.Fatalln("MCD requires TCP socket")
+		}
+		for _, ln := range sdLns {
+			ln = netutil.LimitListener(ln, *maxConn)
+			go func(ln net.Listener) {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						log.Fatalln("Can not accept connection on activated socket:", err)
+					}
+					conns <- conn
+				}
+			}(ln)
+		}
+	} else if nncp.IsUnixAddr(*bind) {
+		if *mcdOnce {
+			log.Fatalln("MCD is not supported with Unix domain socket")
+		}
+		var mode uint64
+		if *bindMode != "" {
+			mode, err = strconv.ParseUint(*bindMode, 8, 32)
+			if err != nil {
+				log.Fatalln("Can not parse -bind-mode:", err)
+			}
+		}
+		ln, err := nncp.UnixListen(*bind, os.FileMode(mode))
+		if err != nil {
+			log.Fatalln("Can not listen:", err)
+		}
+		ln = netutil.LimitListener(ln, *maxConn)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					log.Fatalln("Can not accept connection on Unix socket:", err)
+				}
+				conns <- conn
+			}
+		}()
+	} else if *bind != "" {
 		cols := strings.Split(*bind, ":")
 		port, err := strconv.Atoi(cols[len(cols)-1])
 		if err != nil {
 			log.Fatalln("Can not parse port:", err)
 		}
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(*bind); err == nil {
+			ip = net.ParseIP(host)
+		}
 
 		if *mcdOnce {
-			if err = startMCDTx(ctx, port, true); err != nil {
+			if err = startMCDTx(ctx, ip, port, true); err != nil {
 				log.Fatalln("Can not do MCD transmission:", err)
 			}
 			return
@@ -249,7 +349,7 @@ func main() {
 		if err != nil {
 			log.Fatalln("Can not listen:", err)
 		}
-		if err = startMCDTx(ctx, port, false); err != nil {
+		if err = startMCDTx(ctx, ip, port, false); err != nil {
 			log.Fatalln("Can not do MCD transmission:", err)
 		}
 		ln = netutil.LimitListener(ln, *maxConn)
@@ -264,6 +364,37 @@ func main() {
 		}()
 	}
 
+	if *quicBind != "" {
+		quicLn, err := nncp.QUICListen(*quicBind)
+		if err != nil {
+			log.Fatalln("Can not listen:", err)
+		}
+		ln := netutil.LimitListener(quicLn, *maxConn)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					log.Fatalln("Can not accept connection on QUIC:", err)
+				}
+				conns <- conn
+			}
+		}()
+	}
+
+	if *wsBind != "" {
+		ln, err := net.Listen("tcp", *wsBind)
+		if err != nil {
+			log.Fatalln("Can not listen:", err)
+		}
+		ln = netutil.LimitListener(ln, *maxConn)
+		go func() {
+			log.Fatalln(
+				"Can not serve WebSocket:",
+				http.Serve(ln, nncp.WSHandler(conns)),
+			)
+		}()
+	}
+
 	if *yggdrasil != "" {
 		ln, err := nncpYggdrasil.NewListener(ctx.YggdrasilAliases, *yggdrasil)
 		if err != nil {
@@ -281,22 +412,59 @@ func main() {
 		}()
 	}
 
+	var ctxP atomic.Pointer[nncp.Ctx]
+	ctxP.Store(ctx)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ctx := ctxP.Load()
+			ctx.LogI("daemon-reload", nil, func(les nncp.LEs) string {
+				return "Reloading configuration"
+			})
+			newCtx, err := ctx.Reload()
+			if err != nil {
+				ctx.LogE("daemon-reload", nil, err, func(les nncp.LEs) string {
+					return "Reloading configuration"
+				})
+				continue
+			}
+			setup(newCtx)
+			// Only new sessions use the new context
+			ctxP.Store(newCtx)
+		}
+	}()
+
+	go func() {
+		for {
+			resendAll(ctxP.Load())
+			time.Sleep(time.Minute)
+		}
+	}()
+
 	for conn := range conns {
+		ctx := ctxP.Load()
+		addr := conn.RemoteAddr().String()
+		if (addr == "" || addr == "@") && conn.LocalAddr().Network() == "unix" {
+			// Unix domain socket peers are usually unnamed
+			addr = nncp.UnixScheme + conn.LocalAddr().String()
+		}
 		ctx.LogD(
 			"daemon-accepted",
-			nncp.LEs{{K: "Addr", V: conn.RemoteAddr()}},
+			nncp.LEs{{K: "Addr", V: addr}},
 			func(les nncp.LEs) string {
-				return "Accepted connection with " + conn.RemoteAddr().String()
+				return "Accepted connection with " + addr
 			},
 		)
-		go func(conn net.Conn) {
+		go func(conn net.Conn, addr string) {
 			nodeIdC := make(chan *nncp.NodeId)
-			go performSP(ctx, conn, conn.RemoteAddr().String(), nice, *noCK, nodeIdC)
+			go performSP(ctx, conn, addr, nice, *noCK, nodeIdC)
 			nodeId := <-nodeIdC
 			var autoTossFinish chan struct{}
 			var autoTossBadCode chan bool
 			if *autoToss && nodeId != nil {
-				autoTossFinish, autoTossBadCode = ctx.AutoToss(
+				var err error
+				autoTossFinish, autoTossBadCode, err = ctx.AutoToss(
 					nodeId,
 					nice,
 					*autoTossDoSeen,
@@ -307,14 +475,22 @@ func main() {
 					*autoTossNoArea,
 					*autoTossNoACK,
 				)
+				if err != nil {
+					ctx.LogE(
+						"daemon-autotoss", nncp.LEs{{K: "Node", V: nodeId}}, err,
+						func(les nncp.LEs) string {
+							return "Can not run auto tossing"
+						},
+					)
+				}
 			}
 			<-nodeIdC // call completion
-			if *autoToss && nodeId != nil {
+			if autoTossFinish != nil {
 				close(autoTossFinish)
 				<-autoTossBadCode
 			}
 			conn.Close()
-		}(conn)
+		}(conn, addr)
 
 	}
 }
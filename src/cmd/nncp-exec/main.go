@@ -47,6 +47,7 @@ func main() {
 		minSize      = flag.Uint64("minsize", 0, "Minimal required resulting packet size, in KiB")
 		argMaxSize   = flag.Uint64("maxsize", 0, "Maximal allowable resulting packet size, in KiB")
 		viaOverride  = flag.String("via", "", "Override Via path to destination node")
+		expire       = flag.Duration("expire", 0, "Packet's lifetime, after which it is dropped")
 		spoolPath    = flag.String("spool", "", "Override path to spool")
 		logPath      = flag.String("log", "", "Override path to logfile")
 		quiet        = flag.Bool("quiet", false, "Print only errors")
@@ -117,6 +118,9 @@ func main() {
 	}
 
 	nncp.ViaOverride(*viaOverride, ctx, node)
+	if *expire > 0 {
+		node.Expire = *expire
+	}
 	ctx.Umask()
 
 	if err = ctx.TxExec(
@@ -52,6 +52,7 @@ func main() {
 		argMaxSize   = flag.Uint64("maxsize", 0, "Maximal allowable resulting packets size, in KiB")
 		argChunkSize = flag.Int64("chunked", -1, "Split file on specified size chunks, in KiB")
 		viaOverride  = flag.String("via", "", "Override Via path to destination node")
+		expire       = flag.Duration("expire", 0, "Packet's lifetime, after which it is dropped")
 		spoolPath    = flag.String("spool", "", "Override path to spool")
 		logPath      = flag.String("log", "", "Override path to logfile")
 		quiet        = flag.Bool("quiet", false, "Print only errors")
@@ -124,6 +125,9 @@ func main() {
 	}
 
 	nncp.ViaOverride(*viaOverride, ctx, node)
+	if *expire > 0 {
+		node.Expire = *expire
+	}
 	ctx.Umask()
 
 	var chunkSize int64
@@ -43,6 +43,7 @@ func main() {
 		replyNiceRaw = flag.String("replynice", nncp.NicenessFmt(nncp.DefaultNiceFile), "Reply file packet niceness")
 		minSize      = flag.Uint64("minsize", 0, "Minimal required resulting packet size, in KiB")
 		viaOverride  = flag.String("via", "", "Override Via path to destination node")
+		expire       = flag.Duration("expire", 0, "Packet's lifetime, after which it is dropped")
 		spoolPath    = flag.String("spool", "", "Override path to spool")
 		logPath      = flag.String("log", "", "Override path to logfile")
 		quiet        = flag.Bool("quiet", false, "Print only errors")
@@ -103,6 +104,9 @@ func main() {
 	}
 
 	nncp.ViaOverride(*viaOverride, ctx, node)
+	if *expire > 0 {
+		node.Expire = *expire
+	}
 	ctx.Umask()
 
 	var dst string
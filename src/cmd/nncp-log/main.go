@@ -24,9 +24,11 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"go.cypherpunks.ru/nncp/v8"
-	"go.cypherpunks.ru/recfile"
 )
 
 func usage() {
@@ -40,6 +42,11 @@ func main() {
 	var (
 		cfgPath  = flag.String("cfg", nncp.DefaultCfgPath, "Path to configuration file")
 		logPath  = flag.String("log", "", "Override path to logfile")
+		nodesRaw = flag.String("node", "", "Only records of comma-separated nodes")
+		pktsRaw  = flag.String("pkt", "", "Only records of comma-separated packets")
+		whosRaw  = flag.String("who", "", "Only records of comma-separated Who-s")
+		sinceRaw = flag.String("since", "", "Only records since that RFC3339 time")
+		untilRaw = flag.String("until", "", "Only records before that RFC3339 time")
 		debug    = flag.Bool("debug", false, "Print debug messages")
 		version  = flag.Bool("version", false, "Print version information")
 		warranty = flag.Bool("warranty", false, "Print warranty information")
@@ -61,11 +68,43 @@ func main() {
 		log.Fatalln("Error during initialization:", err)
 	}
 
+	var filter nncp.LogFilter
+	if *nodesRaw != "" {
+		for _, nodeRaw := range strings.Split(*nodesRaw, ",") {
+			node, err := ctx.FindNode(nodeRaw)
+			if err != nil {
+				log.Fatalln("Invalid -node specified:", err)
+			}
+			filter.Nodes = append(filter.Nodes, node.Id.String())
+		}
+		sort.Strings(filter.Nodes)
+	}
+	if *pktsRaw != "" {
+		filter.Pkts = strings.Split(*pktsRaw, ",")
+		sort.Strings(filter.Pkts)
+	}
+	if *whosRaw != "" {
+		filter.Whos = strings.Split(*whosRaw, ",")
+		sort.Strings(filter.Whos)
+	}
+	if *sinceRaw != "" {
+		filter.Since, err = time.Parse(time.RFC3339, *sinceRaw)
+		if err != nil {
+			log.Fatalln("Invalid -since specified:", err)
+		}
+	}
+	if *untilRaw != "" {
+		filter.Until, err = time.Parse(time.RFC3339, *untilRaw)
+		if err != nil {
+			log.Fatalln("Invalid -until specified:", err)
+		}
+	}
+
 	fd, err := os.Open(ctx.LogPath)
 	if err != nil {
 		log.Fatalln("Can not open log:", err)
 	}
-	r := recfile.NewReader(fd)
+	r := nncp.NewLogReader(fd)
 	for {
 		le, err := r.NextMap()
 		if err != nil {
@@ -74,6 +113,9 @@ func main() {
 			}
 			log.Fatalln("Can not read log:", err)
 		}
+		if !filter.Match(le) {
+			continue
+		}
 		if *debug {
 			fmt.Println(le)
 		}
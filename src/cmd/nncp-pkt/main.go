@@ -26,6 +26,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	xdr "github.com/davecgh/go-xdr/xdr2"
 	"github.com/klauspost/compress/zstd"
@@ -76,6 +77,8 @@ func doPlain(ctx *nncp.Ctx, pkt nncp.Pkt, dump, decompress bool) {
 		payloadType = "area"
 	case nncp.PktTypeACK:
 		payloadType = "acknowledgement"
+	case nncp.PktTypeReceipt:
+		payloadType = "delivery receipt"
 	}
 	var path string
 	switch pkt.Type {
@@ -94,7 +97,7 @@ func doPlain(ctx *nncp.Ctx, pkt nncp.Pkt, dump, decompress bool) {
 		if areaId, err := nncp.AreaIdFromString(path); err == nil {
 			path = fmt.Sprintf("%s (%s)", path, ctx.AreaName(areaId))
 		}
-	case nncp.PktTypeACK:
+	case nncp.PktTypeACK, nncp.PktTypeReceipt:
 		path = nncp.Base32Codec.EncodeToString(pkt.Path[:pkt.PathLen])
 	default:
 		path = string(pkt.Path[:pkt.PathLen])
@@ -131,12 +134,21 @@ func doEncrypted(
 	}
 
 	if !dump {
+		expire := "never"
+		if pktEnc.Expire != 0 {
+			expire = time.Unix(int64(pktEnc.Expire), 0).UTC().Format(time.RFC3339)
+			if pktEnc.Expired(time.Now()) {
+				expire += " (expired)"
+			}
+		}
 		fmt.Printf(`Packet type: encrypted
 Niceness: %s (%d)
+Expire: %s
 Sender: %s (%s)
 Recipient: %s (%s)
 `,
 			nncp.NicenessFmt(pktEnc.Nice), pktEnc.Nice,
+			expire,
 			pktEnc.Sender, senderName,
 			pktEnc.Recipient, recipientName,
 		)
@@ -211,8 +223,7 @@ func main() {
 	if _, err := io.ReadFull(os.Stdin, beginning[:nncp.PktEncOverhead]); err != nil {
 		log.Fatalln("Not enough data to read")
 	}
-	var pktEnc nncp.PktEnc
-	if _, err := xdr.Unmarshal(bytes.NewReader(beginning), &pktEnc); err == nil {
+	if pktEnc, _, err := nncp.PktEncUnmarshal(bytes.NewReader(beginning)); err == nil {
 		switch pktEnc.Magic {
 		case nncp.MagicNNCPEv1.B:
 			log.Fatalln(nncp.MagicNNCPEv1.TooOld())
@@ -224,8 +235,8 @@ func main() {
 			log.Fatalln(nncp.MagicNNCPEv4.TooOld())
 		case nncp.MagicNNCPEv5.B:
 			log.Fatalln(nncp.MagicNNCPEv5.TooOld())
-		case nncp.MagicNNCPEv6.B:
-			doEncrypted(ctx, pktEnc, *dump, beginning[:nncp.PktEncOverhead])
+		case nncp.MagicNNCPEv6.B, nncp.MagicNNCPEv7.B:
+			doEncrypted(ctx, *pktEnc, *dump, beginning[:nncp.PktEncOverhead])
 			return
 		}
 	}
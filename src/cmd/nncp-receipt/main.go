@@ -0,0 +1,120 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Show end-to-end delivery receipts state.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"go.cypherpunks.ru/nncp/v8"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, nncp.UsageHeader())
+	fmt.Fprintf(os.Stderr, "nncp-receipt -- show delivery receipts state\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [-node NODE] [-pkt PKT] [-pending]\nOptions:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var (
+		cfgPath   = flag.String("cfg", nncp.DefaultCfgPath, "Path to configuration file")
+		nodeRaw   = flag.String("node", "", "Process only that node")
+		pktRaw    = flag.String("pkt", "", "Show only that packet (or receipt) state")
+		pending   = flag.Bool("pending", false, "Show only undelivered packets")
+		spoolPath = flag.String("spool", "", "Override path to spool")
+		debug     = flag.Bool("debug", false, "Print debug messages")
+		version   = flag.Bool("version", false, "Print version information")
+		warranty  = flag.Bool("warranty", false, "Print warranty information")
+	)
+	log.SetFlags(log.Lshortfile)
+	flag.Usage = usage
+	flag.Parse()
+	if *warranty {
+		fmt.Println(nncp.Warranty)
+		return
+	}
+	if *version {
+		fmt.Println(nncp.VersionGet())
+		return
+	}
+
+	ctx, err := nncp.CtxFromCmdline(*cfgPath, *spoolPath, "", false, false, false, *debug)
+	if err != nil {
+		log.Fatalln("Error during initialization:", err)
+	}
+
+	var nodeOnly *nncp.Node
+	if *nodeRaw != "" {
+		nodeOnly, err = ctx.FindNode(*nodeRaw)
+		if err != nil {
+			log.Fatalln("Invalid -node specified:", err)
+		}
+	}
+
+	nodeNames := make([]string, 0, len(ctx.Neigh))
+	nodeNameToNode := make(map[string]*nncp.Node, len(ctx.Neigh))
+	for _, node := range ctx.Neigh {
+		nodeNames = append(nodeNames, node.Name)
+		nodeNameToNode[node.Name] = node
+	}
+	sort.Strings(nodeNames)
+
+	ctx.Umask()
+	for _, nodeName := range nodeNames {
+		node := nodeNameToNode[nodeName]
+		if nodeOnly != nil && *node.Id != *nodeOnly.Id {
+			continue
+		}
+		receipts, err := ctx.Receipts(node.Id)
+		if err != nil {
+			log.Fatalln("Can not read receipts:", err)
+		}
+		nodePrinted := false
+		for _, r := range receipts {
+			if *pktRaw != "" && r.Pkt != *pktRaw && r.Msg != *pktRaw {
+				continue
+			}
+			if *pending && r.Delivered != nil {
+				continue
+			}
+			if !nodePrinted {
+				fmt.Println(node.Name)
+				nodePrinted = true
+			}
+			state := "pending"
+			if r.Delivered != nil {
+				state = "delivered " + r.Delivered.Format(time.RFC3339)
+			}
+			fmt.Printf(
+				"\t%s %s %s (%s, nice: %s) sent %s: %s\n",
+				r.Pkt, r.Type, r.Path,
+				humanize.IBytes(uint64(r.Size)),
+				nncp.NicenessFmt(r.Nice),
+				r.Sent.Format(time.RFC3339),
+				state,
+			)
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"go.cypherpunks.ru/nncp/v8"
@@ -46,6 +47,30 @@ func jobPrint(xx nncp.TRxTx, job nncp.Job, suffix string) {
 	)
 }
 
+func callStatePrint(ctx *nncp.Ctx, node *nncp.Node) {
+	cs, err := ctx.CallStateRead(node.Id)
+	if err != nil {
+		log.Fatalln("Can not read call state:", err)
+	}
+	if cs.LastAttempt.IsZero() {
+		return
+	}
+	fmt.Printf("\tcall: last attempt %s", cs.LastAttempt.Format(time.RFC3339))
+	if !cs.LastSuccess.IsZero() {
+		fmt.Printf(
+			", last success %s (%s)",
+			cs.LastSuccess.Format(time.RFC3339), cs.LastAddr,
+		)
+	}
+	if cs.BackingOff(time.Now()) {
+		fmt.Printf(
+			", backoff till %s after %d failures",
+			cs.Backoff.Format(time.RFC3339), cs.Failures,
+		)
+	}
+	fmt.Printf("\n")
+}
+
 func main() {
 	var (
 		showPkt   = flag.Bool("pkt", false, "Show packets listing")
@@ -97,6 +122,9 @@ func main() {
 			continue
 		}
 		fmt.Println(node.Name)
+		if node.NoisePub != nil {
+			callStatePrint(ctx, node)
+		}
 		rxNums := make(map[uint8]int)
 		rxBytes := make(map[uint8]int64)
 		noCKNums := make(map[uint8]int)
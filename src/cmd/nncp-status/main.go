@@ -0,0 +1,165 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Show outbound packets tracking state.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"go.cypherpunks.ru/nncp/v8"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, nncp.UsageHeader())
+	fmt.Fprintf(os.Stderr, "nncp-status -- show outbound packets state\n\n")
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] [-node NODE] [-pkt PKT] [-inflight] [-purge]\nOptions:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	var (
+		cfgPath   = flag.String("cfg", nncp.DefaultCfgPath, "Path to configuration file")
+		nodeRaw   = flag.String("node", "", "Process only packets to/via that node")
+		pktRaw    = flag.String("pkt", "", "Process only that packet")
+		inFlight  = flag.Bool("inflight", false, "Show only not delivered and not acknowledged packets")
+		purge     = flag.Bool("purge", false, "Forget about delivered and acknowledged packets")
+		spoolPath = flag.String("spool", "", "Override path to spool")
+		logPath   = flag.String("log", "", "Override path to logfile")
+		debug     = flag.Bool("debug", false, "Print debug messages")
+		version   = flag.Bool("version", false, "Print version information")
+		warranty  = flag.Bool("warranty", false, "Print warranty information")
+	)
+	log.SetFlags(log.Lshortfile)
+	flag.Usage = usage
+	flag.Parse()
+	if *warranty {
+		fmt.Println(nncp.Warranty)
+		return
+	}
+	if *version {
+		fmt.Println(nncp.VersionGet())
+		return
+	}
+
+	ctx, err := nncp.CtxFromCmdline(*cfgPath, *spoolPath, *logPath, false, false, false, *debug)
+	if err != nil {
+		log.Fatalln("Error during initialization:", err)
+	}
+
+	var nodeOnly *nncp.Node
+	if *nodeRaw != "" {
+		nodeOnly, err = ctx.FindNode(*nodeRaw)
+		if err != nil {
+			log.Fatalln("Invalid -node specified:", err)
+		}
+	}
+
+	nodeNames := make([]string, 0, len(ctx.Neigh))
+	nodeNameToNode := make(map[string]*nncp.Node, len(ctx.Neigh))
+	for _, node := range ctx.Neigh {
+		nodeNames = append(nodeNames, node.Name)
+		nodeNameToNode[node.Name] = node
+	}
+	sort.Strings(nodeNames)
+
+	ctx.Umask()
+	isBad := false
+	for _, nodeName := range nodeNames {
+		node := nodeNameToNode[nodeName]
+		tracks, err := ctx.Tracks(node.Id)
+		if err != nil {
+			log.Fatalln("Can not read tracking state:", err)
+		}
+		nodePrinted := false
+		for _, t := range tracks {
+			if nodeOnly != nil && *t.Node != *nodeOnly.Id && *t.Hop != *nodeOnly.Id {
+				continue
+			}
+			if *pktRaw != "" && t.Pkt != *pktRaw {
+				continue
+			}
+			if *purge {
+				if t.InFlight() {
+					continue
+				}
+				les := nncp.LEs{{K: "Node", V: t.Node}, {K: "Pkt", V: t.Pkt}}
+				if err = ctx.TrackRemove(t); err != nil {
+					ctx.LogE("status-purge", les, err, func(les nncp.LEs) string {
+						return fmt.Sprintf("Purging %s/%s", node.Name, t.Pkt)
+					})
+					isBad = true
+					continue
+				}
+				ctx.LogI("status-purge", les, func(les nncp.LEs) string {
+					return fmt.Sprintf("Purged %s/%s", node.Name, t.Pkt)
+				})
+				continue
+			}
+			if *inFlight && !t.InFlight() {
+				continue
+			}
+			if !nodePrinted {
+				fmt.Println(node.Name)
+				nodePrinted = true
+			}
+			var state string
+			switch {
+			case t.ACKed != nil:
+				state = "acked " + t.ACKed.Format(time.RFC3339)
+			case t.Delivered != nil:
+				state = "delivered " + t.Delivered.Format(time.RFC3339)
+			case t.Transmitted != nil:
+				state = "transmitted " + t.Transmitted.Format(time.RFC3339)
+			default:
+				_, err = os.Stat(filepath.Join(
+					ctx.Spool, t.Hop.String(), string(nncp.TTx), t.HopPkt,
+				))
+				if err == nil {
+					state = "queued"
+				} else {
+					state = "missing"
+				}
+			}
+			if t.Resends > 0 {
+				state += fmt.Sprintf(", resent %d times", t.Resends)
+			}
+			dst := ctx.NodeName(t.Node)
+			if t.HopPkt != t.Pkt {
+				dst += " via " + ctx.NodeName(t.Hop)
+			}
+			fmt.Printf(
+				"\t%s %s %s to %s (%s, nice: %s) created %s: %s\n",
+				t.Pkt, t.Type, t.Path, dst,
+				humanize.IBytes(uint64(t.Size)),
+				nncp.NicenessFmt(t.Nice),
+				t.Created.Format(time.RFC3339),
+				state,
+			)
+		}
+	}
+	if isBad {
+		os.Exit(1)
+	}
+}
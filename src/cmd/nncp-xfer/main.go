@@ -248,7 +248,7 @@ func main() {
 					err = nncp.MagicNNCPEv4.TooOld()
 				case nncp.MagicNNCPEv5.B:
 					err = nncp.MagicNNCPEv5.TooOld()
-				case nncp.MagicNNCPEv6.B:
+				case nncp.MagicNNCPEv6.B, nncp.MagicNNCPEv7.B:
 				default:
 					err = errors.New("is not an encrypted packet")
 				}
@@ -284,6 +284,11 @@ func main() {
 				fd.Close()
 				continue
 			}
+			if err = ctx.QuotaCheck(ctx.Neigh[*nodeId], nncp.TRx, fiInt.Size()); err != nil {
+				ctx.LogE("xfer-rx-quota", les, err, logMsg)
+				fd.Close()
+				continue
+			}
 			if _, err = fd.Seek(0, io.SeekStart); err != nil {
 				log.Fatalln(err)
 			}
@@ -435,6 +440,7 @@ Tx:
 			}
 		}
 		les = les[:len(les)-1]
+		ctx.Resend(&nodeId)
 		for job := range ctx.Jobs(&nodeId, nncp.TTx) {
 			pktName := filepath.Base(job.Path)
 			les := append(les, nncp.LE{K: "Pkt", V: pktName})
@@ -540,14 +546,13 @@ Tx:
 					)
 				},
 			)
+			ctx.TrackTransmitted(&nodeId, pktName)
 			if !*keep {
-				if err = os.Remove(job.Path); err != nil {
+				if err = ctx.TxSentRemove(ctx.Neigh[nodeId], job.Path); err != nil {
 					ctx.LogE("xfer-tx-remove", les, err, func(les nncp.LEs) string {
 						return logMsg(les) + ": removing"
 					})
 					isBad = true
-				} else if ctx.HdrUsage {
-					os.Remove(nncp.JobPath2Hdr(job.Path))
 				}
 			}
 		}
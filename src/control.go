@@ -0,0 +1,332 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	ControlOK  = "OK"
+	ControlErr = "ERR "
+)
+
+type controlCall struct {
+	nodeId NodeId
+	idx    int
+}
+
+// Control of the running daemon/caller through the local Unix domain
+// socket: listing and killing of active SP sessions, triggering calls
+// and pausing them.
+type Control struct {
+	ctx       *Ctx
+	sessions  map[int]*SPState
+	sessionId int
+	triggers  map[controlCall]chan struct{}
+	paused    bool
+	sync.Mutex
+}
+
+func NewControl(ctx *Ctx) *Control {
+	return &Control{
+		ctx:      ctx,
+		sessions: make(map[int]*SPState),
+		triggers: make(map[controlCall]chan struct{}),
+	}
+}
+
+func (c *Control) setCtx(ctx *Ctx) {
+	c.Lock()
+	c.ctx = ctx
+	c.Unlock()
+}
+
+func (c *Control) spStarted(state *SPState) {
+	c.Lock()
+	c.sessionId++
+	c.sessions[c.sessionId] = state
+	c.Unlock()
+}
+
+func (c *Control) spFinished(state *SPState) {
+	c.Lock()
+	for id, s := range c.sessions {
+		if s == state {
+			delete(c.sessions, id)
+		}
+	}
+	c.Unlock()
+}
+
+// Register the call of the node and return the channel, signalling
+// that it must be made immediately. Nil channel is returned if control
+// is disabled.
+func (c *Control) CallTrigger(nodeId *NodeId, idx int) chan struct{} {
+	if c == nil {
+		return nil
+	}
+	trigger := make(chan struct{}, 1)
+	c.Lock()
+	c.triggers[controlCall{*nodeId, idx}] = trigger
+	c.Unlock()
+	return trigger
+}
+
+// Unregister the call, if it is still registered with that trigger.
+func (c *Control) CallTriggerRelease(nodeId *NodeId, idx int, trigger chan struct{}) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	key := controlCall{*nodeId, idx}
+	if c.triggers[key] == trigger {
+		delete(c.triggers, key)
+	}
+	c.Unlock()
+}
+
+// Are the scheduled outgoing calls paused?
+func (c *Control) Paused() bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.paused
+}
+
+func (c *Control) list(w io.Writer) {
+	c.Lock()
+	ids := make([]int, 0, len(c.sessions))
+	for id := range c.sessions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	states := make([]*SPState, 0, len(ids))
+	for _, id := range ids {
+		states = append(states, c.sessions[id])
+	}
+	c.Unlock()
+	now := time.Now()
+	for i, state := range states {
+		duration := now.Sub(state.started)
+		rxBytes := atomic.LoadInt64(&state.RxBytes)
+		txBytes := atomic.LoadInt64(&state.TxBytes)
+		rxSpeed, txSpeed := rxBytes, txBytes
+		if secs := int64(duration.Seconds()); secs > 0 {
+			rxSpeed /= secs
+			txSpeed /= secs
+		}
+		state.RLock()
+		rxPkt, txPkt := state.rxPkt, state.txPkt
+		state.RUnlock()
+		if rxPkt == "" {
+			rxPkt = "-"
+		}
+		if txPkt == "" {
+			txPkt = "-"
+		}
+		fmt.Fprintf(
+			w, "%d\t%s (%s)\tnice %s\t%d:%02d:%02d\n",
+			ids[i], state.Node.Name, state.Addr, NicenessFmt(state.Nice),
+			int(duration.Hours()),
+			int(duration.Minutes())%60,
+			int(duration.Seconds())%60,
+		)
+		fmt.Fprintf(
+			w, "\tRx: %s (%s/sec), packet %s\n",
+			humanize.IBytes(uint64(rxBytes)), humanize.IBytes(uint64(rxSpeed)), rxPkt,
+		)
+		fmt.Fprintf(
+			w, "\tTx: %s (%s/sec), packet %s\n",
+			humanize.IBytes(uint64(txBytes)), humanize.IBytes(uint64(txSpeed)), txPkt,
+		)
+	}
+}
+
+func (c *Control) kill(arg string) error {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return errors.New("invalid session id: " + arg)
+	}
+	c.Lock()
+	state := c.sessions[id]
+	c.Unlock()
+	if state == nil {
+		return errors.New("no such session")
+	}
+	state.Kill()
+	return nil
+}
+
+func (c *Control) call(args []string) error {
+	c.Lock()
+	ctx := c.ctx
+	c.Unlock()
+	node, err := ctx.FindNode(args[0])
+	if err != nil {
+		return err
+	}
+	idx := 0
+	if len(args) > 1 {
+		if idx, err = strconv.Atoi(args[1]); err != nil {
+			return errors.New("invalid call index: " + args[1])
+		}
+	}
+	c.Lock()
+	trigger := c.triggers[controlCall{*node.Id, idx}]
+	c.Unlock()
+	if trigger == nil {
+		return errors.New("no such call")
+	}
+	select {
+	case trigger <- struct{}{}:
+	default:
+		// Already triggered
+	}
+	return nil
+}
+
+func (c *Control) pause(paused bool) error {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.triggers) == 0 {
+		return errors.New("no calls are made")
+	}
+	c.paused = paused
+	return nil
+}
+
+// Process single command line and write the reply: ControlOK line
+// followed by the command's output, or ControlErr with error message.
+func (c *Control) Process(w io.Writer, line string) {
+	cols := strings.Fields(line)
+	var err error
+	var out strings.Builder
+	if len(cols) == 0 {
+		err = errors.New("empty command")
+		goto Done
+	}
+	switch cols[0] {
+	case "list":
+		c.list(&out)
+	case "kill":
+		if len(cols) != 2 {
+			err = errors.New("usage: kill ID")
+			break
+		}
+		err = c.kill(cols[1])
+	case "call":
+		if len(cols) < 2 || len(cols) > 3 {
+			err = errors.New("usage: call NODE [INDEX]")
+			break
+		}
+		err = c.call(cols[1:])
+	case "pause":
+		err = c.pause(true)
+	case "resume":
+		err = c.pause(false)
+	default:
+		err = errors.New("unknown command: " + cols[0])
+	}
+Done:
+	if err == nil {
+		fmt.Fprintf(w, "%s\n%s", ControlOK, out.String())
+	} else {
+		fmt.Fprintf(w, "%s%s\n", ControlErr, err)
+	}
+}
+
+func (c *Control) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DefaultDeadline))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	c.Lock()
+	ctx := c.ctx
+	c.Unlock()
+	ctx.LogD("control", LEs{{"Cmd", strings.TrimSpace(line)}}, func(les LEs) string {
+		return "Control command: " + strings.TrimSpace(line)
+	})
+	c.Process(conn, line)
+}
+
+// Start serving control commands on Unix domain socket in background.
+// Socket is accessible only by the owner.
+func (ctx *Ctx) ControlListen(pth string) error {
+	ln, err := UnixListen(UnixScheme+pth, 0600)
+	if err != nil {
+		return err
+	}
+	ctx.Control = NewControl(ctx)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				ctx.LogE("control", LEs{{"Addr", pth}}, err, func(les LEs) string {
+					return "Serving control on " + pth
+				})
+				return
+			}
+			go ctx.Control.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Send the command to the control socket and return its output.
+func ControlRequest(pth string, args []string) (string, error) {
+	conn, err := net.DialTimeout("unix", pth, DefaultDeadline)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(DefaultDeadline))
+	if _, err = io.WriteString(conn, strings.Join(args, " ")+"\n"); err != nil {
+		return "", err
+	}
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	status = strings.TrimSuffix(status, "\n")
+	if strings.HasPrefix(status, ControlErr) {
+		return "", errors.New(strings.TrimPrefix(status, ControlErr))
+	}
+	if status != ControlOK {
+		return "", errors.New("invalid reply: " + status)
+	}
+	out, err := io.ReadAll(br)
+	return string(out), err
+}
@@ -0,0 +1,129 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControl(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testcontrol")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTheir, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := nodeTheir.Their()
+	node.Name = "their"
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   map[NodeId]*Node{*nodeTheir.Id: node},
+		Alias:   map[string]*NodeId{"their": nodeTheir.Id},
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	pth := filepath.Join(spool, "control.sock")
+	if err = ctx.ControlListen(pth); err != nil {
+		t.Fatal(err)
+	}
+
+	connOur, connTheir := net.Pipe()
+	defer connTheir.Close()
+	state := &SPState{
+		Ctx:     &ctx,
+		Node:    node,
+		Addr:    "pipe",
+		conn:    connOur,
+		started: time.Now(),
+		isDead:  make(chan struct{}),
+		rxPkt:   "RXPKT",
+	}
+	ctx.Control.spStarted(state)
+	out, err := ControlRequest(pth, []string{"list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "1\ttheir (pipe)\t") ||
+		!strings.Contains(out, "packet RXPKT") {
+		t.Fatal("bad list", out)
+	}
+	if _, err = ControlRequest(pth, []string{"kill", "2"}); err == nil {
+		t.Fatal("unknown session is killed")
+	}
+	if _, err = ControlRequest(pth, []string{"kill", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !state.NotAlive() {
+		t.Fatal("session is alive")
+	}
+	if _, err = connTheir.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection is not closed")
+	}
+	ctx.Control.spFinished(state)
+	if out, err = ControlRequest(pth, []string{"list"}); err != nil || out != "" {
+		t.Fatal("session is still listed", out, err)
+	}
+
+	if _, err = ControlRequest(pth, []string{"pause"}); err == nil {
+		t.Fatal("paused without calls")
+	}
+	trigger := ctx.Control.CallTrigger(nodeTheir.Id, 0)
+	if _, err = ControlRequest(pth, []string{"call", "their", "1"}); err == nil {
+		t.Fatal("unknown call is triggered")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = ControlRequest(pth, []string{"call", "their"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-trigger:
+	default:
+		t.Fatal("call is not triggered")
+	}
+	if _, err = ControlRequest(pth, []string{"pause"}); err != nil {
+		t.Fatal(err)
+	}
+	if !ctx.Control.Paused() {
+		t.Fatal("not paused")
+	}
+	if _, err = ControlRequest(pth, []string{"resume"}); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Control.Paused() {
+		t.Fatal("paused")
+	}
+	if _, err = ControlRequest(pth, []string{"unknown"}); err == nil {
+		t.Fatal("unknown command succeeded")
+	}
+}
@@ -40,6 +40,7 @@ type Ctx struct {
 
 	Spool      string
 	LogPath    string
+	LogFormat  string
 	UmaskForce *int
 	Quiet      bool
 	ShowPrgrs  bool
@@ -52,7 +53,22 @@ type Ctx struct {
 	MCDRxIfis []string
 	MCDTxIfis map[string]int
 
+	RxLimiter *RateLimiter
+	TxLimiter *RateLimiter
+
 	YggdrasilAliases map[string]string
+
+	TossHandlers map[PktType]TossHandler
+
+	Metrics *Metrics
+	Control *Control
+
+	cmdline *ctxCmdline
+}
+
+type ctxCmdline struct {
+	cfgPath, spoolPath, logPath        string
+	quiet, showPrgrs, omitPrgrs, debug bool
 }
 
 func (ctx *Ctx) FindNode(id string) (*Node, error) {
@@ -66,7 +82,7 @@ func (ctx *Ctx) FindNode(id string) (*Node, error) {
 	}
 	node, known := ctx.Neigh[*nodeId]
 	if !known {
-		return nil, errors.New("Unknown node")
+		return nil, UnknownNode
 	}
 	return node, nil
 }
@@ -101,6 +117,10 @@ func CtxFromCmdline(
 	cfgPath, spoolPath, logPath string,
 	quiet, showPrgrs, omitPrgrs, debug bool,
 ) (*Ctx, error) {
+	cmdline := &ctxCmdline{
+		cfgPath, spoolPath, logPath,
+		quiet, showPrgrs, omitPrgrs, debug,
+	}
 	env := os.Getenv(CfgPathEnv)
 	if env != "" {
 		cfgPath = env
@@ -148,7 +168,7 @@ func CtxFromCmdline(
 	} else {
 		ctx.LogPath = logPath
 	}
-	if strings.HasPrefix(ctx.LogPath, LogFdPrefix) {
+	if strings.HasPrefix(ctx.LogPath, LogFdPrefix) && LogFd == nil {
 		ptr, err := strconv.ParseUint(
 			strings.TrimPrefix(ctx.LogPath, LogFdPrefix), 10, 64,
 		)
@@ -168,9 +188,46 @@ func CtxFromCmdline(
 	}
 	ctx.Quiet = quiet
 	ctx.Debug = debug
+	ctx.cmdline = cmdline
 	return ctx, nil
 }
 
+// Create new context, reading the configuration again with the same
+// command line options. Metrics, control, toss handlers and unchanged
+// global rate limiters are carried over to it. Running MCD receivers and
+// transmitters switch to it, keeping their interfaces. Existing context
+// is left intact, so active sessions can finish with it.
+func (ctx *Ctx) Reload() (*Ctx, error) {
+	c := ctx.cmdline
+	if c == nil {
+		return nil, errors.New("context is not created from command line")
+	}
+	newCtx, err := CtxFromCmdline(
+		c.cfgPath, c.spoolPath, c.logPath,
+		c.quiet, c.showPrgrs, c.omitPrgrs, c.debug,
+	)
+	if err != nil {
+		return nil, err
+	}
+	newCtx.TossHandlers = ctx.TossHandlers
+	if ctx.RxLimiter != nil && ctx.RxLimiter.Rate() == newCtx.RxLimiter.Rate() {
+		newCtx.RxLimiter = ctx.RxLimiter
+	}
+	if ctx.TxLimiter != nil && ctx.TxLimiter.Rate() == newCtx.TxLimiter.Rate() {
+		newCtx.TxLimiter = ctx.TxLimiter
+	}
+	if ctx.Metrics != nil {
+		newCtx.Metrics = ctx.Metrics
+		newCtx.Metrics.setCtx(newCtx)
+	}
+	if ctx.Control != nil {
+		newCtx.Control = ctx.Control
+		newCtx.Control.setCtx(newCtx)
+	}
+	mcdCtx.CompareAndSwap(ctx, newCtx)
+	return newCtx, nil
+}
+
 func (ctx *Ctx) Umask() {
 	if ctx.UmaskForce != nil {
 		syscall.Umask(*ctx.UmaskForce)
@@ -0,0 +1,136 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCtxReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testreload")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTheir, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeJSON := func(node *NodeOur) NodeJSON {
+		noisePub := Base32Codec.EncodeToString(node.NoisePub[:])
+		return NodeJSON{
+			Id:       node.Id.String(),
+			ExchPub:  Base32Codec.EncodeToString(node.ExchPub[:]),
+			SignPub:  Base32Codec.EncodeToString(node.SignPub[:]),
+			NoisePub: &noisePub,
+		}
+	}
+	rxLimit := uint64(10)
+	cfg := CfgJSON{
+		Spool: filepath.Join(dir, "spool"),
+		Log:   filepath.Join(dir, "log"),
+		Self: &NodeOurJSON{
+			Id:       nodeOur.Id.String(),
+			ExchPub:  Base32Codec.EncodeToString(nodeOur.ExchPub[:]),
+			ExchPrv:  Base32Codec.EncodeToString(nodeOur.ExchPrv[:]),
+			SignPub:  Base32Codec.EncodeToString(nodeOur.SignPub[:]),
+			SignPrv:  Base32Codec.EncodeToString(nodeOur.SignPrv[:]),
+			NoisePub: Base32Codec.EncodeToString(nodeOur.NoisePub[:]),
+			NoisePrv: Base32Codec.EncodeToString(nodeOur.NoisePrv[:]),
+		},
+		Neigh:   map[string]NodeJSON{"self": nodeJSON(nodeOur)},
+		RxLimit: &rxLimit,
+	}
+	cfgPath := filepath.Join(dir, "cfg.hjson")
+	save := func() {
+		data, err := json.Marshal(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(cfgPath, data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save()
+	ctx, err := CtxFromCmdline(cfgPath, "", "", true, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Metrics = NewMetrics(ctx)
+	ctx.Control = NewControl(ctx)
+	// As if MCD is running
+	mcdCtx.Store(ctx)
+	defer mcdCtx.Store(nil)
+
+	cfg.Neigh["their"] = nodeJSON(nodeTheir)
+	save()
+	newCtx, err := ctx.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ctx.FindNode("their"); err == nil {
+		t.Fatal("old context is changed")
+	}
+	if _, err = newCtx.FindNode("their"); err != nil {
+		t.Fatal(err)
+	}
+	if newCtx.Metrics != ctx.Metrics || newCtx.Metrics.ctx != newCtx {
+		t.Fatal("metrics are not carried over")
+	}
+	if newCtx.Control != ctx.Control || newCtx.Control.ctx != newCtx {
+		t.Fatal("control is not carried over")
+	}
+	if newCtx.RxLimiter != ctx.RxLimiter {
+		t.Fatal("unchanged limiter is not carried over")
+	}
+	if mcdCtx.Load() != newCtx {
+		t.Fatal("MCD does not use new context")
+	}
+	mcdNode, known := mcdCtx.Load().Neigh[*nodeTheir.Id]
+	if !known || mcdNode.Name != "their" {
+		t.Fatal("MCD does not see new neighbour")
+	}
+	newCtxPrev := newCtx
+
+	rxLimit = 20
+	save()
+	if newCtx, err = ctx.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if newCtx.RxLimiter == ctx.RxLimiter || newCtx.RxLimiter.Rate() != 20*1024 {
+		t.Fatal("changed limiter is carried over")
+	}
+	if mcdCtx.Load() != newCtxPrev {
+		t.Fatal("MCD context is replaced by reloading the stale one")
+	}
+
+	if err = ioutil.WriteFile(cfgPath, []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ctx.Reload(); err == nil {
+		t.Fatal("invalid configuration is loaded")
+	}
+}
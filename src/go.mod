@@ -10,13 +10,14 @@ require (
 	github.com/gorhill/cronexpr v0.0.0-20180427100037-88b0669f7d75
 	github.com/hjson/hjson-go v3.3.0+incompatible
 	github.com/klauspost/compress v1.15.12
+	github.com/quic-go/quic-go v0.54.0
 	github.com/yggdrasil-network/yggdrasil-go v0.4.6
 	go.cypherpunks.ru/balloon v1.1.1
 	go.cypherpunks.ru/recfile v0.5.1
-	golang.org/x/crypto v0.3.0
-	golang.org/x/net v0.2.0
-	golang.org/x/sys v0.2.0
-	golang.org/x/term v0.2.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+	golang.org/x/term v0.23.0
 	gvisor.dev/gvisor v0.0.0-20220901235040-6ca97ef2ce1c
 	lukechampine.com/blake3 v1.1.7
 )
@@ -25,7 +26,11 @@ require (
 	github.com/Arceliar/phony v0.0.0-20210209235338-dde1a8dca979 // indirect
 	github.com/google/btree v1.0.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.1 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 )
 
-go 1.17
+go 1.23
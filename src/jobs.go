@@ -25,7 +25,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	xdr "github.com/davecgh/go-xdr/xdr2"
 	"github.com/dustin/go-humanize"
 )
 
@@ -50,16 +49,15 @@ func JobPath2Hdr(jobPath string) string {
 }
 
 func (ctx *Ctx) HdrRead(r io.Reader) (*PktEnc, []byte, error) {
-	var pktEnc PktEnc
-	_, err := xdr.Unmarshal(r, &pktEnc)
+	pktEnc, _, err := PktEncUnmarshal(r)
 	if err != nil {
 		return nil, nil, err
 	}
 	var raw bytes.Buffer
-	if _, err = xdr.Marshal(&raw, pktEnc); err != nil {
+	if _, err = PktEncMarshal(&raw, pktEnc); err != nil {
 		panic(err)
 	}
-	return &pktEnc, raw.Bytes(), nil
+	return pktEnc, raw.Bytes(), nil
 }
 
 func (ctx *Ctx) HdrWrite(pktEncRaw []byte, tgt string) error {
@@ -182,7 +180,7 @@ func (ctx *Ctx) jobsFind(nodeId *NodeId, xx TRxTx, nock, part bool) chan Job {
 				err = MagicNNCPEv4.TooOld()
 			case MagicNNCPEv5.B:
 				err = MagicNNCPEv5.TooOld()
-			case MagicNNCPEv6.B:
+			case MagicNNCPEv6.B, MagicNNCPEv7.B:
 			default:
 				err = BadMagic
 			}
@@ -57,3 +57,17 @@ func (ctx *Ctx) UnlockDir(fd *os.File) {
 		fd.Close()
 	}
 }
+
+// Exclusively lock the file, waiting for other holders of the lock.
+// It is released with UnlockDir.
+func lockFileWait(lockPath string) (*os.File, error) {
+	fd, err := os.OpenFile(lockPath, os.O_CREATE|os.O_WRONLY, os.FileMode(0666))
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Flock(int(fd.Fd()), unix.LOCK_EX); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
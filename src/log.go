@@ -18,9 +18,15 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package nncp
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,7 +34,12 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-const LogFdPrefix = "FD:"
+const (
+	LogFdPrefix = "FD:"
+
+	LogFormatRec  = "rec"
+	LogFormatJSON = "json"
+)
 
 var (
 	LogFd     *os.File
@@ -42,6 +53,10 @@ type LE struct {
 type LEs []LE
 
 func (les LEs) Rec() string {
+	return les.rec(time.Now())
+}
+
+func (les LEs) rec(when time.Time) string {
 	b := bytes.NewBuffer(make([]byte, 0, 1<<10))
 	w := recfile.NewWriter(b)
 	_, err := w.RecordStart()
@@ -50,7 +65,7 @@ func (les LEs) Rec() string {
 	}
 	_, err = w.WriteFields(recfile.Field{
 		Name:  "When",
-		Value: time.Now().UTC().Format(time.RFC3339Nano),
+		Value: when.UTC().Format(time.RFC3339Nano),
 	})
 	if err != nil {
 		panic(err)
@@ -84,6 +99,55 @@ func (les LEs) Rec() string {
 	return b.String()
 }
 
+// JSON object with the same fields as in Rec, terminated with newline.
+func (les LEs) JSON() string {
+	return les.json(time.Now())
+}
+
+func (les LEs) json(when time.Time) string {
+	b := bytes.NewBuffer(make([]byte, 0, 1<<10))
+	b.WriteString(`{"When":`)
+	raw, err := json.Marshal(when.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		panic(err)
+	}
+	b.Write(raw)
+	for _, le := range les {
+		var v interface{}
+		switch vv := le.V.(type) {
+		case int, int8, uint8, int64, uint64, bool:
+			v = vv
+		case []string:
+			if len(vv) == 0 {
+				continue
+			}
+			v = vv
+		default:
+			v = fmt.Sprintf("%s", vv)
+		}
+		if raw, err = json.Marshal(le.K); err != nil {
+			panic(err)
+		}
+		b.WriteByte(',')
+		b.Write(raw)
+		b.WriteByte(':')
+		if raw, err = json.Marshal(v); err != nil {
+			panic(err)
+		}
+		b.Write(raw)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Log record serialized in the configured log format.
+func (ctx *Ctx) logRec(les LEs, when time.Time) string {
+	if ctx.LogFormat == LogFormatJSON {
+		return les.json(when)
+	}
+	return les.rec(when)
+}
+
 func (ctx *Ctx) Log(rec string) {
 	if LogFd != nil {
 		LogFdLock.Lock()
@@ -133,25 +197,149 @@ func (ctx *Ctx) LogD(who string, les LEs, msg func(LEs) string) {
 func (ctx *Ctx) LogI(who string, les LEs, msg func(LEs) string) {
 	les = append(LEs{{"Who", who}}, les...)
 	les = append(les, LE{"Msg", msg(les)})
-	rec := les.Rec()
+	when := time.Now()
+	rec := les.rec(when)
 	if ctx.Debug {
 		fmt.Fprint(os.Stderr, rec)
 	}
 	if !ctx.Quiet {
 		fmt.Fprintln(os.Stderr, ctx.HumanizeRec(rec))
 	}
-	ctx.Log(rec)
+	ctx.Log(ctx.logRec(les, when))
 }
 
 func (ctx *Ctx) LogE(who string, les LEs, err error, msg func(LEs) string) {
+	if ctx.Metrics != nil {
+		ctx.Metrics.logError(who)
+	}
 	les = append(LEs{{"Err", err.Error()}, {"Who", who}}, les...)
 	les = append(les, LE{"Msg", msg(les)})
-	rec := les.Rec()
+	when := time.Now()
+	rec := les.rec(when)
 	if ctx.Debug {
 		fmt.Fprint(os.Stderr, rec)
 	}
 	if !ctx.Quiet {
 		fmt.Fprintln(os.Stderr, ctx.HumanizeRec(rec))
 	}
-	ctx.Log(rec)
+	ctx.Log(ctx.logRec(les, when))
+}
+
+// Reader of the log, consisting of either recfile records, JSON lines,
+// or both of them mixed.
+type LogReader struct {
+	br *bufio.Reader
+}
+
+func NewLogReader(r io.Reader) *LogReader {
+	return &LogReader{br: bufio.NewReader(r)}
+}
+
+// Read the next log record. io.EOF is returned at the end.
+func (lr *LogReader) NextMap() (map[string]string, error) {
+	var line string
+	var err error
+	for {
+		line, err = lr.br.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(line, "{") {
+		return logJSONMap(line)
+	}
+	lines := []string{line}
+	for err == nil {
+		// JSON line can immediately follow the recfile record
+		var next []byte
+		if next, err = lr.br.Peek(1); err == nil && next[0] == '{' {
+			break
+		}
+		line, err = lr.br.ReadString('\n')
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return recfile.NewReader(strings.NewReader(strings.Join(lines, ""))).NextMap()
+}
+
+func logJSONMap(line string) (map[string]string, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			m[k] = v
+		case json.Number:
+			m[k] = v.String()
+		case bool:
+			m[k] = fmt.Sprintf("%v", v)
+		case []interface{}:
+			ss := make([]string, 0, len(v))
+			for _, s := range v {
+				ss = append(ss, fmt.Sprintf("%v", s))
+			}
+			m[k] = strings.Join(ss, "\n")
+		default:
+			return nil, errors.New("unsupported log field value: " + k)
+		}
+	}
+	return m, nil
+}
+
+// Log records filter. Empty fields are not checked.
+type LogFilter struct {
+	Nodes []string
+	Pkts  []string
+	Whos  []string
+	Since time.Time
+	Until time.Time
+}
+
+func logFilterHas(vs []string, v string) bool {
+	if len(vs) == 0 {
+		return true
+	}
+	i := sort.SearchStrings(vs, v)
+	return i < len(vs) && vs[i] == v
+}
+
+// Does the record satisfy the filter? Nodes, Pkts and Whos must be
+// sorted.
+func (f *LogFilter) Match(le map[string]string) bool {
+	if !logFilterHas(f.Nodes, le["Node"]) {
+		return false
+	}
+	if !logFilterHas(f.Pkts, le["Pkt"]) {
+		return false
+	}
+	if !logFilterHas(f.Whos, le["Who"]) {
+		return false
+	}
+	if f.Since.IsZero() && f.Until.IsZero() {
+		return true
+	}
+	when, err := time.Parse(time.RFC3339Nano, le["When"])
+	if err != nil {
+		return false
+	}
+	if !f.Since.IsZero() && when.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !when.Before(f.Until) {
+		return false
+	}
+	return true
 }
@@ -0,0 +1,55 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestLogReaderMixed(t *testing.T) {
+	f := func(who, pkt string, size uint64, recFirst bool) bool {
+		who = strconv.QuoteToASCII(who)
+		pkt = strconv.QuoteToASCII(pkt)
+		les := LEs{{"Who", who}, {"Pkt", pkt}, {"Size", size}, {"Debug", true}}
+		recs := []string{les.JSON(), les.Rec()}
+		if recFirst {
+			recs[0], recs[1] = recs[1], recs[0]
+		}
+		r := NewLogReader(strings.NewReader(strings.Join(recs, "")))
+		for range recs {
+			le, err := r.NextMap()
+			if err != nil {
+				return false
+			}
+			if le["Who"] != who || le["Pkt"] != pkt ||
+				le["Size"] != strconv.FormatUint(size, 10) ||
+				le["Debug"] != "true" || le["When"] == "" {
+				return false
+			}
+		}
+		_, err := r.NextMap()
+		return err == io.EOF
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
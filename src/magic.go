@@ -49,6 +49,10 @@ var (
 		B:    [8]byte{'N', 'N', 'C', 'P', 'D', 0, 0, 1},
 		Name: "NNCPDv1 (multicast discovery v1)", Till: "now",
 	}
+	MagicNNCPDv2 = Magic{
+		B:    [8]byte{'N', 'N', 'C', 'P', 'D', 0, 0, 2},
+		Name: "NNCPDv2 (authenticated multicast discovery v2)", Till: "now",
+	}
 	MagicNNCPEv1 = Magic{
 		B:    [8]byte{'N', 'N', 'C', 'P', 'E', 0, 0, 1},
 		Name: "NNCPEv1 (encrypted packet v1)", Till: "0.12",
@@ -73,6 +77,10 @@ var (
 		B:    [8]byte{'N', 'N', 'C', 'P', 'E', 0, 0, 6},
 		Name: "NNCPEv6 (encrypted packet v6)", Till: "now",
 	}
+	MagicNNCPEv7 = Magic{
+		B:    [8]byte{'N', 'N', 'C', 'P', 'E', 0, 0, 7},
+		Name: "NNCPEv7 (encrypted packet v7)", Till: "now",
+	}
 	MagicNNCPSv1 = Magic{
 		B:    [8]byte{'N', 'N', 'C', 'P', 'S', 0, 0, 1},
 		Name: "NNCPSv1 (sync protocol v1)", Till: "now",
@@ -19,17 +19,30 @@ package nncp
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	xdr "github.com/davecgh/go-xdr/xdr2"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	MCDPort = 5400
+
+	// Maximal size of MCDv2 announcement
+	MCDv2MaxSize = 1024
 )
 
 type MCD struct {
@@ -37,18 +50,58 @@ type MCD struct {
 	Sender *NodeId
 }
 
+type MCDv2Tbs struct {
+	Magic     [8]byte
+	Sender    *NodeId
+	Timestamp uint64 // UNIX time in nanoseconds
+	Port      uint32
+	Addrs     []string
+}
+
+type MCDv2 struct {
+	Magic     [8]byte
+	Sender    *NodeId
+	Timestamp uint64
+	Port      uint32
+	Addrs     []string
+	Sign      [ed25519.SignatureSize]byte
+}
+
 type MCDAddr struct {
 	Addr     net.UDPAddr
 	lastSeen time.Time
 }
 
+type mcdSeenKey struct {
+	nodeId    NodeId
+	timestamp uint64
+}
+
+// Where the announcement was received from.
+type mcdSeenSrc struct {
+	ip  string
+	ifi string
+}
+
 var (
 	mcdIP           = net.ParseIP("ff02::4e4e:4350")
 	mcdAddrLifetime = 2 * time.Minute
+	mcdTimeWindow   = time.Minute
 
 	mcdPktSize int
-	MCDAddrs   map[NodeId][]*MCDAddr
-	MCDAddrsM  sync.RWMutex
+	mcdSeen    map[mcdSeenKey]mcdSeenSrc
+
+	// Interfaces listened for broadcast announcements, per port
+	mcdBcastIfis  = make(map[int]map[string]struct{})
+	mcdBcastIfisM sync.Mutex
+
+	// Context of the running MCD receivers and transmitters. It is
+	// replaced during the configuration reload, so they see current
+	// neighbours and keys.
+	mcdCtx atomic.Pointer[Ctx]
+
+	MCDAddrs  map[NodeId][]*MCDAddr
+	MCDAddrsM sync.RWMutex
 )
 
 func init() {
@@ -60,6 +113,7 @@ func init() {
 	}
 	mcdPktSize = buf.Len()
 
+	mcdSeen = make(map[mcdSeenKey]mcdSeenSrc)
 	MCDAddrs = make(map[NodeId][]*MCDAddr)
 	go func() {
 		for {
@@ -75,140 +129,579 @@ func init() {
 				}
 				MCDAddrs[nodeId] = addrsAlive
 			}
+			for k := range mcdSeen {
+				if !mcdTimestampValid(k.timestamp, now) {
+					delete(mcdSeen, k)
+				}
+			}
 			MCDAddrsM.Unlock()
 		}
 	}()
 }
 
-func (ctx *Ctx) MCDRx(ifiName string) error {
+func mcdTimestampValid(timestamp uint64, now time.Time) bool {
+	t := time.Unix(0, int64(timestamp))
+	return !t.Before(now.Add(-mcdTimeWindow)) && !t.After(now.Add(mcdTimeWindow))
+}
+
+// Create MCDv2 announcement signed by our node. Port is the one
+// daemon is listening on, optional addrs are IP addresses it is
+// reachable with. If no addrs are specified, then receiver will use
+// the source address of the announcement.
+func MCDv2Marshal(our *NodeOur, port int, addrs []string, now time.Time) ([]byte, error) {
+	if port <= 0 || port > 65535 {
+		return nil, errors.New("invalid port")
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", addr)
+		}
+	}
+	tbs := MCDv2Tbs{
+		Magic:     MagicNNCPDv2.B,
+		Sender:    our.Id,
+		Timestamp: uint64(now.UnixNano()),
+		Port:      uint32(port),
+		Addrs:     addrs,
+	}
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, &tbs); err != nil {
+		return nil, err
+	}
+	mcd := MCDv2{
+		Magic:     tbs.Magic,
+		Sender:    tbs.Sender,
+		Timestamp: tbs.Timestamp,
+		Port:      tbs.Port,
+		Addrs:     tbs.Addrs,
+	}
+	copy(mcd.Sign[:], ed25519.Sign(our.SignPrv, buf.Bytes()))
+	buf.Reset()
+	if _, err := xdr.Marshal(&buf, &mcd); err != nil {
+		return nil, err
+	}
+	if buf.Len() > MCDv2MaxSize {
+		return nil, errors.New("too many addresses")
+	}
+	return buf.Bytes(), nil
+}
+
+// Parse and authenticate received MCD announcement, returning the
+// announcing node and addresses to call it with. MCDv1 is accepted only
+// if node explicitly allows it with its mcd-v1 option. MCDv2 must be
+// signed by the node, be fresh enough and not seen before. The same
+// announcement can legitimately arrive several times (through several
+// targets): duplicate from the same source IP address on the same
+// ifiName interface is silently skipped, returning no addresses. Copy
+// received on another interface is treated as replay, because source
+// address of the announcement without addresses is not authenticated.
+// zone is the one of link-local addresses.
+func (ctx *Ctx) mcdParse(
+	ifiName, zone string,
+	src *net.UDPAddr,
+	data []byte,
+	now time.Time,
+) (*Node, []net.UDPAddr, error) {
+	if len(data) < len(MagicNNCPDv1.B) {
+		return nil, nil, errors.New("too short packet")
+	}
+	var magic [8]byte
+	copy(magic[:], data)
+	switch magic {
+	case MagicNNCPDv1.B:
+		if len(data) != mcdPktSize {
+			return nil, nil, errors.New("invalid size")
+		}
+		var mcd MCD
+		if _, err := xdr.Unmarshal(bytes.NewReader(data), &mcd); err != nil {
+			return nil, nil, err
+		}
+		node, known := ctx.Neigh[*mcd.Sender]
+		if !known {
+			return nil, nil, fmt.Errorf("unknown node %s", mcd.Sender)
+		}
+		if !node.MCDv1 {
+			return node, nil, errors.New("MCDv1 is not allowed")
+		}
+		return node, []net.UDPAddr{*src}, nil
+	case MagicNNCPDv2.B:
+		if len(data) > MCDv2MaxSize {
+			return nil, nil, errors.New("invalid size")
+		}
+		var mcd MCDv2
+		n, err := xdr.UnmarshalLimited(bytes.NewReader(data), &mcd, MCDv2MaxSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n != len(data) {
+			return nil, nil, errors.New("trailing data")
+		}
+		node, known := ctx.Neigh[*mcd.Sender]
+		if !known {
+			return nil, nil, fmt.Errorf("unknown node %s", mcd.Sender)
+		}
+		tbs := MCDv2Tbs{
+			Magic:     mcd.Magic,
+			Sender:    mcd.Sender,
+			Timestamp: mcd.Timestamp,
+			Port:      mcd.Port,
+			Addrs:     mcd.Addrs,
+		}
+		var buf bytes.Buffer
+		if _, err = xdr.Marshal(&buf, &tbs); err != nil {
+			return nil, nil, err
+		}
+		if !ed25519.Verify(node.SignPub, buf.Bytes(), mcd.Sign[:]) {
+			return node, nil, errors.New("invalid signature")
+		}
+		if !mcdTimestampValid(mcd.Timestamp, now) {
+			return node, nil, errors.New("timestamp is out of window")
+		}
+		if mcd.Port == 0 || mcd.Port > 65535 {
+			return node, nil, errors.New("invalid port")
+		}
+		addrs := make([]net.UDPAddr, 0, len(mcd.Addrs)+1)
+		for _, addr := range mcd.Addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return node, nil, fmt.Errorf("invalid IP address: %s", addr)
+			}
+			udpAddr := net.UDPAddr{IP: ip, Port: int(mcd.Port)}
+			if ip.IsLinkLocalUnicast() {
+				udpAddr.Zone = zone
+			}
+			addrs = append(addrs, udpAddr)
+		}
+		if len(addrs) == 0 {
+			addrs = append(addrs, net.UDPAddr{
+				IP: src.IP, Port: int(mcd.Port), Zone: src.Zone,
+			})
+		}
+		k := mcdSeenKey{nodeId: *mcd.Sender, timestamp: mcd.Timestamp}
+		srcSeen := mcdSeenSrc{ip: src.IP.String(), ifi: ifiName}
+		MCDAddrsM.Lock()
+		seenSrc, seen := mcdSeen[k]
+		if !seen {
+			mcdSeen[k] = srcSeen
+		}
+		MCDAddrsM.Unlock()
+		if seen {
+			if seenSrc == srcSeen {
+				return node, nil, nil
+			}
+			return node, nil, fmt.Errorf(
+				"replayed, seen from %s on %s", seenSrc.ip, seenSrc.ifi,
+			)
+		}
+		return node, addrs, nil
+	}
+	return nil, nil, fmt.Errorf("unexpected magic: %s", hex.EncodeToString(magic[:]))
+}
+
+// Add or refresh node's MCD address. Returns true if it is a new one.
+func mcdAddrsAdd(nodeId *NodeId, addr net.UDPAddr, now time.Time) bool {
+	MCDAddrsM.Lock()
+	defer MCDAddrsM.Unlock()
+	for _, mcdAddr := range MCDAddrs[*nodeId] {
+		if mcdAddr.Addr.IP.Equal(addr.IP) &&
+			mcdAddr.Addr.Port == addr.Port &&
+			mcdAddr.Addr.Zone == addr.Zone {
+			mcdAddr.lastSeen = now
+			return false
+		}
+	}
+	MCDAddrs[*nodeId] = append(
+		MCDAddrs[*nodeId],
+		&MCDAddr{Addr: addr, lastSeen: now},
+	)
+	return true
+}
+
+// Parse mcd-listen/mcd-send entry: POSIX regular expression of network
+// interfaces names, optionally followed by whitespace and the target
+// address. Target is either IPv4/IPv6 multicast group or IPv4 broadcast
+// address, with optional port. IPv6 ff02::4e4e:4350 group and MCDPort
+// are used by default. Only the IP address after the last whitespace is
+// treated as the target, so regular expressions with whitespaces keep
+// their meaning.
+func MCDTargetParse(s string) (*regexp.Regexp, *net.UDPAddr, error) {
+	reRaw := s
+	target := &net.UDPAddr{IP: mcdIP, Port: MCDPort}
+	if i := strings.LastIndexAny(s, " \t"); i != -1 {
+		targetRaw := s[i+1:]
+		host, portRaw, err := net.SplitHostPort(targetRaw)
+		if err != nil {
+			host, portRaw = strings.TrimSuffix(strings.TrimPrefix(targetRaw, "["), "]"), ""
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !ip.IsMulticast() && ip.To4() == nil {
+				return nil, nil, fmt.Errorf(
+					"neither multicast nor IPv4 broadcast: %q", targetRaw,
+				)
+			}
+			target.IP = ip
+			if portRaw != "" {
+				target.Port, err = strconv.Atoi(portRaw)
+				if err != nil || target.Port <= 0 || target.Port > 65535 {
+					return nil, nil, fmt.Errorf("invalid MCD port: %q", targetRaw)
+				}
+			}
+			reRaw = strings.TrimRight(s[:i], " \t")
+		}
+	}
+	if reRaw == "" {
+		return nil, nil, fmt.Errorf("invalid MCD entry: %q", s)
+	}
+	ifiRe, err := regexp.CompilePOSIX(reRaw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not compile POSIX regexp %q: %w", reRaw, err)
+	}
+	return ifiRe, target, nil
+}
+
+// Call f for each network interface matching the MCD entries.
+func mcdIfisMatch(
+	entries []string,
+	f func(ifiName string, target *net.UDPAddr, entry string) error,
+) error {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		ifiRe, target, err := MCDTargetParse(entry)
+		if err != nil {
+			return err
+		}
+		for _, ifi := range ifis {
+			if !ifiRe.MatchString(ifi.Name) {
+				continue
+			}
+			if err = f(ifi.Name, target, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Start MCD reception on all interfaces and targets from mcd-listen.
+// Failures of the separate interfaces are only logged.
+func (ctx *Ctx) MCDRxStart() error {
+	return mcdIfisMatch(ctx.MCDRxIfis, func(
+		ifiName string, target *net.UDPAddr, entry string,
+	) error {
+		if err := ctx.MCDRx(ifiName, target); err != nil {
+			les := LEs{{"If", ifiName}, {"Target", target.String()}}
+			ctx.LogE("mcd", les, err, func(les LEs) string {
+				return fmt.Sprintf("Can not run MCD reception on %s/%s", ifiName, target)
+			})
+		}
+		return nil
+	})
+}
+
+// Start MCD transmission on all interfaces and targets from mcd-send,
+// announcing daemon's port and optional addresses. Announcements are
+// sent only once if zeroInterval is set.
+func (ctx *Ctx) MCDTxStart(port int, addrs []string, zeroInterval bool) error {
+	entries := make([]string, 0, len(ctx.MCDTxIfis))
+	for entry := range ctx.MCDTxIfis {
+		entries = append(entries, entry)
+	}
+	return mcdIfisMatch(entries, func(
+		ifiName string, target *net.UDPAddr, entry string,
+	) error {
+		var interval time.Duration
+		if !zeroInterval {
+			interval = time.Duration(ctx.MCDTxIfis[entry]) * time.Second
+		}
+		return ctx.MCDTx(ifiName, target, port, addrs, interval)
+	})
+}
+
+// Addresses of the node discovered by MCD.
+func MCDNodeAddrs(nodeId *NodeId) []string {
+	MCDAddrsM.RLock()
+	defer MCDAddrsM.RUnlock()
+	addrs := make([]string, 0, len(MCDAddrs[*nodeId]))
+	for _, mcdAddr := range MCDAddrs[*nodeId] {
+		addrs = append(addrs, mcdAddr.Addr.String())
+	}
+	return addrs
+}
+
+func mcdListenReuse(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if opErr == nil {
+				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// Process received MCD announcement.
+func mcdRxHandle(
+	ifiName string,
+	target *net.UDPAddr,
+	zone string,
+	addr *net.UDPAddr,
+	data []byte,
+) {
+	ctx := mcdCtx.Load()
+	les := LEs{{"If", ifiName}, {"Target", target.String()}}
+	now := time.Now()
+	node, addrs, err := ctx.mcdParse(ifiName, zone, addr, data, now)
+	if node != nil {
+		les = append(les, LE{"Node", node.Id})
+	}
+	if err != nil {
+		ctx.LogD("mcd", les, func(les LEs) string {
+			return fmt.Sprintf(
+				"MCD Rx %s/%s: %s: %s",
+				ifiName, target, addr, err,
+			)
+		})
+		return
+	}
+	ctx.LogD("mcd", les, func(les LEs) string {
+		return fmt.Sprintf(
+			"MCD Rx %s/%s: %s: node %s",
+			ifiName, target, addr, node.Name,
+		)
+	})
+	for _, mcdAddr := range addrs {
+		if !mcdAddrsAdd(node.Id, mcdAddr, now) {
+			continue
+		}
+		lesAdd := append(les, LE{"Addr", mcdAddr.String()})
+		ctx.LogI("mcd-add", lesAdd, func(les LEs) string {
+			return fmt.Sprintf(
+				"MCD discovered %s's address: %s",
+				node.Name, mcdAddr.String(),
+			)
+		})
+	}
+}
+
+// Listen for MCD announcements on specified interface. Broadcast
+// announcements are received from all interfaces at once, so only the
+// first call for each port starts listening, and the next ones only add
+// their interfaces to the list of accepted ones.
+func (ctx *Ctx) MCDRx(ifiName string, target *net.UDPAddr) error {
+	if !target.IP.IsMulticast() {
+		return ctx.mcdBcastRx(ifiName, target)
+	}
 	ifi, err := net.InterfaceByName(ifiName)
 	if err != nil {
 		return err
 	}
-	addr := &net.UDPAddr{IP: mcdIP, Port: MCDPort, Zone: ifiName}
-	conn, err := net.ListenMulticastUDP("udp", ifi, addr)
+	conn, err := net.ListenMulticastUDP("udp", ifi, &net.UDPAddr{
+		IP: target.IP, Port: target.Port, Zone: ifiName,
+	})
 	if err != nil {
 		return err
 	}
+	mcdCtx.CompareAndSwap(nil, ctx)
 	go func() {
-		buf := make([]byte, mcdPktSize)
-		var n int
-		var mcd MCD
-	ListenCycle:
+		buf := make([]byte, MCDv2MaxSize+1)
 		for {
-			les := LEs{{"If", ifiName}}
-			n, addr, err = conn.ReadFromUDP(buf)
+			n, src, err := conn.ReadFrom(buf)
 			if err != nil {
-				ctx.LogE("mcd", les, err, func(les LEs) string {
-					return fmt.Sprintf("MCD Rx %s/%d", ifiName, MCDPort)
+				les := LEs{{"If", ifiName}, {"Target", target.String()}}
+				mcdCtx.Load().LogE("mcd", les, err, func(les LEs) string {
+					return fmt.Sprintf("MCD Rx %s/%s", ifiName, target)
 				})
 				continue
 			}
-			if n != mcdPktSize {
-				ctx.LogD("mcd", les, func(les LEs) string {
-					return fmt.Sprintf(
-						"MCD Rx %s/%d: got packet with invalid size",
-						ifiName, MCDPort,
-					)
-				})
-				continue
+			if addr, ok := src.(*net.UDPAddr); ok {
+				mcdRxHandle(ifiName, target, ifiName, addr, buf[:n])
 			}
-			_, err = xdr.Unmarshal(bytes.NewReader(buf[:n]), &mcd)
+		}
+	}()
+	return nil
+}
+
+// Listen for broadcast MCD announcements. Single socket per port
+// receives them from all interfaces, so the receiving interface is
+// taken from the packet's control message and checked against the
+// listened ones.
+func (ctx *Ctx) mcdBcastRx(ifiName string, target *net.UDPAddr) error {
+	mcdBcastIfisM.Lock()
+	defer mcdBcastIfisM.Unlock()
+	if ifis, listening := mcdBcastIfis[target.Port]; listening {
+		ifis[ifiName] = struct{}{}
+		return nil
+	}
+	conn, err := mcdListenReuse("udp4", ":"+strconv.Itoa(target.Port))
+	if err != nil {
+		return err
+	}
+	pconn := ipv4.NewPacketConn(conn)
+	if err = pconn.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true); err != nil {
+		conn.Close()
+		return err
+	}
+	mcdBcastIfis[target.Port] = map[string]struct{}{ifiName: {}}
+	mcdCtx.CompareAndSwap(nil, ctx)
+	go func() {
+		buf := make([]byte, MCDv2MaxSize+1)
+		for {
+			n, cm, src, err := pconn.ReadFrom(buf)
 			if err != nil {
-				ctx.LogD("mcd", les, func(les LEs) string {
-					return fmt.Sprintf(
-						"MCD Rx %s/%d: can not unmarshal: %s",
-						ifiName, MCDPort, err,
-					)
+				les := LEs{{"Target", target.String()}}
+				mcdCtx.Load().LogE("mcd", les, err, func(les LEs) string {
+					return fmt.Sprintf("MCD Rx %s", target)
 				})
 				continue
 			}
-			if mcd.Magic != MagicNNCPDv1.B {
-				ctx.LogD("mcd", les, func(les LEs) string {
-					return fmt.Sprintf(
-						"MCD Rx %s/%d: unexpected magic: %s",
-						ifiName, MCDPort, hex.EncodeToString(mcd.Magic[:]),
-					)
-				})
+			addr, ok := src.(*net.UDPAddr)
+			if !ok || cm == nil {
 				continue
 			}
-			node, known := ctx.Neigh[*mcd.Sender]
-			if known {
-				les = append(les, LE{"Node", node.Id})
-				ctx.LogD("mcd", les, func(les LEs) string {
-					return fmt.Sprintf(
-						"MCD Rx %s/%d: %s: node %s",
-						ifiName, MCDPort, addr, node.Name,
-					)
-				})
-			} else {
-				ctx.LogD("mcd", les, func(les LEs) string {
-					return fmt.Sprintf(
-						"MCD Rx %s/%d: %s: unknown node %s",
-						ifiName, MCDPort, addr, node.Id.String(),
-					)
-				})
+			ifi, err := net.InterfaceByIndex(cm.IfIndex)
+			if err != nil {
 				continue
 			}
-			MCDAddrsM.RLock()
-			for _, mcdAddr := range MCDAddrs[*mcd.Sender] {
-				if mcdAddr.Addr.IP.Equal(addr.IP) &&
-					mcdAddr.Addr.Port == addr.Port &&
-					mcdAddr.Addr.Zone == addr.Zone {
-					mcdAddr.lastSeen = time.Now()
-					MCDAddrsM.RUnlock()
-					continue ListenCycle
-				}
+			mcdBcastIfisM.Lock()
+			_, listened := mcdBcastIfis[target.Port][ifi.Name]
+			mcdBcastIfisM.Unlock()
+			if !listened {
+				continue
 			}
-			MCDAddrsM.RUnlock()
-			MCDAddrsM.Lock()
-			MCDAddrs[*mcd.Sender] = append(
-				MCDAddrs[*mcd.Sender],
-				&MCDAddr{Addr: *addr, lastSeen: time.Now()},
-			)
-			MCDAddrsM.Unlock()
-			ctx.LogI("mcd-add", les, func(les LEs) string {
-				return fmt.Sprintf("MCD discovered %s's address: %s", node.Name, addr)
-			})
+			dst := &net.UDPAddr{IP: cm.Dst, Port: target.Port}
+			mcdRxHandle(ifi.Name, dst, "", addr, buf[:n])
 		}
 	}()
 	return nil
 }
 
-func (ctx *Ctx) MCDTx(ifiName string, port int, interval time.Duration) error {
+// Directed broadcast addresses of interface's IPv4 networks.
+func mcdIfiBcasts(ifi *net.Interface) ([]net.IP, error) {
+	ifiAddrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var bcasts []net.IP
+	for _, ifiAddr := range ifiAddrs {
+		ipNet, ok := ifiAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || len(ipNet.Mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range ip {
+			bcast[i] = ip[i] | ^ipNet.Mask[i]
+		}
+		bcasts = append(bcasts, bcast)
+	}
+	return bcasts, nil
+}
+
+// Send MCD announcements every interval, or only once if it is zero.
+// Both authenticated MCDv2 and MCDv1 (for older versions) are sent to
+// multicast groups. MCDv1 relies on the source port of the packet, so
+// only MCDv2 is broadcasted from the ephemeral port. Limited broadcast
+// address is replaced with directed broadcast ones of the interface.
+func (ctx *Ctx) MCDTx(
+	ifiName string,
+	target *net.UDPAddr,
+	port int,
+	addrs []string,
+	interval time.Duration,
+) error {
 	ifi, err := net.InterfaceByName(ifiName)
 	if err != nil {
 		return err
 	}
-	addr := &net.UDPAddr{IP: mcdIP, Port: port, Zone: ifiName}
-	conn, err := net.ListenMulticastUDP("udp", ifi, addr)
-	if err != nil {
+	if _, err = MCDv2Marshal(ctx.Self, port, addrs, time.Now()); err != nil {
 		return err
 	}
-
-	dst := &net.UDPAddr{IP: mcdIP, Port: MCDPort, Zone: ifiName}
-	var buf bytes.Buffer
-	mcd := MCD{Magic: MagicNNCPDv1.B, Sender: ctx.Self.Id}
-	if _, err := xdr.Marshal(&buf, mcd); err != nil {
-		panic(err)
+	var conn *net.UDPConn
+	var dsts []*net.UDPAddr
+	var withV1 bool
+	if target.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", ifi, &net.UDPAddr{
+			IP: target.IP, Port: port, Zone: ifiName,
+		})
+		if err != nil {
+			return err
+		}
+		dsts = append(dsts, &net.UDPAddr{
+			IP: target.IP, Port: target.Port, Zone: ifiName,
+		})
+		withV1 = true
+	} else {
+		bcasts := []net.IP{target.IP}
+		if target.IP.Equal(net.IPv4bcast) {
+			bcasts, err = mcdIfiBcasts(ifi)
+			if err != nil {
+				return err
+			}
+			if len(bcasts) == 0 {
+				return errors.New("no IPv4 addresses")
+			}
+		}
+		for _, bcast := range bcasts {
+			dsts = append(dsts, &net.UDPAddr{IP: bcast, Port: target.Port})
+		}
+		conn, err = net.ListenUDP("udp4", nil)
+		if err != nil {
+			return err
+		}
+	}
+	send := func(ctx *Ctx) error {
+		bufV2, err := MCDv2Marshal(ctx.Self, port, addrs, time.Now())
+		if err != nil {
+			return err
+		}
+		var bufV1 bytes.Buffer
+		if withV1 {
+			mcd := MCD{Magic: MagicNNCPDv1.B, Sender: ctx.Self.Id}
+			if _, err := xdr.Marshal(&bufV1, mcd); err != nil {
+				panic(err)
+			}
+		}
+		for _, dst := range dsts {
+			if _, err = conn.WriteTo(bufV2, dst); err != nil {
+				return err
+			}
+			if !withV1 {
+				continue
+			}
+			if _, err = conn.WriteTo(bufV1.Bytes(), dst); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 	if interval == 0 {
-		_, err = conn.WriteTo(buf.Bytes(), dst)
+		err = send(ctx)
+		conn.Close()
 		return err
 	}
+	mcdCtx.CompareAndSwap(nil, ctx)
 	go func() {
-		les := LEs{{"If", ifiName}}
+		les := LEs{{"If", ifiName}, {"Target", target.String()}}
 		for {
+			ctx := mcdCtx.Load()
 			ctx.LogD("mcd", les, func(les LEs) string {
-				return fmt.Sprintf(
-					"MCD Tx %s/%d/%d",
-					ifiName, MCDPort, port,
-				)
+				return fmt.Sprintf("MCD Tx %s/%s/%d", ifiName, target, port)
 			})
-			_, err = conn.WriteTo(buf.Bytes(), dst)
-			if err != nil {
+			if err := send(ctx); err != nil {
 				ctx.LogE("mcd", les, err, func(les LEs) string {
-					return fmt.Sprintf("MCD on %s/%d/%d", ifiName, MCDPort, port)
+					return fmt.Sprintf("MCD on %s/%s/%d", ifiName, target, port)
 				})
 			}
 			time.Sleep(interval)
@@ -0,0 +1,288 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+func TestMCDParse(t *testing.T) {
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeAlien, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{Self: nodeOur, Neigh: make(map[NodeId]*Node)}
+	node := nodeOur.Their()
+	ctx.Neigh[*nodeOur.Id] = node
+	src := &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "ifi"}
+	now := time.Now()
+
+	data, err := MCDv2Marshal(nodeOur, 5400, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, addrs, err := ctx.mcdParse("ifi", "ifi", src, data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != node || len(addrs) != 1 ||
+		!addrs[0].IP.Equal(src.IP) || addrs[0].Port != 5400 ||
+		addrs[0].Zone != src.Zone {
+		t.Fatal("bad source address", addrs)
+	}
+	_, addrs, err = ctx.mcdParse("ifi", "ifi", src, data, now)
+	if err != nil {
+		t.Fatal("duplicate from the same source failed", err)
+	}
+	if len(addrs) != 0 {
+		t.Fatal("duplicate from the same source accepted", addrs)
+	}
+	srcOther := &net.UDPAddr{IP: net.ParseIP("fe80::3"), Port: 1234, Zone: "ifi"}
+	if _, _, err = ctx.mcdParse("ifi", "ifi", srcOther, data, now); err == nil {
+		t.Fatal("replay accepted")
+	}
+	srcOtherIfi := &net.UDPAddr{IP: src.IP, Port: 1234, Zone: "ifi2"}
+	if _, _, err = ctx.mcdParse("ifi2", "ifi2", srcOtherIfi, data, now); err == nil {
+		t.Fatal("replay on another interface accepted")
+	}
+
+	data, err = MCDv2Marshal(
+		nodeOur, 5401, []string{"192.0.2.1", "fe80::2"}, now.Add(time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addrs, err = ctx.mcdParse("ifi", "ifi", src, data, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 ||
+		addrs[0].String() != "192.0.2.1:5401" ||
+		addrs[1].String() != "[fe80::2%ifi]:5401" {
+		t.Fatal("bad addresses", addrs)
+	}
+
+	data, err = MCDv2Marshal(nodeOur, 5400, nil, now.Add(-2*mcdTimeWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ctx.mcdParse("ifi", "ifi", src, data, now); err == nil {
+		t.Fatal("stale accepted")
+	}
+
+	forged := *nodeAlien
+	forged.Id = nodeOur.Id
+	data, err = MCDv2Marshal(&forged, 5400, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ctx.mcdParse("ifi", "ifi", src, data, now); err == nil {
+		t.Fatal("forged accepted")
+	}
+	data, err = MCDv2Marshal(nodeAlien, 5400, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ctx.mcdParse("ifi", "ifi", src, data, now); err == nil {
+		t.Fatal("unknown node accepted")
+	}
+
+	var buf bytes.Buffer
+	if _, err = xdr.Marshal(&buf, MCD{
+		Magic: MagicNNCPDv1.B, Sender: nodeOur.Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ctx.mcdParse("ifi", "ifi", src, buf.Bytes(), now); err == nil {
+		t.Fatal("MCDv1 accepted")
+	}
+	node.MCDv1 = true
+	_, addrs, err = ctx.mcdParse("ifi", "ifi", src, buf.Bytes(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].String() != src.String() {
+		t.Fatal("bad MCDv1 address", addrs)
+	}
+}
+
+func TestMCDTargetParse(t *testing.T) {
+	for entry, expected := range map[string]string{
+		".*":                          "[ff02::4e4e:4350]:5400",
+		"eth0 [ff05::4e4e:4350]:5401": "[ff05::4e4e:4350]:5401",
+		"eth.*\t239.78.78.67":         "239.78.78.67:5400",
+		"igb0 255.255.255.255:5402":   "255.255.255.255:5402",
+		"igb0 192.168.1.255":          "192.168.1.255:5400",
+		"eth1 [ff05::4e4e:4350]":      "[ff05::4e4e:4350]:5400",
+	} {
+		ifiRe, target, err := MCDTargetParse(entry)
+		if err != nil {
+			t.Fatal(entry, err)
+		}
+		if target.String() != expected {
+			t.Fatal(entry, target)
+		}
+		if !ifiRe.MatchString(strings.Fields(entry)[0]) {
+			t.Fatal(entry, "does not match")
+		}
+	}
+	for _, entry := range []string{
+		"", " 239.78.78.67", "eth0 fe80::1", "eth0 192.168.1.255:0",
+		"eth0 192.168.1.255:65536", "( 239.78.78.67", "(",
+	} {
+		if _, _, err := MCDTargetParse(entry); err == nil {
+			t.Fatal("accepted", entry)
+		}
+	}
+	// Whitespace without the target address is the part of regexp
+	for _, entry := range []string{"eth0 foo", "eth0 239.78.78.67 5400", "eth0 "} {
+		ifiRe, target, err := MCDTargetParse(entry)
+		if err != nil {
+			t.Fatal(entry, err)
+		}
+		if target.String() != "[ff02::4e4e:4350]:5400" {
+			t.Fatal(entry, target)
+		}
+		if !ifiRe.MatchString(entry) || ifiRe.MatchString("eth0") {
+			t.Fatal(entry, "regexp is changed")
+		}
+	}
+}
+
+func TestMCDCfgValidate(t *testing.T) {
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := func(listen []string, send map[string]int) *CfgJSON {
+		return &CfgJSON{
+			Spool: "/spool",
+			Log:   "/log",
+			Neigh: map[string]NodeJSON{"self": {
+				Id:      nodeOur.Id.String(),
+				ExchPub: Base32Codec.EncodeToString(nodeOur.ExchPub[:]),
+				SignPub: Base32Codec.EncodeToString(nodeOur.SignPub[:]),
+			}},
+			MCDRxIfis: listen,
+			MCDTxIfis: send,
+		}
+	}
+	if _, err = Cfg2Ctx(cfg(
+		[]string{"em0", "igb0 255.255.255.255"},
+		map[string]int{"em0 239.78.78.67": 10},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Cfg2Ctx(cfg([]string{"em0 fe80::1"}, nil)); err == nil {
+		t.Fatal("invalid mcd-listen is accepted")
+	}
+	if _, err = Cfg2Ctx(cfg(nil, map[string]int{"(": 10})); err == nil {
+		t.Fatal("invalid mcd-send is accepted")
+	}
+}
+
+func TestMCDBcastRxIfis(t *testing.T) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo string
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			lo = ifi.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("no loopback interface")
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	spool, err := ioutil.TempDir("", "testmcd")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Self:    nodeOur,
+		Neigh:   make(map[NodeId]*Node),
+		LogPath: filepath.Join(spool, "log.log"),
+	}
+	ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+	mcdCtx.Store(&ctx)
+	defer mcdCtx.Store(nil)
+	target := &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+	announce := func(now time.Time) {
+		data, err := MCDv2Marshal(nodeOur, 5400, nil, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{
+			IP: net.IPv4(127, 0, 0, 1), Port: port,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = ctx.MCDRx(lo+"-excluded", target); err != nil {
+		t.Fatal(err)
+	}
+	announce(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	if len(MCDNodeAddrs(nodeOur.Id)) != 0 {
+		t.Fatal("announcement from not listened interface is accepted")
+	}
+
+	if err = ctx.MCDRx(lo, target); err != nil {
+		t.Fatal(err)
+	}
+	announce(time.Now().Add(time.Second))
+	for i := 0; len(MCDNodeAddrs(nodeOur.Id)) == 0; i++ {
+		if i == 100 {
+			t.Fatal("announcement from listened interface is not accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
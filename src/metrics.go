@@ -0,0 +1,302 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of the running daemon/caller, exported in Prometheus text
+// exposition format through HTTP.
+type Metrics struct {
+	ctx          *Ctx
+	sessions     map[*SPState]struct{}
+	rxBytes      map[NodeId]int64
+	txBytes      map[NodeId]int64
+	lastCall     map[NodeId]time.Time
+	tossFailures map[string]int64
+	sync.Mutex
+}
+
+func NewMetrics(ctx *Ctx) *Metrics {
+	return &Metrics{
+		ctx:          ctx,
+		sessions:     make(map[*SPState]struct{}),
+		rxBytes:      make(map[NodeId]int64),
+		txBytes:      make(map[NodeId]int64),
+		lastCall:     make(map[NodeId]time.Time),
+		tossFailures: make(map[string]int64),
+	}
+}
+
+func (m *Metrics) setCtx(ctx *Ctx) {
+	m.Lock()
+	m.ctx = ctx
+	m.Unlock()
+}
+
+func (m *Metrics) spStarted(state *SPState) {
+	m.Lock()
+	m.sessions[state] = struct{}{}
+	m.Unlock()
+}
+
+func (m *Metrics) spFinished(state *SPState, isGood bool) {
+	m.Lock()
+	delete(m.sessions, state)
+	m.rxBytes[*state.Node.Id] += state.RxBytes
+	m.txBytes[*state.Node.Id] += state.TxBytes
+	if isGood {
+		m.lastCall[*state.Node.Id] = time.Now()
+	}
+	m.Unlock()
+}
+
+func (m *Metrics) logError(who string) {
+	if !strings.HasPrefix(who, "rx") {
+		return
+	}
+	m.Lock()
+	m.tossFailures[who]++
+	m.Unlock()
+}
+
+func metricsLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+type metricsFamily struct {
+	name    string
+	typ     string
+	help    string
+	samples []string
+}
+
+// Text exposition format requires all samples of the metric family to
+// be grouped after its description, so they are collected first and
+// written all at once.
+type metricsWriter struct {
+	families []*metricsFamily
+	byName   map[string]*metricsFamily
+}
+
+func (mw *metricsWriter) write(
+	name, typ, help string,
+	labels []string,
+	v interface{},
+) {
+	family, exists := mw.byName[name]
+	if !exists {
+		family = &metricsFamily{name: name, typ: typ, help: help}
+		mw.families = append(mw.families, family)
+		mw.byName[name] = family
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(
+			`%s="%s"`, labels[i], metricsLabel(labels[i+1]),
+		))
+	}
+	if len(pairs) == 0 {
+		family.samples = append(family.samples, fmt.Sprintf("%s %v", name, v))
+	} else {
+		family.samples = append(family.samples, fmt.Sprintf(
+			"%s{%s} %v", name, strings.Join(pairs, ","), v,
+		))
+	}
+}
+
+func (mw *metricsWriter) flush(w io.Writer) {
+	for _, family := range mw.families {
+		fmt.Fprintf(
+			w, "# HELP %s %s\n# TYPE %s %s\n",
+			family.name, family.help, family.name, family.typ,
+		)
+		for _, sample := range family.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+func (m *Metrics) writeQueues(mw *metricsWriter, ctx *Ctx) {
+	nodes := make([]*Node, 0, len(ctx.Neigh))
+	for _, node := range ctx.Neigh {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	for _, xx := range []TRxTx{TRx, TTx} {
+		for _, node := range nodes {
+			nums := make(map[uint8]int)
+			sizes := make(map[uint8]int64)
+			for job := range ctx.Jobs(node.Id, xx) {
+				nums[job.PktEnc.Nice]++
+				sizes[job.PktEnc.Nice] += job.Size
+			}
+			nices := make([]int, 0, len(nums))
+			for nice := range nums {
+				nices = append(nices, int(nice))
+			}
+			sort.Ints(nices)
+			for _, nice := range nices {
+				labels := []string{"node", node.Name, "nice", strconv.Itoa(nice)}
+				mw.write(
+					"nncp_"+string(xx)+"_pkts", "gauge",
+					"Number of queued packets",
+					labels, nums[uint8(nice)],
+				)
+				mw.write(
+					"nncp_"+string(xx)+"_bytes", "gauge",
+					"Size of queued packets",
+					labels, sizes[uint8(nice)],
+				)
+			}
+		}
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	mw := &metricsWriter{byName: make(map[string]*metricsFamily)}
+	defer mw.flush(w)
+	m.Lock()
+	ctx := m.ctx
+	m.Unlock()
+	m.writeQueues(mw, ctx)
+
+	m.Lock()
+	defer m.Unlock()
+	mw.write(
+		"nncp_sp_sessions", "gauge",
+		"Number of active SP sessions", nil, len(m.sessions),
+	)
+	states := make([]*SPState, 0, len(m.sessions))
+	for state := range m.sessions {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].started.Before(states[j].started)
+	})
+	now := time.Now()
+	nodeConns := make(map[NodeId]int)
+	for _, state := range states {
+		// Several sessions with the node are numbered in order of start
+		labels := []string{
+			"node", state.Node.Name,
+			"conn", strconv.Itoa(nodeConns[*state.Node.Id]),
+		}
+		nodeConns[*state.Node.Id]++
+		rxBytes := atomic.LoadInt64(&state.RxBytes)
+		txBytes := atomic.LoadInt64(&state.TxBytes)
+		mw.write(
+			"nncp_sp_rx_bytes", "gauge",
+			"Received bytes during the active SP session",
+			labels, rxBytes,
+		)
+		mw.write(
+			"nncp_sp_tx_bytes", "gauge",
+			"Transmitted bytes during the active SP session",
+			labels, txBytes,
+		)
+		rxSpeed, txSpeed := rxBytes, txBytes
+		if duration := int64(now.Sub(state.started).Seconds()); duration > 0 {
+			rxSpeed /= duration
+			txSpeed /= duration
+		}
+		mw.write(
+			"nncp_sp_rx_speed", "gauge",
+			"Receiving speed (bytes/sec) of the active SP session",
+			labels, rxSpeed,
+		)
+		mw.write(
+			"nncp_sp_tx_speed", "gauge",
+			"Transmitting speed (bytes/sec) of the active SP session",
+			labels, txSpeed,
+		)
+	}
+
+	nodeIds := make([]NodeId, 0, len(m.rxBytes))
+	for nodeId := range m.rxBytes {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Slice(nodeIds, func(i, j int) bool {
+		return m.ctx.NodeName(&nodeIds[i]) < m.ctx.NodeName(&nodeIds[j])
+	})
+	for _, nodeId := range nodeIds {
+		labels := []string{"node", m.ctx.NodeName(&nodeId)}
+		mw.write(
+			"nncp_sp_rx_bytes_total", "counter",
+			"Received bytes during the finished SP sessions",
+			labels, m.rxBytes[nodeId],
+		)
+		mw.write(
+			"nncp_sp_tx_bytes_total", "counter",
+			"Transmitted bytes during the finished SP sessions",
+			labels, m.txBytes[nodeId],
+		)
+		if lastCall, exists := m.lastCall[nodeId]; exists {
+			mw.write(
+				"nncp_last_call_timestamp_seconds", "gauge",
+				"Time of the last successfully finished SP session",
+				labels, lastCall.Unix(),
+			)
+		}
+	}
+
+	whos := make([]string, 0, len(m.tossFailures))
+	for who := range m.tossFailures {
+		whos = append(whos, who)
+	}
+	sort.Strings(whos)
+	for _, who := range whos {
+		mw.write(
+			"nncp_toss_failures_total", "counter",
+			"Number of tossing failures", []string{"who", who},
+			m.tossFailures[who],
+		)
+	}
+}
+
+// Start collecting metrics and serving them through HTTP on /metrics
+// path in background.
+func (ctx *Ctx) MetricsListen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ctx.Metrics = NewMetrics(ctx)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", ctx.Metrics)
+	go func() {
+		err := http.Serve(ln, mux)
+		ctx.LogE("metrics", LEs{{"Addr", addr}}, err, func(les LEs) string {
+			return "Serving metrics on " + addr
+		})
+	}()
+	return nil
+}
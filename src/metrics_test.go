@@ -0,0 +1,222 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	metricsHelpRe   = regexp.MustCompile(`^# HELP ([a-zA-Z_:][a-zA-Z0-9_:]*) .+$`)
+	metricsTypeRe   = regexp.MustCompile(`^# TYPE ([a-zA-Z_:][a-zA-Z0-9_:]*) (counter|gauge)$`)
+	metricsSampleRe = regexp.MustCompile(
+		`^([a-zA-Z_:][a-zA-Z0-9_:]*)` +
+			`(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*"` +
+			`(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\.)*")*\})? (\S+)$`,
+	)
+)
+
+// Strictly parse text exposition format, returning values of the
+// series. Each family must be described once and have all its samples
+// grouped right after the description.
+func metricsParse(t *testing.T, body string) map[string]float64 {
+	series := make(map[string]float64)
+	families := make(map[string]struct{})
+	var family string
+	var typed bool
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if m := metricsHelpRe.FindStringSubmatch(line); m != nil {
+			if _, exists := families[m[1]]; exists {
+				t.Fatalf("family %s is described again:\n%s", m[1], body)
+			}
+			families[m[1]] = struct{}{}
+			family, typed = m[1], false
+			continue
+		}
+		if m := metricsTypeRe.FindStringSubmatch(line); m != nil {
+			if m[1] != family || typed {
+				t.Fatalf("unexpected TYPE of %s:\n%s", m[1], body)
+			}
+			typed = true
+			continue
+		}
+		m := metricsSampleRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid line %q:\n%s", line, body)
+		}
+		if m[1] != family || !typed {
+			t.Fatalf("sample %q outside its family:\n%s", line, body)
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Fatalf("invalid value in %q", line)
+		}
+		if _, exists := series[m[1]+m[2]]; exists {
+			t.Fatalf("duplicate series %s%s:\n%s", m[1], m[2], body)
+		}
+		series[m[1]+m[2]] = v
+	}
+	return series
+}
+
+func TestMetrics(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testmetrics")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTgt, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   make(map[NodeId]*Node),
+		Alias:   make(map[string]*NodeId),
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+	node := nodeTgt.Their()
+	node.Name = "tgt"
+	node.Resend = time.Minute
+	node.ResendMax = 1
+	ctx.Neigh[*nodeTgt.Id] = node
+	for i := 0; i < 2; i++ {
+		if err = ctx.TxExec(
+			node, 123, 123, "sink", nil,
+			strings.NewReader("BODY\n"), 1<<15, MaxFileSize, false, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Transmitted long ago packet waiting for resending
+	sentDir := filepath.Join(spool, nodeTgt.Id.String(), SentDir)
+	for job := range ctx.Jobs(nodeTgt.Id, TTx) {
+		if err = ctx.TxSentRemove(node, job.Path); err != nil {
+			t.Fatal(err)
+		}
+		past := time.Now().Add(-time.Hour)
+		os.Chtimes(filepath.Join(sentDir, filepath.Base(job.Path)), past, past)
+		break
+	}
+	if err = ctx.TxExec(
+		node, 200, 200, "sink", nil,
+		strings.NewReader("BODY\n"), 1<<15, MaxFileSize, false, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMetrics(&ctx)
+	scrape := func() map[string]float64 {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatal("unexpected content type:", ct)
+		}
+		return metricsParse(t, w.Body.String())
+	}
+	has := func(series map[string]float64, expected map[string]float64) {
+		for name, v := range expected {
+			got, exists := series[name]
+			if !exists {
+				t.Fatalf("no %s in %v", name, series)
+			}
+			if got != v {
+				t.Fatalf("%s: %v != %v", name, got, v)
+			}
+		}
+	}
+
+	series := scrape()
+	has(series, map[string]float64{
+		`nncp_tx_pkts{node="tgt",nice="123"}`: 1,
+		`nncp_tx_pkts{node="tgt",nice="200"}`: 1,
+		"nncp_sp_sessions":                    0,
+	})
+	if series[`nncp_tx_bytes{node="tgt",nice="200"}`] == 0 {
+		t.Fatal("no size of queued packets")
+	}
+	if _, exists := series[`nncp_last_call_timestamp_seconds{node="tgt"}`]; exists {
+		t.Fatal("last call without sessions")
+	}
+	if len(dirFiles(sentDir)) != 1 {
+		t.Fatal("scraping modified the spool")
+	}
+
+	// Failed session counts bytes, but it is not the successful call.
+	// Simultaneous sessions with the node are distinguished by number.
+	state := &SPState{Ctx: &ctx, Node: node, started: time.Now()}
+	m.spStarted(state)
+	state.RxBytes, state.TxBytes = 100, 200
+	state2 := &SPState{Ctx: &ctx, Node: node, started: time.Now().Add(time.Second)}
+	m.spStarted(state2)
+	state2.RxBytes, state2.TxBytes = 10, 20
+	has(scrape(), map[string]float64{
+		"nncp_sp_sessions":                      2,
+		`nncp_sp_rx_bytes{node="tgt",conn="0"}`: 100,
+		`nncp_sp_tx_bytes{node="tgt",conn="0"}`: 200,
+		`nncp_sp_rx_bytes{node="tgt",conn="1"}`: 10,
+		`nncp_sp_tx_bytes{node="tgt",conn="1"}`: 20,
+	})
+	m.spFinished(state, false)
+	m.spFinished(state2, false)
+	series = scrape()
+	has(series, map[string]float64{
+		"nncp_sp_sessions":                   0,
+		`nncp_sp_rx_bytes_total{node="tgt"}`: 110,
+		`nncp_sp_tx_bytes_total{node="tgt"}`: 220,
+	})
+	if _, exists := series[`nncp_last_call_timestamp_seconds{node="tgt"}`]; exists {
+		t.Fatal("last call after failed session")
+	}
+
+	state = &SPState{Ctx: &ctx, Node: node, started: time.Now()}
+	m.spStarted(state)
+	state.RxBytes, state.TxBytes = 1, 2
+	m.spFinished(state, true)
+	m.logError("rx-unknown")
+	m.logError("rx-unknown")
+	m.logError("tx")
+	series = scrape()
+	has(series, map[string]float64{
+		`nncp_sp_rx_bytes_total{node="tgt"}`:         111,
+		`nncp_sp_tx_bytes_total{node="tgt"}`:         222,
+		`nncp_toss_failures_total{who="rx-unknown"}`: 2,
+	})
+	if _, exists := series[`nncp_last_call_timestamp_seconds{node="tgt"}`]; !exists {
+		t.Fatal("no last call after successful session")
+	}
+	if _, exists := series[`nncp_toss_failures_total{who="tx"}`]; exists {
+		t.Fatal("non-tossing failure is counted")
+	}
+}
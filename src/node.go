@@ -50,13 +50,25 @@ type Node struct {
 	FreqChunked    int64
 	FreqMinSize    int64
 	FreqMaxSize    int64
+	Quota          Quota
+	Transit        *Transit
 	Via            []*NodeId
 	Addrs          map[string]string
+	Proxy          string
 	RxRate         int
 	TxRate         int
+	RxLimit        int64
+	TxLimit        int64
+	RateSchedule   []*RateSchedule
 	OnlineDeadline time.Duration
 	MaxOnlineTime  time.Duration
 	Calls          []*Call
+	Receipt        bool
+	MCDv1          bool
+	Expire         time.Duration
+	Resend         time.Duration
+	ResendMax      int
+	BackoffMax     time.Duration
 
 	Busy bool
 	sync.Mutex
@@ -0,0 +1,167 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+// Simultaneous SP sessions of the same parallel call with the node
+// share rx/tx directories locks. Sessions of another call, or sessions
+// without the call group at all, are excluded, as other processes are
+// by the underlying flock.
+type sharedLock struct {
+	fd    *os.File
+	refs  int
+	group [16]byte
+}
+
+var (
+	sharedLocks  = make(map[string]*sharedLock)
+	sharedLocksM sync.Mutex
+
+	// Packets being received by SP sessions in that process
+	spRxClaims  = make(map[[MTHSize]byte]*SPState)
+	spRxClaimsM sync.Mutex
+)
+
+func (ctx *Ctx) LockDirShared(
+	nodeId *NodeId,
+	lockCtx string,
+	group [16]byte,
+) (*os.File, error) {
+	lockPath := filepath.Join(ctx.Spool, nodeId.String(), lockCtx)
+	sharedLocksM.Lock()
+	defer sharedLocksM.Unlock()
+	if l, exists := sharedLocks[lockPath]; exists {
+		if l.group != group {
+			err := errors.New("locked by another parallel call")
+			ctx.LogE("lockdir-shared", LEs{{"Path", lockPath}}, err, func(les LEs) string {
+				return "Locking directory: " + lockPath
+			})
+			return nil, err
+		}
+		l.refs++
+		return l.fd, nil
+	}
+	fd, err := ctx.LockDir(nodeId, lockCtx)
+	if err != nil {
+		return nil, err
+	}
+	sharedLocks[lockPath] = &sharedLock{fd: fd, refs: 1, group: group}
+	return fd, nil
+}
+
+func (ctx *Ctx) UnlockDirShared(fd *os.File) {
+	if fd == nil {
+		return
+	}
+	sharedLocksM.Lock()
+	defer sharedLocksM.Unlock()
+	for lockPath, l := range sharedLocks {
+		if l.fd != fd {
+			continue
+		}
+		l.refs--
+		if l.refs == 0 {
+			ctx.UnlockDir(fd)
+			delete(sharedLocks, lockPath)
+		}
+		return
+	}
+	ctx.UnlockDir(fd)
+}
+
+// Lock the directory exclusively, or share it with other sessions of
+// the same parallel call.
+func (state *SPState) dirLock(nodeId *NodeId, lockCtx string) (*os.File, error) {
+	if state.partNum <= 1 {
+		return state.Ctx.LockDir(nodeId, lockCtx)
+	}
+	return state.Ctx.LockDirShared(nodeId, lockCtx, state.partGroup)
+}
+
+// PART packet, telling the responder what part of the parallel call
+// that session is.
+func (state *SPState) partMarshal() []byte {
+	return MarshalSP(SPTypePart, SPPart{
+		Group: state.partGroup,
+		Idx:   uint32(state.partIdx),
+		Num:   uint32(state.partNum),
+	})
+}
+
+// Take the part of the parallel call from the PART packet, if the
+// initiator's first payload starts with it.
+func (state *SPState) partUnmarshal(payload []byte) error {
+	r := bytes.NewReader(payload)
+	var head SPHead
+	if _, err := xdr.Unmarshal(r, &head); err != nil || head.Type != SPTypePart {
+		return nil
+	}
+	var part SPPart
+	if _, err := xdr.Unmarshal(r, &part); err != nil {
+		return err
+	}
+	if part.Num < 2 || part.Idx >= part.Num {
+		return fmt.Errorf("invalid part %d/%d", part.Idx, part.Num)
+	}
+	state.partGroup = part.Group
+	state.partIdx = int(part.Idx)
+	state.partNum = int(part.Num)
+	return nil
+}
+
+// Does the packet belong to that session's part of the parallel call?
+// Packets are distributed between sessions by their hash.
+func (state *SPState) inPart(hsh *[MTHSize]byte) bool {
+	if state.partNum <= 1 {
+		return true
+	}
+	return int(binary.BigEndian.Uint32(hsh[:4])%uint32(state.partNum)) == state.partIdx
+}
+
+// Claim the packet for reception by that session. Returns false if it
+// is already being received by another one.
+func (state *SPState) rxClaim(hsh *[MTHSize]byte) bool {
+	spRxClaimsM.Lock()
+	defer spRxClaimsM.Unlock()
+	if owner, exists := spRxClaims[*hsh]; exists && owner != state {
+		return false
+	}
+	spRxClaims[*hsh] = state
+	return true
+}
+
+func (state *SPState) rxClaimsRelease() {
+	spRxClaimsM.Lock()
+	for hsh, owner := range spRxClaims {
+		if owner == state {
+			delete(spRxClaims, hsh)
+		}
+	}
+	spRxClaimsM.Unlock()
+}
@@ -0,0 +1,232 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestSPPartition(t *testing.T) {
+	f := func(hsh [MTHSize]byte, partNum uint8) bool {
+		partNum = partNum%8 + 1
+		states := make([]*SPState, partNum)
+		for i := range states {
+			states[i] = &SPState{partIdx: i, partNum: int(partNum)}
+		}
+		owners := 0
+		for _, state := range states {
+			if state.inPart(&hsh) {
+				owners++
+			}
+		}
+		if owners != 1 {
+			return false
+		}
+		if !states[0].rxClaim(&hsh) || !states[0].rxClaim(&hsh) {
+			return false
+		}
+		if partNum > 1 && states[1].rxClaim(&hsh) {
+			return false
+		}
+		states[0].rxClaimsRelease()
+		if !states[len(states)-1].rxClaim(&hsh) {
+			return false
+		}
+		states[len(states)-1].rxClaimsRelease()
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockDirShared(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testlockdir")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   make(map[NodeId]*Node),
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	group := [16]byte{1}
+	fd1, err := ctx.LockDirShared(nodeOur.Id, string(TRx), group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, err := ctx.LockDirShared(nodeOur.Id, string(TRx), group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ctx.LockDir(nodeOur.Id, string(TRx)); err == nil {
+		t.Fatal("exclusive lock is not held")
+	}
+	if _, err = ctx.LockDirShared(nodeOur.Id, string(TRx), [16]byte{2}); err == nil {
+		t.Fatal("lock is shared with another group")
+	}
+	ctx.UnlockDirShared(fd1)
+	if _, err = ctx.LockDir(nodeOur.Id, string(TRx)); err == nil {
+		t.Fatal("lock released too early")
+	}
+	ctx.UnlockDirShared(fd2)
+	fd, err := ctx.LockDir(nodeOur.Id, string(TRx))
+	if err != nil {
+		t.Fatal("lock is not released")
+	}
+	ctx.UnlockDir(fd)
+}
+
+func TestSPParallel(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testspparallel")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeA, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCtx := func(our, their *NodeOur, name string) (*Ctx, *Node) {
+		node := their.Their()
+		node.NoisePub = their.NoisePub
+		node.OnlineDeadline = time.Minute
+		ctx := &Ctx{
+			Spool:   filepath.Join(spool, name),
+			Self:    our,
+			SelfId:  our.Id,
+			Neigh:   map[NodeId]*Node{*their.Id: node},
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, name+".log"),
+			Debug:   TDebug,
+		}
+		return ctx, node
+	}
+	ctxA, nodeBOfA := newCtx(nodeA, nodeB, "a")
+	ctxB, nodeAOfB := newCtx(nodeB, nodeA, "b")
+	const pkts = 8
+	for i := 0; i < pkts; i++ {
+		if err = ctxA.TxExec(
+			nodeBOfA, DefaultNiceExec, DefaultNiceExec, "sendmail", nil,
+			bytes.NewReader(nil), int64(1024+i), MaxFileSize, true, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+		if err = ctxB.TxExec(
+			nodeAOfB, DefaultNiceExec, DefaultNiceExec, "sendmail", nil,
+			bytes.NewReader(nil), int64(1024+i), MaxFileSize, true, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	group := [16]byte{1, 2, 3}
+	var states []*SPState
+	defer func() {
+		for _, state := range states {
+			state.Kill()
+			state.Wait()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		connA, connB := net.Pipe()
+		stateA := &SPState{
+			Ctx:            ctxA,
+			Node:           nodeBOfA,
+			Nice:           255,
+			NoCK:           true,
+			onlineDeadline: time.Minute,
+			partIdx:        i,
+			partNum:        2,
+			partGroup:      group,
+		}
+		stateB := &SPState{Ctx: ctxB, Nice: 255, NoCK: true}
+		errB := make(chan error)
+		go func() { errB <- stateB.StartR(connB) }()
+		if err = stateA.StartI(connA); err != nil {
+			t.Fatal(err)
+		}
+		if err = <-errB; err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, stateA, stateB)
+		if stateB.partIdx != i || stateB.partNum != 2 || stateB.partGroup != group {
+			t.Fatal("responder has not got the part")
+		}
+	}
+
+	// Session outside the parallel call is not allowed by the responder
+	ctxA2, nodeBOfA2 := newCtx(nodeA, nodeB, "a2")
+	connA, connB := net.Pipe()
+	stateA := &SPState{
+		Ctx:            ctxA2,
+		Node:           nodeBOfA2,
+		Nice:           255,
+		NoCK:           true,
+		onlineDeadline: time.Minute,
+		partNum:        1,
+	}
+	stateB := &SPState{Ctx: ctxB, Nice: 255, NoCK: true}
+	errB := make(chan error)
+	go func() {
+		err := stateB.StartR(connB)
+		connB.Close()
+		errB <- err
+	}()
+	stateA.StartI(connA)
+	if err = <-errB; err == nil {
+		stateB.Kill()
+		stateB.Wait()
+		t.Fatal("session outside the parallel call is accepted")
+	}
+	connA.Close()
+
+	count := func(ctx *Ctx, nodeId *NodeId) (n int) {
+		for range ctx.JobsNoCK(nodeId) {
+			n++
+		}
+		return
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		if count(ctxB, nodeA.Id) == pkts && count(ctxA, nodeB.Id) == pkts {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("packets are not received")
+}
@@ -23,6 +23,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"io"
+	"time"
 
 	xdr "github.com/davecgh/go-xdr/xdr2"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -45,6 +46,7 @@ const (
 	PktTypeExecFat PktType = iota
 	PktTypeArea    PktType = iota
 	PktTypeACK     PktType = iota
+	PktTypeReceipt PktType = iota
 
 	MaxPathSize = 1<<8 - 1
 
@@ -58,9 +60,14 @@ var (
 	DeriveKeySizeCtx = string(MagicNNCPEv6.B[:]) + " SIZE"
 	DeriveKeyPadCtx  = string(MagicNNCPEv6.B[:]) + " PAD"
 
-	PktOverhead     int64
-	PktEncOverhead  int64
-	PktSizeOverhead int64
+	DeriveKeyFullCtxV7 = string(MagicNNCPEv7.B[:]) + " FULL"
+	DeriveKeySizeCtxV7 = string(MagicNNCPEv7.B[:]) + " SIZE"
+	DeriveKeyPadCtxV7  = string(MagicNNCPEv7.B[:]) + " PAD"
+
+	PktOverhead      int64
+	PktEncOverhead   int64 // NNCPEv7, with expiration time
+	PktEncV6Overhead int64
+	PktSizeOverhead  int64
 
 	TooBig = errors.New("Too big than allowed")
 )
@@ -76,12 +83,35 @@ type Pkt struct {
 type PktTbs struct {
 	Magic     [8]byte
 	Nice      uint8
+	Expire    uint64
 	Sender    *NodeId
 	Recipient *NodeId
 	ExchPub   [32]byte
 }
 
+// In-memory representation of both NNCPEv6 and NNCPEv7 headers. Use
+// PktEncMarshal/PktEncUnmarshal for their serialization.
 type PktEnc struct {
+	Magic     [8]byte
+	Nice      uint8
+	Expire    uint64 // UNIX time after which packet is expired, 0 for never
+	Sender    *NodeId
+	Recipient *NodeId
+	ExchPub   [32]byte
+	Sign      [ed25519.SignatureSize]byte
+}
+
+// NNCPEv6 header has no expiration time. It is still created for never
+// expiring packets, for compatibility with older versions.
+type PktTbsV6 struct {
+	Magic     [8]byte
+	Nice      uint8
+	Sender    *NodeId
+	Recipient *NodeId
+	ExchPub   [32]byte
+}
+
+type PktEncV6 struct {
 	Magic     [8]byte
 	Nice      uint8
 	Sender    *NodeId
@@ -90,6 +120,112 @@ type PktEnc struct {
 	Sign      [ed25519.SignatureSize]byte
 }
 
+// Marshal encrypted packet's header in the format corresponding to its
+// magic number.
+func PktEncMarshal(w io.Writer, pktEnc *PktEnc) (int, error) {
+	if pktEnc.Magic == MagicNNCPEv6.B {
+		return xdr.Marshal(w, &PktEncV6{
+			Magic:     pktEnc.Magic,
+			Nice:      pktEnc.Nice,
+			Sender:    pktEnc.Sender,
+			Recipient: pktEnc.Recipient,
+			ExchPub:   pktEnc.ExchPub,
+			Sign:      pktEnc.Sign,
+		})
+	}
+	return xdr.Marshal(w, pktEnc)
+}
+
+// Unmarshal encrypted packet's header, either NNCPEv6 or NNCPEv7 one.
+// Headers with other magic numbers are unmarshalled as NNCPEv7, so
+// caller has to check the magic.
+func PktEncUnmarshal(r io.Reader) (*PktEnc, int, error) {
+	var magic [8]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, 0, err
+	}
+	r = io.MultiReader(bytes.NewReader(magic[:]), r)
+	if magic == MagicNNCPEv6.B {
+		var pktEncV6 PktEncV6
+		n, err := xdr.Unmarshal(r, &pktEncV6)
+		if err != nil {
+			return nil, n, err
+		}
+		return &PktEnc{
+			Magic:     pktEncV6.Magic,
+			Nice:      pktEncV6.Nice,
+			Sender:    pktEncV6.Sender,
+			Recipient: pktEncV6.Recipient,
+			ExchPub:   pktEncV6.ExchPub,
+			Sign:      pktEncV6.Sign,
+		}, n, nil
+	}
+	var pktEnc PktEnc
+	n, err := xdr.Unmarshal(r, &pktEnc)
+	if err != nil {
+		return nil, n, err
+	}
+	return &pktEnc, n, nil
+}
+
+// Magic number of the created encrypted packet: NNCPEv7 is used only
+// when expiration time is set.
+func pktEncMagic(expire uint64) [8]byte {
+	if expire == 0 {
+		return MagicNNCPEv6.B
+	}
+	return MagicNNCPEv7.B
+}
+
+func pktEncOverhead(magic [8]byte) int64 {
+	if magic == MagicNNCPEv6.B {
+		return PktEncV6Overhead
+	}
+	return PktEncOverhead
+}
+
+func pktEncDeriveKeyCtxs(magic [8]byte) (full, size, pad string) {
+	if magic == MagicNNCPEv6.B {
+		return DeriveKeyFullCtx, DeriveKeySizeCtx, DeriveKeyPadCtx
+	}
+	return DeriveKeyFullCtxV7, DeriveKeySizeCtxV7, DeriveKeyPadCtxV7
+}
+
+func pktTbsMarshal(
+	magic [8]byte, nice uint8, expire uint64,
+	sender, recipient *NodeId, exchPub [32]byte,
+) []byte {
+	var tbs interface{}
+	if magic == MagicNNCPEv6.B {
+		tbs = &PktTbsV6{
+			Magic:     magic,
+			Nice:      nice,
+			Sender:    sender,
+			Recipient: recipient,
+			ExchPub:   exchPub,
+		}
+	} else {
+		tbs = &PktTbs{
+			Magic:     magic,
+			Nice:      nice,
+			Expire:    expire,
+			Sender:    sender,
+			Recipient: recipient,
+			ExchPub:   exchPub,
+		}
+	}
+	var tbsBuf bytes.Buffer
+	if _, err := xdr.Marshal(&tbsBuf, tbs); err != nil {
+		panic(err)
+	}
+	return tbsBuf.Bytes()
+}
+
+// Is the packet already expired at the given moment.
+func (pktEnc *PktEnc) Expired(now time.Time) bool {
+	return pktEnc.Expire != 0 && uint64(now.Unix()) > pktEnc.Expire
+}
+
 type PktSize struct {
 	Payload uint64
 	Pad     uint64
@@ -124,7 +260,7 @@ func init() {
 		panic(err)
 	}
 	pktEnc := PktEnc{
-		Magic:     MagicNNCPEv6.B,
+		Magic:     MagicNNCPEv7.B,
 		Sender:    dummyId,
 		Recipient: dummyId,
 	}
@@ -135,6 +271,14 @@ func init() {
 	PktEncOverhead = int64(n)
 	buf.Reset()
 
+	pktEnc.Magic = MagicNNCPEv6.B
+	n, err = PktEncMarshal(&buf, &pktEnc)
+	if err != nil {
+		panic(err)
+	}
+	PktEncV6Overhead = int64(n)
+	buf.Reset()
+
 	size := PktSize{}
 	n, err = xdr.Marshal(&buf, size)
 	if err != nil {
@@ -154,18 +298,10 @@ func ctrIncr(b []byte) {
 }
 
 func TbsPrepare(our *NodeOur, their *Node, pktEnc *PktEnc) []byte {
-	tbs := PktTbs{
-		Magic:     MagicNNCPEv6.B,
-		Nice:      pktEnc.Nice,
-		Sender:    their.Id,
-		Recipient: our.Id,
-		ExchPub:   pktEnc.ExchPub,
-	}
-	var tbsBuf bytes.Buffer
-	if _, err := xdr.Marshal(&tbsBuf, &tbs); err != nil {
-		panic(err)
-	}
-	return tbsBuf.Bytes()
+	return pktTbsMarshal(
+		pktEnc.Magic, pktEnc.Nice, pktEnc.Expire,
+		their.Id, our.Id, pktEnc.ExchPub,
+	)
 }
 
 func TbsVerify(our *NodeOur, their *Node, pktEnc *PktEnc) ([]byte, bool, error) {
@@ -182,10 +318,15 @@ func sizeWithTags(size int64) (fullSize int64) {
 	return
 }
 
-func sizePadCalc(sizePayload, minSize int64, wrappers int) (sizePad int64) {
+func sizePadCalc(
+	sizePayload, minSize int64,
+	wrappers int,
+	expire uint64,
+) (sizePad int64) {
 	expectedSize := sizePayload - PktOverhead
 	for i := 0; i < wrappers; i++ {
-		expectedSize = PktEncOverhead + sizeWithTags(PktOverhead+expectedSize)
+		expectedSize = pktEncOverhead(pktEncMagic(expire)) +
+			sizeWithTags(PktOverhead+expectedSize)
 	}
 	sizePad = minSize - expectedSize
 	if sizePad < 0 {
@@ -196,7 +337,7 @@ func sizePadCalc(sizePayload, minSize int64, wrappers int) (sizePad int64) {
 
 func PktEncWrite(
 	our *NodeOur, their *Node,
-	pkt *Pkt, nice uint8,
+	pkt *Pkt, nice uint8, expire uint64,
 	minSize, maxSize int64, wrappers int,
 	r io.Reader, w io.Writer,
 ) (pktEncRaw []byte, size int64, err error) {
@@ -214,31 +355,22 @@ func PktEncWrite(
 	copy(pktRaw, buf.Bytes())
 	buf.Reset()
 
-	tbs := PktTbs{
-		Magic:     MagicNNCPEv6.B,
-		Nice:      nice,
-		Sender:    our.Id,
-		Recipient: their.Id,
-		ExchPub:   *pub,
-	}
-	_, err = xdr.Marshal(&buf, &tbs)
-	if err != nil {
-		return
-	}
+	magic := pktEncMagic(expire)
+	tbs := pktTbsMarshal(magic, nice, expire, our.Id, their.Id, *pub)
 	signature := new([ed25519.SignatureSize]byte)
-	copy(signature[:], ed25519.Sign(our.SignPrv, buf.Bytes()))
-	ad := blake3.Sum256(buf.Bytes())
-	buf.Reset()
+	copy(signature[:], ed25519.Sign(our.SignPrv, tbs))
+	ad := blake3.Sum256(tbs)
 
 	pktEnc := PktEnc{
-		Magic:     MagicNNCPEv6.B,
+		Magic:     magic,
 		Nice:      nice,
+		Expire:    expire,
 		Sender:    our.Id,
 		Recipient: their.Id,
 		ExchPub:   *pub,
 		Sign:      *signature,
 	}
-	_, err = xdr.Marshal(&buf, &pktEnc)
+	_, err = PktEncMarshal(&buf, &pktEnc)
 	if err != nil {
 		return
 	}
@@ -252,10 +384,11 @@ func PktEncWrite(
 
 	sharedKey := new([32]byte)
 	curve25519.ScalarMult(sharedKey, prv, their.ExchPub)
+	deriveKeyFullCtx, deriveKeySizeCtx, deriveKeyPadCtx := pktEncDeriveKeyCtxs(magic)
 	keyFull := make([]byte, chacha20poly1305.KeySize)
 	keySize := make([]byte, chacha20poly1305.KeySize)
-	blake3.DeriveKey(keyFull, DeriveKeyFullCtx, sharedKey[:])
-	blake3.DeriveKey(keySize, DeriveKeySizeCtx, sharedKey[:])
+	blake3.DeriveKey(keyFull, deriveKeyFullCtx, sharedKey[:])
+	blake3.DeriveKey(keySize, deriveKeySizeCtx, sharedKey[:])
 	aeadFull, err := chacha20poly1305.New(keyFull)
 	if err != nil {
 		return
@@ -293,7 +426,7 @@ func PktEncWrite(
 		break
 	}
 
-	sizePad := sizePadCalc(sizePayload, minSize, wrappers)
+	sizePad := sizePadCalc(sizePayload, minSize, wrappers, expire)
 	_, err = xdr.Marshal(&buf, &PktSize{uint64(sizePayload), uint64(sizePad)})
 	if err != nil {
 		return
@@ -342,7 +475,7 @@ func PktEncWrite(
 	size = sizePayload
 	if sizePadLeft > 0 {
 		keyPad := make([]byte, chacha20poly1305.KeySize)
-		blake3.DeriveKey(keyPad, DeriveKeyPadCtx, sharedKey[:])
+		blake3.DeriveKey(keyPad, deriveKeyPadCtx, sharedKey[:])
 		_, err = io.CopyN(w, blake3.New(32, keyPad).XOF(), sizePadLeft)
 	}
 	return
@@ -354,8 +487,7 @@ func PktEncRead(
 	signatureVerify bool,
 	sharedKeyCached []byte,
 ) (sharedKey []byte, their *Node, size int64, err error) {
-	var pktEnc PktEnc
-	_, err = xdr.Unmarshal(r, &pktEnc)
+	pktEnc, _, err := PktEncUnmarshal(r)
 	if err != nil {
 		return
 	}
@@ -370,7 +502,7 @@ func PktEncRead(
 		err = MagicNNCPEv4.TooOld()
 	case MagicNNCPEv5.B:
 		err = MagicNNCPEv5.TooOld()
-	case MagicNNCPEv6.B:
+	case MagicNNCPEv6.B, MagicNNCPEv7.B:
 	default:
 		err = BadMagic
 	}
@@ -390,7 +522,7 @@ func PktEncRead(
 			return
 		}
 		var verified bool
-		tbsRaw, verified, err = TbsVerify(our, their, &pktEnc)
+		tbsRaw, verified, err = TbsVerify(our, their, pktEnc)
 		if err != nil {
 			return
 		}
@@ -399,7 +531,7 @@ func PktEncRead(
 			return
 		}
 	} else {
-		tbsRaw = TbsPrepare(our, &Node{Id: pktEnc.Sender}, &pktEnc)
+		tbsRaw = TbsPrepare(our, &Node{Id: pktEnc.Sender}, pktEnc)
 	}
 	ad := blake3.Sum256(tbsRaw)
 	if sharedKeyCached == nil {
@@ -410,10 +542,11 @@ func PktEncRead(
 		sharedKey = sharedKeyCached
 	}
 
+	deriveKeyFullCtx, deriveKeySizeCtx, _ := pktEncDeriveKeyCtxs(pktEnc.Magic)
 	keyFull := make([]byte, chacha20poly1305.KeySize)
 	keySize := make([]byte, chacha20poly1305.KeySize)
-	blake3.DeriveKey(keyFull, DeriveKeyFullCtx, sharedKey[:])
-	blake3.DeriveKey(keySize, DeriveKeySizeCtx, sharedKey[:])
+	blake3.DeriveKey(keyFull, deriveKeyFullCtx, sharedKey[:])
+	blake3.DeriveKey(keySize, deriveKeySizeCtx, sharedKey[:])
 	aeadFull, err := chacha20poly1305.New(keyFull)
 	if err != nil {
 		return
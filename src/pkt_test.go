@@ -62,7 +62,7 @@ func TestPktEncWrite(t *testing.T) {
 			nodeOur,
 			nodeTheir.Their(),
 			pkt,
-			nice,
+			nice, 0,
 			int64(minSize),
 			MaxFileSize,
 			int(wrappers),
@@ -72,8 +72,8 @@ func TestPktEncWrite(t *testing.T) {
 		if err != nil {
 			return false
 		}
-		var pktEnc PktEnc
-		if _, err = xdr.Unmarshal(&ct, &pktEnc); err != nil {
+		pktEnc, _, err := PktEncUnmarshal(&ct)
+		if err != nil {
 			return false
 		}
 		if *pktEnc.Sender != *nodeOur.Id {
@@ -101,12 +101,16 @@ func TestPktEncRead(t *testing.T) {
 		dataSize uint32,
 		minSize uint16,
 		wrappers uint8,
+		expire uint32,
 	) bool {
 		dataSize %= 1 << 20
 		data := make([]byte, dataSize)
 		if _, err = io.ReadFull(rand.Reader, data); err != nil {
 			panic(err)
 		}
+		if expire%2 == 0 {
+			expire = 0
+		}
 		var ct bytes.Buffer
 		if len(path) > int(pathSize) {
 			path = path[:int(pathSize)]
@@ -121,7 +125,7 @@ func TestPktEncRead(t *testing.T) {
 			node1,
 			node2.Their(),
 			pkt,
-			nice,
+			nice, uint64(expire),
 			int64(minSize),
 			MaxFileSize,
 			int(wrappers),
@@ -131,6 +135,13 @@ func TestPktEncRead(t *testing.T) {
 		if err != nil {
 			return false
 		}
+		pktEnc, _, err := PktEncUnmarshal(bytes.NewReader(ct.Bytes()))
+		if err != nil || pktEnc.Expire != uint64(expire) {
+			return false
+		}
+		if (expire == 0) != (pktEnc.Magic == MagicNNCPEv6.B) {
+			return false
+		}
 		var pt bytes.Buffer
 		nodes := make(map[NodeId]*Node)
 		nodes[*node1.Id] = node1.Their()
@@ -0,0 +1,135 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// QUIC addresses can not be reached through the proxy.
+var QUICProxied = errors.New("QUIC can not be used through the proxy")
+
+// Connection through HTTP CONNECT proxy, with possibly already read
+// part of the tunneled data.
+type httpProxyConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *httpProxyConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+func httpConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		passwd, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username()+":"+passwd),
+		) + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("HTTP proxy: " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &httpProxyConn{Conn: conn, br: br}, nil
+}
+
+// Connect to TCP addr through the proxy. socks5://[USER:PASS@]HOST:PORT,
+// socks5h:// and http://[USER:PASS@]HOST:PORT (CONNECT method) proxy
+// URLs are supported. Proxy negotiation must finish in DefaultDeadline.
+func ProxyDial(proxyURL, addr string) (ConnDeadlined, error) {
+	return proxyDial(proxyURL, addr)
+}
+
+func proxyDial(proxyURL, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDeadline)
+	defer cancel()
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	case "http":
+		return httpConnect(ctx, u, addr)
+	}
+	return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+}
+
+// Does TCP addr have to be dialed through the proxy? Link-local
+// addresses, like those found with MCD, and loopback ones are always
+// reached directly.
+func proxyNeeded(proxyURL, addr string) bool {
+	if proxyURL == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return true
+	}
+	if i := strings.IndexByte(host, '%'); i != -1 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return true
+	}
+	return !ip.IsLinkLocalUnicast() && !ip.IsLoopback()
+}
@@ -0,0 +1,143 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func proxyTestRead(t *testing.T, conn ConnDeadlined) {
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatal("unexpected data", buf)
+	}
+	conn.Close()
+}
+
+func TestProxyDialHTTP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect ||
+			req.Host != "example.com:5400" ||
+			req.Header.Get("Proxy-Authorization") != auth {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+	}()
+	conn, err := ProxyDial("http://user:pass@"+ln.Addr().String(), "example.com:5400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyTestRead(t, conn)
+}
+
+func TestProxyDialSOCKS5(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		buf := make([]byte, 2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(r, make([]byte, buf[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 2}) // username/password
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(r, user)
+		io.ReadFull(r, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(r, pass)
+		if string(user) != "user" || string(pass) != "pass" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+		head := make([]byte, 5)
+		if _, err = io.ReadFull(r, head); err != nil || head[3] != 3 {
+			return
+		}
+		host := make([]byte, head[4])
+		io.ReadFull(r, host)
+		io.ReadFull(r, buf)
+		if !bytes.Equal(host, []byte("example.com")) {
+			return
+		}
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Write([]byte("hello"))
+	}()
+	conn, err := ProxyDial("socks5://user:pass@"+ln.Addr().String(), "example.com:5400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyTestRead(t, conn)
+}
+
+func TestProxyNeeded(t *testing.T) {
+	for addr, needed := range map[string]bool{
+		"example.com:5400":     true,
+		"192.0.2.1:5400":       true,
+		"[fe80::1%em0]:5400":   false,
+		"127.0.0.1:5400":       false,
+		"[2001:db8::1]:5400":   true,
+		"169.254.100.100:5400": false,
+	} {
+		if proxyNeeded("socks5://proxy:1080", addr) != needed {
+			t.Error(addr)
+		}
+		if proxyNeeded("", addr) {
+			t.Error("empty proxy", addr)
+		}
+	}
+}
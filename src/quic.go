@@ -0,0 +1,298 @@
+//go:build !noquic
+// +build !noquic
+
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Address prefix of QUIC transport: quic://host:port
+const QUICScheme = "quic://"
+
+// QUIC's TLS is used only as a transport: peers are authenticated by
+// the Noise handshake inside the stream, as with any other transport.
+const QUICALPN = "nncp"
+
+// How often the client checks if the local address, used to reach the
+// peer, is changed. Connection is migrated to the new path then.
+var QUICMigrateCheck = 5 * time.Second
+
+func IsQUICAddr(addr string) bool {
+	return strings.HasPrefix(addr, QUICScheme)
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: DefaultDeadline,
+		MaxIdleTimeout:       2 * PingTimeout,
+		KeepAlivePeriod:      PingTimeout / 2,
+	}
+}
+
+// Single bidirectional stream of QUIC connection, carrying SP session.
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+
+	// Client's UDP sockets: initial one and created for each migration.
+	// They are closed only together with the connection. Addresses are
+	// taken from them, because the connection switches its path
+	// asynchronously.
+	raddr     *net.UDPAddr
+	udpConns  []*net.UDPConn
+	udpConnsM sync.Mutex
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	c.udpConnsM.Lock()
+	defer c.udpConnsM.Unlock()
+	if len(c.udpConns) > 0 {
+		return c.udpConns[len(c.udpConns)-1].LocalAddr()
+	}
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.conn.RemoteAddr()
+}
+
+// Close the stream and wait for the peer to close its side too, before
+// closing the whole connection: connection's closing immediately
+// discards the data still being in flight.
+func (c *QUICConn) Close() error {
+	c.Stream.Close()
+	c.Stream.SetReadDeadline(time.Now().Add(DefaultDeadline))
+	io.Copy(io.Discard, c.Stream)
+	err := c.conn.CloseWithError(0, "")
+	c.udpConnsM.Lock()
+	for _, udpConn := range c.udpConns {
+		udpConn.Close()
+	}
+	c.udpConns = nil
+	c.udpConnsM.Unlock()
+	return err
+}
+
+func QUICDial(addr string) (*QUICConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(addr, QUICScheme))
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDeadline)
+	defer cancel()
+	conn, err := (&quic.Transport{Conn: udpConn}).Dial(
+		ctx,
+		raddr,
+		&tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{QUICALPN},
+		},
+		quicConfig(),
+	)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		udpConn.Close()
+		return nil, err
+	}
+	c := QUICConn{
+		Stream:   stream,
+		conn:     conn,
+		raddr:    raddr,
+		udpConns: []*net.UDPConn{udpConn},
+	}
+	go c.migrateOnChange(raddr)
+	return &c, nil
+}
+
+// Migrate the client's connection to the new UDP socket: new path is
+// probed and switched to. Connection and its stream are kept intact.
+func (c *QUICConn) Migrate() error {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	path, err := c.conn.AddPath(&quic.Transport{Conn: udpConn})
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(c.conn.Context(), DefaultDeadline)
+	defer cancel()
+	if err = path.Probe(ctx); err == nil {
+		err = path.Switch()
+	}
+	c.udpConnsM.Lock()
+	defer c.udpConnsM.Unlock()
+	if err != nil || c.udpConns == nil {
+		path.Close()
+		udpConn.Close()
+		if err == nil {
+			err = net.ErrClosed
+		}
+		return err
+	}
+	c.udpConns = append(c.udpConns, udpConn)
+	return nil
+}
+
+// Local address the system chooses to reach the peer. Nothing is sent.
+func quicRouteAddr(raddr *net.UDPAddr) string {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// Migrate the connection when local address is changed, for example
+// after the switching to another network interface.
+func (c *QUICConn) migrateOnChange(raddr *net.UDPAddr) {
+	ourAddr := quicRouteAddr(raddr)
+	ticker := time.NewTicker(QUICMigrateCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		addr := quicRouteAddr(raddr)
+		if addr == "" || addr == ourAddr {
+			continue
+		}
+		if c.Migrate() == nil {
+			ourAddr = addr
+		}
+	}
+}
+
+// Ephemeral self-signed certificate, required by QUIC's TLS.
+func quicCert() (tls.Certificate, error) {
+	pub, prv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(100 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, pub, prv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: prv}, nil
+}
+
+// QUIC listener, satisfying net.Listener. Each accepted connection's
+// first stream is returned.
+type QUICListener struct {
+	ln    *quic.Listener
+	conns chan *QUICConn
+	errs  chan error
+}
+
+func QUICListen(addr string) (*QUICListener, error) {
+	cert, err := quicCert()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := quic.ListenAddr(
+		strings.TrimPrefix(addr, QUICScheme),
+		&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{QUICALPN},
+		},
+		quicConfig(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	l := QUICListener{
+		ln:    ln,
+		conns: make(chan *QUICConn),
+		errs:  make(chan error, 1),
+	}
+	go l.accept()
+	return &l, nil
+}
+
+func (l *QUICListener) accept() {
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		go func(conn *quic.Conn) {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultDeadline)
+			defer cancel()
+			stream, err := conn.AcceptStream(ctx)
+			if err != nil {
+				conn.CloseWithError(0, "")
+				return
+			}
+			l.conns <- &QUICConn{Stream: stream, conn: conn}
+		}(conn)
+	}
+}
+
+func (l *QUICListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	}
+}
+
+func (l *QUICListener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
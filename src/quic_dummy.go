@@ -0,0 +1,44 @@
+//go:build noquic
+// +build noquic
+
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Address prefix of QUIC transport: quic://host:port
+const QUICScheme = "quic://"
+
+var NoQUIC = errors.New("no QUIC support is compiled in")
+
+func IsQUICAddr(addr string) bool {
+	return strings.HasPrefix(addr, QUICScheme)
+}
+
+func QUICDial(addr string) (ConnDeadlined, error) {
+	return nil, NoQUIC
+}
+
+func QUICListen(addr string) (net.Listener, error) {
+	return nil, NoQUIC
+}
@@ -0,0 +1,162 @@
+//go:build !noquic
+// +build !noquic
+
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestQUIC(t *testing.T) {
+	ln, err := QUICListen(QUICScheme + "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn io.ReadWriteCloser) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	addr := QUICScheme + ln.Addr().String()
+	if !IsQUICAddr(addr) {
+		t.FailNow()
+	}
+	f := func(size uint16) bool {
+		data := make([]byte, int(size)+1)
+		rand.Read(data)
+		conn, err := QUICDial(addr)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		defer conn.Close()
+		go conn.Write(data)
+		got := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Error(err)
+			return false
+		}
+		if !bytes.Equal(got, data) {
+			return false
+		}
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err = conn.Read(got); err == nil {
+			t.Error("read deadline is not respected")
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQUICMigration(t *testing.T) {
+	ln, err := QUICListen(QUICScheme + "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srvConns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		srvConns <- conn
+	}()
+	conn, err := QUICDial(QUICScheme + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+	if _, err = conn.Write(data[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+	var srv net.Conn
+	select {
+	case srv = <-srvConns:
+	case <-time.After(DefaultDeadline):
+		t.Fatal("no connection accepted")
+	}
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(srv, got[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebind client's socket in the middle of the session
+	portOld := conn.LocalAddr().(*net.UDPAddr).Port
+	if err = conn.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	portNew := conn.LocalAddr().(*net.UDPAddr).Port
+	if portNew == portOld {
+		t.Fatal("local address is not changed")
+	}
+
+	// Both directions must work over the new path
+	if _, err = conn.Write(data[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(srv, got[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = srv.Write(data[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, got[:1<<10]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; srv.RemoteAddr().(*net.UDPAddr).Port != portNew; i++ {
+		if i == 100 {
+			t.Fatal("server has not switched to the new path")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Data written right before closing must not be lost
+	go func() {
+		conn.Write(data[1<<10:])
+		conn.Close()
+	}()
+	copy(got, data[:1<<10])
+	if _, err = io.ReadFull(srv, got[1<<10:]); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("data differs")
+	}
+}
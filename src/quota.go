@@ -0,0 +1,87 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var QuotaExceeded = errors.New("quota exceeded")
+
+// Limits of the node's rx/tx spool directories usage. Zero means no
+// limit.
+type Quota struct {
+	RxSize int64
+	RxPkts int64
+	TxSize int64
+	TxPkts int64
+}
+
+// Number and total size of the node's packets (including partly
+// received and non-checksummed) in rx/tx spool directory.
+func (ctx *Ctx) SpoolUsage(nodeId *NodeId, xx TRxTx) (pkts, size int64, err error) {
+	fis, err := ioutil.ReadDir(filepath.Join(ctx.Spool, nodeId.String(), string(xx)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(fi.Name(), PartSuffix)
+		name = strings.TrimSuffix(name, NoCKSuffix)
+		if len(name) != Base32Encoded32Len {
+			continue
+		}
+		pkts++
+		size += fi.Size()
+	}
+	return
+}
+
+// Check if another packet of the given size fits in node's rx/tx quota.
+func (ctx *Ctx) QuotaCheck(node *Node, xx TRxTx, size int64) error {
+	var maxPkts, maxSize int64
+	switch xx {
+	case TRx:
+		maxPkts, maxSize = node.Quota.RxPkts, node.Quota.RxSize
+	case TTx:
+		maxPkts, maxSize = node.Quota.TxPkts, node.Quota.TxSize
+	}
+	if maxPkts == 0 && maxSize == 0 {
+		return nil
+	}
+	pkts, used, err := ctx.SpoolUsage(node.Id, xx)
+	if err != nil {
+		return err
+	}
+	if maxPkts > 0 && pkts+1 > maxPkts {
+		return QuotaExceeded
+	}
+	if maxSize > 0 && used+size > maxSize {
+		return QuotaExceeded
+	}
+	return nil
+}
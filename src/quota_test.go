@@ -0,0 +1,75 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+)
+
+func TestQuotaTxTrns(t *testing.T) {
+	f := func(datum [][]byte, maxPkts uint8) bool {
+		maxPkts = maxPkts%4 + 1
+		spool, err := ioutil.TempDir("", "testquota")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		node := nodeOur.Their()
+		node.Quota.TxPkts = int64(maxPkts)
+		ctx.Neigh[*nodeOur.Id] = node
+		var sent int
+		for i, data := range datum {
+			data = append(data, byte(i))
+			err = ctx.TxTrns(node, 123, int64(len(data)), bytes.NewReader(data))
+			if err == nil {
+				sent++
+				continue
+			}
+			if err != QuotaExceeded {
+				return false
+			}
+		}
+		if len(datum) < int(maxPkts) {
+			return sent == len(datum)
+		}
+		pkts, _, err := ctx.SpoolUsage(node.Id, TTx)
+		return err == nil && sent == int(maxPkts) && pkts == int64(maxPkts)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
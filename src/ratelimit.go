@@ -0,0 +1,140 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+)
+
+// Token bucket limiting the rate of bytes per second. Its capacity
+// (burst) is one second of traffic, but not less than the biggest SP
+// packet. Nil limiter, as like as zero rate one, does not limit
+// anything. It is safe to share it between many goroutines.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	l := &RateLimiter{last: time.Now()}
+	l.SetRate(bytesPerSec)
+	l.tokens = l.burst
+	return l
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Change the rate on the fly. Zero rate disables limiting.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.refill(time.Now())
+	if bytesPerSec <= 0 {
+		l.rate, l.burst, l.tokens = 0, 0, 0
+		return
+	}
+	l.rate = float64(bytesPerSec)
+	l.burst = l.rate
+	if l.burst < MaxSPSize {
+		l.burst = MaxSPSize
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	return int64(l.rate)
+}
+
+// Take n bytes from the bucket, sleeping until they are available.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	if l.rate == 0 {
+		l.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Rate limits override, active when Cron expression matches current
+// minute. Nil limit means no override.
+type RateSchedule struct {
+	Cron    *cronexpr.Expression
+	RxLimit *int64
+	TxLimit *int64
+}
+
+func (rs *RateSchedule) Active(now time.Time) bool {
+	minute := now.Truncate(time.Minute)
+	return rs.Cron.Next(minute.Add(-time.Second)).Equal(minute)
+}
+
+// Determine the limits at the given moment: the first active schedule
+// entry overrides the default ones.
+func RateScheduled(
+	schedules []*RateSchedule,
+	now time.Time,
+	rxLimit, txLimit int64,
+) (int64, int64) {
+	for _, rs := range schedules {
+		if !rs.Active(now) {
+			continue
+		}
+		if rs.RxLimit != nil {
+			rxLimit = *rs.RxLimit
+		}
+		if rs.TxLimit != nil {
+			txLimit = *rs.TxLimit
+		}
+		break
+	}
+	return rxLimit, txLimit
+}
@@ -0,0 +1,93 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/gorhill/cronexpr"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *RateLimiter
+	nilLimiter.Wait(1 << 30)
+	if NewRateLimiter(0) != nil {
+		t.FailNow()
+	}
+	f := func(chunks uint8) bool {
+		chunks = chunks%4 + 1
+		rate := int64(1 << 20)
+		l := NewRateLimiter(rate)
+		started := time.Now()
+		l.Wait(int(rate))
+		// Throttled burst takes a whole second, leave a room for
+		// scheduling delays of loaded machine
+		if time.Since(started) > time.Second/2 {
+			t.Error("burst is throttled")
+			return false
+		}
+		chunk := int(rate / 20)
+		for i := 0; i < int(chunks); i++ {
+			l.Wait(chunk)
+		}
+		expected := time.Duration(chunks) * time.Second / 20
+		if elapsed := time.Since(started); elapsed < expected*9/10 {
+			t.Error("too fast:", elapsed, "expected", expected)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 4}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRateScheduled(t *testing.T) {
+	day := int64(1 << 20)
+	night := int64(0)
+	schedules := []*RateSchedule{
+		{Cron: cronexpr.MustParse("* 8-19 * * *"), TxLimit: &day},
+		{Cron: cronexpr.MustParse("* * * * *"), RxLimit: &night},
+	}
+	f := func(hour, minute, second uint8) bool {
+		now := time.Date(
+			2022, 1, 2,
+			int(hour%24), int(minute%60), int(second%60), 123,
+			time.Local,
+		)
+		rxLimit, txLimit := RateScheduled(schedules, now, 123, 456)
+		if now.Hour() >= 8 && now.Hour() < 20 {
+			return rxLimit == 123 && txLimit == day
+		}
+		return rxLimit == night && txLimit == 456
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+
+	l := NewRateLimiter(day)
+	l.SetRate(0)
+	started := time.Now()
+	l.Wait(int(10 * day))
+	// Limited one would take ten seconds
+	if time.Since(started) > time.Second/2 || l.Rate() != 0 {
+		t.Error("zero rate limits")
+	}
+}
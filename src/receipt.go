@@ -0,0 +1,287 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.cypherpunks.ru/recfile"
+	"golang.org/x/crypto/blake2b"
+)
+
+const ReceiptDir = "receipt"
+
+// End-to-end delivery state of the packet sent to the node with
+// enabled receipts. It is identified by the hash of the final
+// recipient's encrypted packet header.
+type Receipt struct {
+	Node      *NodeId
+	Msg       string
+	Pkt       string
+	Type      string
+	Path      string
+	Nice      uint8
+	Size      int64
+	Sent      time.Time
+	Delivered *time.Time
+}
+
+func receiptable(typ PktType) bool {
+	switch typ {
+	case PktTypeFile, PktTypeFreq, PktTypeExec, PktTypeExecFat:
+		return true
+	}
+	return false
+}
+
+func pktTypeName(typ PktType) string {
+	switch typ {
+	case PktTypeFile:
+		return "file"
+	case PktTypeFreq:
+		return "freq"
+	case PktTypeExec, PktTypeExecFat:
+		return "exec"
+	case PktTypeTrns:
+		return "trns"
+	case PktTypeArea:
+		return "area"
+	case PktTypeACK:
+		return "ack"
+	case PktTypeReceipt:
+		return "receipt"
+	}
+	return "unknown"
+}
+
+func pktEncMsgHash(pktEncRaw []byte) string {
+	hsh := blake2b.Sum256(pktEncRaw)
+	return Base32Codec.EncodeToString(hsh[:])
+}
+
+func (ctx *Ctx) receiptPath(nodeId *NodeId, msg string) string {
+	return filepath.Join(ctx.Spool, nodeId.String(), ReceiptDir, msg)
+}
+
+func (r *Receipt) fields() []recfile.Field {
+	fields := []recfile.Field{
+		{Name: "Msg", Value: r.Msg},
+		{Name: "Pkt", Value: r.Pkt},
+		{Name: "Type", Value: r.Type},
+		{Name: "Path", Value: r.Path},
+		{Name: "Nice", Value: strconv.Itoa(int(r.Nice))},
+		{Name: "Size", Value: strconv.FormatInt(r.Size, 10)},
+		recTime("Sent", r.Sent),
+	}
+	if r.Delivered != nil {
+		fields = append(fields, recTime("Delivered", *r.Delivered))
+	}
+	return fields
+}
+
+func (ctx *Ctx) receiptWrite(r *Receipt) error {
+	return recWrite(
+		filepath.Join(ctx.Spool, r.Node.String(), ReceiptDir), r.Msg, r.fields(),
+	)
+}
+
+func (ctx *Ctx) receiptRead(nodeId *NodeId, msg string) (*Receipt, error) {
+	m, err := recRead(ctx.receiptPath(nodeId, msg))
+	if err != nil {
+		return nil, err
+	}
+	r := Receipt{
+		Node: nodeId,
+		Msg:  m["Msg"],
+		Pkt:  m["Pkt"],
+		Type: m["Type"],
+		Path: m["Path"],
+	}
+	if r.Msg != msg {
+		return nil, errors.New("receipt message mismatch")
+	}
+	nice, err := strconv.ParseUint(m["Nice"], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	r.Nice = uint8(nice)
+	if r.Size, err = strconv.ParseInt(m["Size"], 10, 64); err != nil {
+		return nil, err
+	}
+	if r.Sent, err = recTimeParse(m, "Sent"); err != nil {
+		return nil, err
+	}
+	if r.Delivered, err = recTimeParseOpt(m, "Delivered"); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Delivery states of packets sent to the node, sorted by sending time.
+func (ctx *Ctx) Receipts(nodeId *NodeId) ([]*Receipt, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(ctx.Spool, nodeId.String(), ReceiptDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rs := make([]*Receipt, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() || len(fi.Name()) != Base32Codec.EncodedLen(blake2b.Size256) {
+			continue
+		}
+		r, err := ctx.receiptRead(nodeId, fi.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fi.Name(), err)
+		}
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Sent.Before(rs[j].Sent) })
+	return rs, nil
+}
+
+// Remember that the delivery receipt is expected for the just created
+// packet, whose final recipient's encrypted header is pktEncRaw.
+func (ctx *Ctx) receiptExpect(
+	node *Node,
+	pkt *Pkt,
+	nice uint8,
+	pktEncRaw []byte,
+	res *TxResult,
+) {
+	path := pkt.Path[:int(pkt.PathLen)]
+	if pkt.Type == PktTypeExec || pkt.Type == PktTypeExecFat {
+		path = bytes.Replace(path, []byte{0}, []byte(" "), -1)
+	}
+	r := Receipt{
+		Node: node.Id,
+		Msg:  pktEncMsgHash(pktEncRaw),
+		Pkt:  res.Pkt,
+		Type: pktTypeName(pkt.Type),
+		Path: string(path),
+		Nice: nice,
+		Size: res.Size,
+		Sent: time.Now(),
+	}
+	les := LEs{
+		{"Node", node.Id},
+		{"Pkt", r.Pkt},
+		{"Receipt", r.Msg},
+	}
+	if err := ctx.receiptWrite(&r); err != nil {
+		ctx.LogE("tx-receipt", les, err, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tx packet %s to %s: saving receipt expectation",
+				r.Pkt, node.Name,
+			)
+		})
+	}
+}
+
+// Send delivery receipt back to the sender of the successfully tossed
+// packet with pktEnc header.
+func (ctx *Ctx) txReceipt(
+	cctx context.Context,
+	node *Node,
+	pktEnc *PktEnc,
+	nice uint8,
+) error {
+	var buf bytes.Buffer
+	if _, err := PktEncMarshal(&buf, pktEnc); err != nil {
+		return err
+	}
+	msg := pktEncMsgHash(buf.Bytes())
+	msgRaw, err := Base32Codec.DecodeString(msg)
+	if err != nil {
+		return err
+	}
+	pkt, err := NewPkt(PktTypeReceipt, nice, msgRaw)
+	if err != nil {
+		return err
+	}
+	res, err := ctx.TxContext(
+		cctx, node, pkt, nice, 0, 0, MaxFileSize,
+		bytes.NewReader(nil), msg, nil,
+	)
+	les := LEs{
+		{"Type", "receipt"},
+		{"Node", node.Id},
+		{"Nice", int(nice)},
+		{"Receipt", msg},
+	}
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf("Receipt to %s of %s is sent", node.Name, msg)
+	}
+	if err != nil {
+		ctx.LogE("tx", les, err, logMsg)
+		return err
+	}
+	ctx.LogI("tx", append(les, LE{"NewPkt", res.Pkt}), logMsg)
+	return nil
+}
+
+// Default PktTypeReceipt handler: marks the packet as delivered.
+func tossReceipt(ctx *Ctx, _ context.Context, job *TossJob) error {
+	pkt, sender := job.Pkt, job.Sender
+	msg := Base32Codec.EncodeToString(pkt.Path[:int(pkt.PathLen)])
+	les := append(job.LEs, LE{"Type", "receipt"}, LE{"Receipt", msg})
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf("Tossing receipt %s/%s: %s", sender.Name, job.PktName, msg)
+	}
+	ctx.LogD("rx-receipt", les, logMsg)
+	r, err := ctx.receiptRead(sender.Id, msg)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.LogE("rx-receipt", les, err, logMsg)
+			return err
+		}
+		ctx.LogD("rx-receipt-unknown", les, func(les LEs) string {
+			return logMsg(les) + ": unknown"
+		})
+	} else if !job.DryRun && r.Delivered == nil {
+		now := time.Now()
+		r.Delivered = &now
+		if err = ctx.receiptWrite(r); err != nil {
+			ctx.LogE("rx-receipt", les, err, logMsg)
+			return err
+		}
+	}
+	if err = ctx.TossJobRemove(job); err != nil {
+		return err
+	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		if r == nil {
+			return fmt.Sprintf("Got unknown receipt from %s of %s", sender.Name, msg)
+		}
+		return fmt.Sprintf(
+			"Got receipt from %s: %s %s (%s) is delivered",
+			sender.Name, r.Type, r.Path, r.Pkt,
+		)
+	})
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"go.cypherpunks.ru/recfile"
+)
+
+// Atomically write the single record state file in dir.
+func recWrite(dir, name string, fields []recfile.Field) error {
+	var b bytes.Buffer
+	w := recfile.NewWriter(&b)
+	if _, err := w.RecordStart(); err != nil {
+		return err
+	}
+	if _, err := w.WriteFields(fields...); err != nil {
+		return err
+	}
+	return fileWriteAtomic(dir, name, b.Bytes())
+}
+
+// Read the single record state file.
+func recRead(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return recfile.NewReader(bytes.NewReader(data)).NextMap()
+}
+
+func recTime(name string, t time.Time) recfile.Field {
+	return recfile.Field{Name: name, Value: t.UTC().Format(time.RFC3339Nano)}
+}
+
+func recTimeParse(m map[string]string, name string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, m[name])
+}
+
+// Parse optional time field, nil if it is missing.
+func recTimeParseOpt(m map[string]string, name string) (*time.Time, error) {
+	if _, exists := m[name]; !exists {
+		return nil, nil
+	}
+	t, err := recTimeParse(m, name)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,191 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	SentDir = "sent"
+
+	DefaultResendMax = 3
+)
+
+var ResendLimit = errors.New("resend limit is reached")
+
+// Get rid of the outbound packet transmitted to the node with nncp-xfer
+// or nncp-bundle. If node has resending enabled, then packet is moved
+// to sent/ directory, where it waits for the acknowledgement.
+func (ctx *Ctx) TxSentRemove(node *Node, pktPath string) error {
+	if node.Resend == 0 {
+		if err := os.Remove(pktPath); err != nil {
+			return err
+		}
+		if ctx.HdrUsage {
+			os.Remove(JobPath2Hdr(pktPath))
+		}
+		return nil
+	}
+	dir := filepath.Join(ctx.Spool, node.Id.String(), SentDir)
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+	sentPath := filepath.Join(dir, filepath.Base(pktPath))
+	if err := os.Rename(pktPath, sentPath); err != nil {
+		return err
+	}
+	// Modification time is the moment of the transmission
+	now := time.Now()
+	if err := os.Chtimes(sentPath, now, now); err != nil {
+		return err
+	}
+	if ctx.HdrUsage {
+		os.Remove(JobPath2Hdr(pktPath))
+	}
+	return DirSync(dir)
+}
+
+// Is there any packet in sent/ not acknowledged in time?
+func (ctx *Ctx) resendDue(node *Node) bool {
+	fis, err := ioutil.ReadDir(filepath.Join(ctx.Spool, node.Id.String(), SentDir))
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	for _, fi := range fis {
+		if len(fi.Name()) == Base32Encoded32Len && now.Sub(fi.ModTime()) >= node.Resend {
+			return true
+		}
+	}
+	return false
+}
+
+// Same as Resend, but it takes node's outbound directory lock itself.
+// Nothing is done if the lock is already held, for example by the
+// running online session: resending is left for the next invocation.
+func (ctx *Ctx) ResendLocked(nodeId *NodeId) {
+	node := ctx.Neigh[*nodeId]
+	if node == nil || node.Resend == 0 || !ctx.resendDue(node) {
+		return
+	}
+	dirLock, err := ctx.LockDir(nodeId, string(TTx))
+	if err != nil {
+		return
+	}
+	defer ctx.UnlockDir(dirLock)
+	ctx.Resend(nodeId)
+}
+
+// Move not acknowledged in time packets from sent/ back to tx/ of the
+// node. Packets resent more than node's ResendMax times are removed.
+// Caller must hold node's outbound directory lock.
+func (ctx *Ctx) Resend(nodeId *NodeId) {
+	node := ctx.Neigh[*nodeId]
+	if node == nil || node.Resend == 0 {
+		return
+	}
+	sentDir := filepath.Join(ctx.Spool, nodeId.String(), SentDir)
+	fis, err := ioutil.ReadDir(sentDir)
+	if err != nil {
+		return
+	}
+	txDir := filepath.Join(ctx.Spool, nodeId.String(), string(TTx))
+	now := time.Now()
+	var requeued bool
+	for _, fi := range fis {
+		pktName := fi.Name()
+		if len(pktName) != Base32Encoded32Len {
+			continue
+		}
+		if now.Sub(fi.ModTime()) < node.Resend {
+			continue
+		}
+		les := LEs{{"Node", nodeId}, {"Pkt", pktName}}
+		var resends int
+		if t, err := ctx.trackRead(ctx.trackResolve(nodeId, pktName)); err == nil {
+			resends = t.Resends
+		}
+		if resends >= node.ResendMax {
+			err = ResendLimit
+			ctx.LogE("tx-resend", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Resending %s/%s: giving up after %d attempts",
+					node.Name, pktName, resends,
+				)
+			})
+			if err = os.Remove(filepath.Join(sentDir, pktName)); err != nil {
+				ctx.LogE("tx-resend-remove", les, err, func(les LEs) string {
+					return fmt.Sprintf("Resending %s/%s: removing", node.Name, pktName)
+				})
+			}
+			continue
+		}
+		if err = ensureDir(txDir); err != nil {
+			ctx.LogE("tx-resend", les, err, func(les LEs) string {
+				return fmt.Sprintf("Resending %s/%s: mkdir", node.Name, pktName)
+			})
+			return
+		}
+		if err = os.Rename(
+			filepath.Join(sentDir, pktName),
+			filepath.Join(txDir, pktName),
+		); err != nil {
+			ctx.LogE("tx-resend", les, err, func(les LEs) string {
+				return fmt.Sprintf("Resending %s/%s: renaming", node.Name, pktName)
+			})
+			continue
+		}
+		requeued = true
+		// Tracking state is lost or never existed: start counting
+		// attempts from scratch
+		created := fi.ModTime()
+		ctx.trackUpdate(nodeId, pktName, func() *Track {
+			return &Track{
+				Node:    nodeId,
+				Pkt:     pktName,
+				Hop:     nodeId,
+				HopPkt:  pktName,
+				Type:    "unknown",
+				Created: created,
+			}
+		}, func(t *Track) {
+			t.Transmitted = nil
+			t.Resends++
+		})
+		ctx.LogI("tx-resend", append(les, LE{"Resends", resends + 1}), func(les LEs) string {
+			return fmt.Sprintf(
+				"Resending %s/%s: not acknowledged for %s, attempt %d",
+				node.Name, pktName, now.Sub(fi.ModTime()).Truncate(time.Second), resends+1,
+			)
+		})
+	}
+	if !requeued {
+		return
+	}
+	if err = DirSync(txDir); err != nil {
+		ctx.LogE("tx-resend-dirsync", LEs{{"Node", nodeId}}, err, func(les LEs) string {
+			return fmt.Sprintf("Resending %s: dirsyncing", node.Name)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestResend(t *testing.T) {
+	f := func(nice uint8, resendMax uint8, untracked bool) bool {
+		resendMax = resendMax%4 + 1
+		spool, err := ioutil.TempDir("", "testresend")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeTgt, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		node := nodeTgt.Their()
+		node.Resend = time.Hour
+		node.ResendMax = int(resendMax)
+		ctx.Neigh[*nodeTgt.Id] = node
+		if err := ctx.TxExec(
+			node, nice, nice, "sink", nil,
+			strings.NewReader("BODY\n"), 1<<15, MaxFileSize, false, nil,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		txPath := filepath.Join(spool, nodeTgt.Id.String(), string(TTx))
+		sentPath := filepath.Join(spool, nodeTgt.Id.String(), SentDir)
+		if untracked {
+			// Missing tracking state must not prevent resending
+			tracks, err := ctx.Tracks(nodeTgt.Id)
+			if err != nil || len(tracks) != 1 {
+				t.Error(err)
+				return false
+			}
+			if err = ctx.TrackRemove(tracks[0]); err != nil {
+				t.Error(err)
+				return false
+			}
+		}
+		for i := 0; i <= int(resendMax); i++ {
+			ctx.Resend(nodeTgt.Id)
+			jobs := 0
+			for job := range ctx.Jobs(nodeTgt.Id, TTx) {
+				if err = ctx.TxSentRemove(node, job.Path); err != nil {
+					t.Error(err)
+					return false
+				}
+				jobs++
+			}
+			if jobs != 1 || len(dirFiles(txPath)) != 0 {
+				return false
+			}
+			for range ctx.Jobs(nodeTgt.Id, TTx) {
+				return false
+			}
+			pktName := dirFiles(sentPath)[0]
+			past := time.Now().Add(-2 * time.Hour)
+			os.Chtimes(filepath.Join(sentPath, pktName), past, past)
+		}
+		ctx.Resend(nodeTgt.Id)
+		for range ctx.Jobs(nodeTgt.Id, TTx) {
+			return false
+		}
+		if len(dirFiles(sentPath)) != 0 {
+			return false
+		}
+		tracks, err := ctx.Tracks(nodeTgt.Id)
+		return err == nil && len(tracks) == 1 && tracks[0].Resends == int(resendMax)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
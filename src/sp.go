@@ -29,6 +29,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	xdr "github.com/davecgh/go-xdr/xdr2"
@@ -90,6 +91,7 @@ const (
 	SPTypeDone SPType = iota
 	SPTypeHalt SPType = iota
 	SPTypePing SPType = iota
+	SPTypePart SPType = iota
 )
 
 type SPHead struct {
@@ -117,6 +119,12 @@ type SPDone struct {
 	Hash *[MTHSize]byte
 }
 
+type SPPart struct {
+	Group [16]byte
+	Idx   uint32
+	Num   uint32
+}
+
 type SPRaw struct {
 	Magic   [8]byte
 	Payload []byte
@@ -213,6 +221,7 @@ type SPState struct {
 	Node           *Node
 	Nice           uint8
 	NoCK           bool
+	Addr           string
 	onlineDeadline time.Duration
 	maxOnlineTime  time.Duration
 	hs             *noise.HandshakeState
@@ -240,14 +249,24 @@ type SPState struct {
 	xxOnly         TRxTx
 	rxRate         int
 	txRate         int
+	rxLimit        int64
+	txLimit        int64
+	rxLimiter      *RateLimiter
+	txLimiter      *RateLimiter
 	isDead         chan struct{}
 	listOnly       bool
 	onlyPkts       map[[MTHSize]byte]bool
+	partIdx        int
+	partNum        int
+	partGroup      [16]byte
 	writeSPBuf     bytes.Buffer
 	fds            map[string]FdAndFullSize
 	fdsLock        sync.RWMutex
 	fileHashers    map[string]*MTHAndOffset
 	progressBars   map[string]struct{}
+	conn           ConnDeadlined
+	rxPkt          string
+	txPkt          string
 	sync.RWMutex
 }
 
@@ -271,6 +290,12 @@ func (state *SPState) SetDead() {
 	}()
 }
 
+// Forcefully terminate the session.
+func (state *SPState) Kill() {
+	state.SetDead()
+	state.conn.Close()
+}
+
 func (state *SPState) NotAlive() bool {
 	select {
 	case <-state.isDead:
@@ -281,8 +306,40 @@ func (state *SPState) NotAlive() bool {
 }
 
 func (state *SPState) dirUnlock() {
-	state.Ctx.UnlockDir(state.rxLock)
-	state.Ctx.UnlockDir(state.txLock)
+	state.Ctx.UnlockDirShared(state.rxLock)
+	state.Ctx.UnlockDirShared(state.txLock)
+	state.rxLock, state.txLock = nil, nil
+	state.rxClaimsRelease()
+}
+
+func (state *SPState) limitsUpdate(now time.Time) {
+	if len(state.Node.RateSchedule) == 0 {
+		return
+	}
+	rxLimit, txLimit := RateScheduled(
+		state.Node.RateSchedule, now, state.rxLimit, state.txLimit,
+	)
+	if rxLimit == state.rxLimiter.Rate() && txLimit == state.txLimiter.Rate() {
+		return
+	}
+	state.rxLimiter.SetRate(rxLimit)
+	state.txLimiter.SetRate(txLimit)
+	state.Ctx.LogI("sp-limits", LEs{
+		{"Node", state.Node.Id},
+		{"RxLimit", rxLimit},
+		{"TxLimit", txLimit},
+	}, func(les LEs) string {
+		limitFmt := func(limit int64) string {
+			if limit == 0 {
+				return "unlimited"
+			}
+			return humanize.IBytes(uint64(limit)) + "/sec"
+		}
+		return fmt.Sprintf(
+			"SP with %s: rate limits changed: rx %s, tx %s",
+			state.Node.Name, limitFmt(rxLimit), limitFmt(txLimit),
+		)
+	})
 }
 
 func (state *SPState) WriteSP(dst io.Writer, payload []byte, ping bool) error {
@@ -296,10 +353,12 @@ func (state *SPState) WriteSP(dst io.Writer, payload []byte, ping bool) error {
 	}
 	if n, err = dst.Write(state.writeSPBuf.Bytes()); err == nil {
 		state.TxLastSeen = time.Now()
-		state.TxBytes += int64(n)
+		atomic.AddInt64(&state.TxBytes, int64(n))
 		if !ping {
 			state.TxLastNonPing = state.TxLastSeen
 		}
+		state.txLimiter.Wait(n)
+		state.Ctx.TxLimiter.Wait(n)
 	}
 	return err
 }
@@ -315,23 +374,47 @@ func (state *SPState) ReadSP(src io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	state.RxLastSeen = time.Now()
-	state.RxBytes += int64(n)
+	atomic.AddInt64(&state.RxBytes, int64(n))
+	state.rxLimiter.Wait(n)
+	state.Ctx.RxLimiter.Wait(n)
 	if sp.Magic != MagicNNCPSv1.B {
 		return nil, BadMagic
 	}
 	return sp.Payload, nil
 }
 
-func (ctx *Ctx) infosOur(nodeId *NodeId, nice uint8, seen *map[[MTHSize]byte]uint8) [][]byte {
+func (ctx *Ctx) infosOur(
+	nodeId *NodeId,
+	nice uint8,
+	seen *map[[MTHSize]byte]uint8,
+	inPart func(*[MTHSize]byte) bool,
+) [][]byte {
 	var infos []*SPInfo
 	var totalSize int64
 	for job := range ctx.Jobs(nodeId, TTx) {
 		if job.PktEnc.Nice > nice {
 			continue
 		}
+		if !inPart(job.HshValue) {
+			continue
+		}
 		if _, known := (*seen)[*job.HshValue]; known {
 			continue
 		}
+		if job.PktEnc.Expired(time.Now()) {
+			ctx.LogD("sp-info-our-expired", LEs{
+				{"Node", nodeId},
+				{"Name", Base32Codec.EncodeToString(job.HshValue[:])},
+				{"Expire", job.PktEnc.Expire},
+			}, func(les LEs) string {
+				return fmt.Sprintf(
+					"Skipping expired packet %s/tx/%s",
+					ctx.NodeName(nodeId),
+					Base32Codec.EncodeToString(job.HshValue[:]),
+				)
+			})
+			continue
+		}
 		totalSize += job.Size
 		infos = append(infos, &SPInfo{
 			Nice: job.PktEnc.Nice,
@@ -384,15 +467,16 @@ func (state *SPState) StartI(conn ConnDeadlined) error {
 	}
 	var rxLock *os.File
 	if !state.listOnly && (state.xxOnly == "" || state.xxOnly == TRx) {
-		rxLock, err = state.Ctx.LockDir(nodeId, string(TRx))
+		rxLock, err = state.dirLock(nodeId, string(TRx))
 		if err != nil {
 			return err
 		}
 	}
 	var txLock *os.File
 	if !state.listOnly && (state.xxOnly == "" || state.xxOnly == TTx) {
-		txLock, err = state.Ctx.LockDir(nodeId, string(TTx))
+		txLock, err = state.dirLock(nodeId, string(TTx))
 		if err != nil {
+			state.Ctx.UnlockDirShared(rxLock)
 			return err
 		}
 	}
@@ -423,7 +507,17 @@ func (state *SPState) StartI(conn ConnDeadlined) error {
 
 	var infosPayloads [][]byte
 	if !state.listOnly && (state.xxOnly == "" || state.xxOnly == TTx) {
-		infosPayloads = state.Ctx.infosOur(nodeId, state.Nice, &state.infosOurSeen)
+		infosPayloads = state.Ctx.infosOur(
+			nodeId, state.Nice, &state.infosOurSeen, state.inPart,
+		)
+	}
+	if state.partNum > 1 {
+		part := state.partMarshal()
+		if len(infosPayloads) > 0 && len(part)+len(infosPayloads[0]) <= MaxSPSize {
+			infosPayloads[0] = append(part, infosPayloads[0]...)
+		} else {
+			infosPayloads = append([][]byte{part}, infosPayloads...)
+		}
 	}
 	var firstPayload []byte
 	if len(infosPayloads) > 0 {
@@ -577,33 +671,48 @@ func (state *SPState) StartR(conn ConnDeadlined) error {
 	state.Node = node
 	state.rxRate = node.RxRate
 	state.txRate = node.TxRate
+	state.rxLimit = node.RxLimit
+	state.txLimit = node.TxLimit
 	state.onlineDeadline = node.OnlineDeadline
 	state.maxOnlineTime = node.MaxOnlineTime
 	les = LEs{{"Node", node.Id}, {"Nice", int(state.Nice)}}
 
+	if err = state.partUnmarshal(payload); err != nil {
+		state.Ctx.LogE("sp-startR-part", les, err, func(les LEs) string {
+			return fmt.Sprintf("SP with %s: parallel call part", node.Name)
+		})
+		return err
+	}
+	if state.partNum > 1 {
+		les = append(les, LE{"Conn", state.partIdx})
+	}
+
 	if err = state.Ctx.ensureRxDir(node.Id); err != nil {
 		return err
 	}
 	var rxLock *os.File
 	if xxOnly == "" || xxOnly == TRx {
-		rxLock, err = state.Ctx.LockDir(node.Id, string(TRx))
+		rxLock, err = state.dirLock(node.Id, string(TRx))
 		if err != nil {
 			return err
 		}
 	}
-	state.rxLock = rxLock
 	var txLock *os.File
 	if xxOnly == "" || xxOnly == TTx {
-		txLock, err = state.Ctx.LockDir(node.Id, string(TTx))
+		txLock, err = state.dirLock(node.Id, string(TTx))
 		if err != nil {
+			state.Ctx.UnlockDirShared(rxLock)
 			return err
 		}
 	}
+	state.rxLock = rxLock
 	state.txLock = txLock
 
 	var infosPayloads [][]byte
 	if xxOnly == "" || xxOnly == TTx {
-		infosPayloads = state.Ctx.infosOur(node.Id, state.Nice, &state.infosOurSeen)
+		infosPayloads = state.Ctx.infosOur(
+			node.Id, state.Nice, &state.infosOurSeen, state.inPart,
+		)
 	}
 	var firstPayload []byte
 	if len(infosPayloads) > 0 {
@@ -649,6 +758,32 @@ func (state *SPState) StartR(conn ConnDeadlined) error {
 	return err
 }
 
+// Insert file request into the queue, keeping it ordered by packets
+// niceness. Requests with the same niceness are served in order of
+// their arrival. As the sender transmits the head of the queue chunk by
+// chunk, more urgent packet preempts the less urgent one being sent,
+// which is resumed from its offset afterwards. Preempted request is
+// returned.
+func (state *SPState) queueTheirInsert(freq *SPFreq, nice uint8) *SPFreq {
+	state.Lock()
+	defer state.Unlock()
+	insertIdx := len(state.queueTheir)
+	for i, freqWithNice := range state.queueTheir {
+		if freqWithNice.nice > nice {
+			insertIdx = i
+			break
+		}
+	}
+	state.queueTheir = append(state.queueTheir, nil)
+	copy(state.queueTheir[insertIdx+1:], state.queueTheir[insertIdx:])
+	state.queueTheir[insertIdx] = &FreqWithNice{freq, nice}
+	if insertIdx == 0 && len(state.queueTheir) > 1 &&
+		state.queueTheir[1].freq.Offset > 0 {
+		return state.queueTheir[1].freq
+	}
+	return nil
+}
+
 func (state *SPState) closeFd(pth string) {
 	state.fdsLock.Lock()
 	if s, exists := state.fds[pth]; exists {
@@ -667,6 +802,15 @@ func (state *SPState) StartWorkers(
 	state.fds = make(map[string]FdAndFullSize)
 	state.fileHashers = make(map[string]*MTHAndOffset)
 	state.isDead = make(chan struct{})
+	state.conn = conn
+	if len(state.Node.RateSchedule) == 0 {
+		state.rxLimiter = NewRateLimiter(state.rxLimit)
+		state.txLimiter = NewRateLimiter(state.txLimit)
+	} else {
+		state.rxLimiter = &RateLimiter{last: time.Now()}
+		state.txLimiter = &RateLimiter{last: time.Now()}
+		state.limitsUpdate(time.Now())
+	}
 	if state.maxOnlineTime > 0 {
 		state.mustFinishAt = state.started.Add(state.maxOnlineTime)
 	}
@@ -674,7 +818,7 @@ func (state *SPState) StartWorkers(
 		spCheckerOnce.Do(func() { go SPChecker(state.Ctx) })
 		go func() {
 			for job := range state.Ctx.JobsNoCK(state.Node.Id) {
-				if job.PktEnc.Nice <= state.Nice {
+				if job.PktEnc.Nice <= state.Nice && state.inPart(job.HshValue) {
 					spCheckerTasks <- SPCheckerTask{
 						nodeId: state.Node.Id,
 						hsh:    job.HshValue,
@@ -753,6 +897,7 @@ func (state *SPState) StartWorkers(
 				pingTicker.Stop()
 				return
 			case now := <-deadlineTicker.C:
+				state.limitsUpdate(now)
 				if now.Sub(state.RxLastNonPing) >= state.onlineDeadline &&
 					now.Sub(state.TxLastNonPing) >= state.onlineDeadline {
 					goto Deadlined
@@ -802,6 +947,7 @@ func (state *SPState) StartWorkers(
 						state.Node.Id,
 						state.Nice,
 						&state.infosOurSeen,
+						state.inPart,
 					) {
 						state.Ctx.LogD(
 							"sp-queue-info",
@@ -869,6 +1015,9 @@ func (state *SPState) StartWorkers(
 					time.Sleep(time.Second / time.Duration(state.txRate))
 				}
 				pktName := Base32Codec.EncodeToString(freq.Hash[:])
+				state.Lock()
+				state.txPkt = pktName
+				state.Unlock()
 				lesp := append(
 					les,
 					LE{"XX", string(TTx)},
@@ -1111,6 +1260,12 @@ func (state *SPState) StartWorkers(
 		conn.Close()
 	}()
 
+	if state.Ctx.Metrics != nil {
+		state.Ctx.Metrics.spStarted(state)
+	}
+	if state.Ctx.Control != nil {
+		state.Ctx.Control.spStarted(state)
+	}
 	return nil
 }
 
@@ -1138,6 +1293,12 @@ func (state *SPState) Wait() bool {
 	for pktName := range state.progressBars {
 		ProgressKill(pktName)
 	}
+	if state.Ctx.Metrics != nil {
+		state.Ctx.Metrics.spFinished(state, nothingLeft)
+	}
+	if state.Ctx.Control != nil {
+		state.Ctx.Control.spFinished(state)
+	}
 	return nothingLeft
 }
 
@@ -1194,6 +1355,29 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 				},
 			)
 
+		case SPTypePart:
+			var part SPPart
+			if _, err = xdr.Unmarshal(r, &part); err != nil {
+				state.Ctx.LogE("sp-process-part", les, err, func(les LEs) string {
+					return fmt.Sprintf(
+						"SP with %s (nice %s): unmarshaling PART",
+						state.Node.Name, NicenessFmt(state.Nice),
+					)
+				})
+				return nil, err
+			}
+			state.Ctx.LogD(
+				"sp-process-part",
+				append(les, LE{"Type", "part"}),
+				func(les LEs) string {
+					return fmt.Sprintf(
+						"SP with %s (nice %s): got PART %d/%d",
+						state.Node.Name, NicenessFmt(state.Nice),
+						part.Idx, part.Num,
+					)
+				},
+			)
+
 		case SPTypeInfo:
 			infosGot = true
 			lesp := append(les, LE{"Type", "info"})
@@ -1247,6 +1431,12 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 			if !state.listOnly && state.xxOnly == TTx {
 				continue
 			}
+			if !state.listOnly && !state.inPart(info.Hash) {
+				state.Ctx.LogD("sp-process-info-other-part", lesp, func(les LEs) string {
+					return logMsg(les) + ": belongs to another connection"
+				})
+				continue
+			}
 			state.Lock()
 			state.infosTheir[*info.Hash] = &info
 			state.Unlock()
@@ -1305,6 +1495,12 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 				})
 				continue
 			}
+			if offset == 0 {
+				if err = state.Ctx.QuotaCheck(state.Node, TRx, int64(info.Size)); err != nil {
+					state.Ctx.LogE("sp-info-quota", lesp, err, logMsg)
+					continue
+				}
+			}
 			state.Ctx.LogI(
 				"sp-info",
 				append(lesp, LE{"Offset", offset}),
@@ -1315,6 +1511,12 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 				},
 			)
 			if !state.listOnly && (state.onlyPkts == nil || state.onlyPkts[*info.Hash]) {
+				if !state.rxClaim(info.Hash) {
+					state.Ctx.LogI("sp-info-busy", lesp, func(les LEs) string {
+						return logMsg(les) + ": being received by another connection"
+					})
+					continue
+				}
 				replies = append(replies, MarshalSP(
 					SPTypeFreq,
 					SPFreq{info.Hash, uint64(offset)},
@@ -1353,9 +1555,10 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 				)
 			}
 			fullsize := int64(0)
-			state.RLock()
+			state.Lock()
 			infoTheir := state.infosTheir[*file.Hash]
-			state.RUnlock()
+			state.rxPkt = pktName
+			state.Unlock()
 			if infoTheir == nil {
 				state.Ctx.LogE("sp-file-open", lesp, err, func(les LEs) string {
 					return logMsg(les) + ": unknown file"
@@ -1382,6 +1585,12 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 			if exists {
 				fd = fdAndFullSize.fd
 			} else {
+				if _, err = os.Stat(filePathPart); os.IsNotExist(err) {
+					if err = state.Ctx.QuotaCheck(state.Node, TRx, fullsize); err != nil {
+						state.Ctx.LogE("sp-file-quota", lesp, err, logMsg)
+						continue
+					}
+				}
 				fd, err = os.OpenFile(
 					filePathPart,
 					os.O_RDWR|os.O_CREATE,
@@ -1601,6 +1810,7 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 				state.Ctx.LogI("sp-done", lesp, func(les LEs) string {
 					return fmt.Sprintf("Packet %s is sent", pktName)
 				})
+				state.Ctx.TrackDelivered(state.Node.Id, pktName)
 				if state.Ctx.HdrUsage {
 					os.Remove(JobPath2Hdr(pth))
 				}
@@ -1637,18 +1847,21 @@ func (state *SPState) ProcessSP(payload []byte) ([][]byte, error) {
 			nice, exists := state.infosOurSeen[*freq.Hash]
 			if exists {
 				if state.onlyPkts == nil || !state.onlyPkts[*freq.Hash] {
-					state.Lock()
-					insertIdx := 0
-					var freqWithNice *FreqWithNice
-					for insertIdx, freqWithNice = range state.queueTheir {
-						if freqWithNice.nice > nice {
-							break
-						}
+					if preempted := state.queueTheirInsert(&freq, nice); preempted != nil {
+						state.Ctx.LogI(
+							"sp-process-freq-preempt",
+							append(lesp, LE{"Preempted", Base32Codec.EncodeToString(
+								preempted.Hash[:],
+							)}),
+							func(les LEs) string {
+								return fmt.Sprintf(
+									"SP with %s (nice %s): FREQ %s: preempts %s",
+									state.Node.Name, NicenessFmt(state.Nice), pktName,
+									Base32Codec.EncodeToString(preempted.Hash[:]),
+								)
+							},
+						)
 					}
-					state.queueTheir = append(state.queueTheir, nil)
-					copy(state.queueTheir[insertIdx+1:], state.queueTheir[insertIdx:])
-					state.queueTheir[insertIdx] = &FreqWithNice{&freq, nice}
-					state.Unlock()
 				} else {
 					state.Ctx.LogD("sp-process-freq-skip", lesp, func(les LEs) string {
 						return fmt.Sprintf(
@@ -0,0 +1,187 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestSPQueueTheirInsert(t *testing.T) {
+	f := func(nices []uint8) bool {
+		state := SPState{}
+		for i, nice := range nices {
+			var hash [MTHSize]byte
+			hash[0] = byte(i)
+			hash[1] = byte(i >> 8)
+			state.queueTheirInsert(&SPFreq{Hash: &hash}, nice)
+		}
+		if len(state.queueTheir) != len(nices) {
+			return false
+		}
+		for i := 1; i < len(state.queueTheir); i++ {
+			prev, curr := state.queueTheir[i-1], state.queueTheir[i]
+			if prev.nice > curr.nice {
+				return false
+			}
+			if prev.nice == curr.nice {
+				prevIdx := int(prev.freq.Hash[0]) | int(prev.freq.Hash[1])<<8
+				currIdx := int(curr.freq.Hash[0]) | int(curr.freq.Hash[1])<<8
+				if prevIdx > currIdx {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSPQueueTheirPreempt(t *testing.T) {
+	state := SPState{}
+	var hashBulk, hashFlash [MTHSize]byte
+	hashFlash[0] = 1
+	freqBulk := &SPFreq{Hash: &hashBulk}
+	if state.queueTheirInsert(freqBulk, NiceBulk) != nil {
+		t.Fatal("preempted empty queue")
+	}
+	if state.queueTheirInsert(&SPFreq{Hash: &hashFlash}, NiceFlash) != nil {
+		t.Fatal("preempted not started transmission")
+	}
+	state.queueTheir = state.queueTheir[1:]
+	freqBulk.Offset = 123
+	if state.queueTheirInsert(&SPFreq{Hash: &hashFlash}, NiceFlash) != freqBulk {
+		t.Fatal("no preemption")
+	}
+	if state.queueTheir[0].nice != NiceFlash || state.queueTheir[1].freq != freqBulk {
+		t.Fatal("bad queue order")
+	}
+}
+
+func TestSPPreemption(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testsppreempt")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeA, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCtx := func(our, their *NodeOur, name string) (*Ctx, *Node) {
+		node := their.Their()
+		node.NoisePub = their.NoisePub
+		node.OnlineDeadline = time.Minute
+		ctx := &Ctx{
+			Spool:   filepath.Join(spool, name),
+			Self:    our,
+			SelfId:  our.Id,
+			Neigh:   map[NodeId]*Node{*their.Id: node},
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, name+".log"),
+			Debug:   TDebug,
+		}
+		return ctx, node
+	}
+	ctxA, nodeBOfA := newCtx(nodeA, nodeB, "a")
+	ctxB, _ := newCtx(nodeB, nodeA, "b")
+	tx := func(nice uint8, size int64) {
+		if err := ctxA.TxExec(
+			nodeBOfA, nice, nice, "sendmail", nil, bytes.NewReader(nil),
+			size, MaxFileSize, true, nil,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx(NiceBulk, 1<<20)
+
+	connA, connB := net.Pipe()
+	stateA := &SPState{
+		Ctx:            ctxA,
+		Node:           nodeBOfA,
+		Nice:           255,
+		NoCK:           true,
+		onlineDeadline: time.Minute,
+		txLimit:        256 * 1024,
+		partNum:        1,
+	}
+	stateB := &SPState{Ctx: ctxB, Nice: 255, NoCK: true, partNum: 1}
+	errB := make(chan error)
+	go func() { errB <- stateB.StartR(connB) }()
+	if err = stateA.StartI(connA); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errB; err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stateA.Kill()
+		stateB.Kill()
+		stateA.Wait()
+		stateB.Wait()
+	}()
+
+	// Wait for bulk transmission to begin
+	time.Sleep(time.Second)
+	tx(NiceFlash, 1024)
+
+	received := func() (urgent, bulk bool) {
+		for job := range ctxB.JobsNoCK(nodeA.Id) {
+			switch job.PktEnc.Nice {
+			case NiceFlash:
+				urgent = true
+			case NiceBulk:
+				bulk = true
+			}
+		}
+		return
+	}
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		urgent, bulk := received()
+		if bulk && !urgent {
+			t.Fatal("bulk packet is not preempted")
+		}
+		if urgent {
+			if bulk {
+				t.Fatal("urgent packet is received after the bulk one")
+			}
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for time.Now().Before(deadline) {
+		if _, bulk := received(); bulk {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("packets are not received")
+}
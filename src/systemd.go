@@ -0,0 +1,81 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The first file descriptor passed by systemd's socket activation.
+const SystemdListenFDsStart = 3
+
+// Parse LISTEN_PID and LISTEN_FDS environment variables values and
+// return the number of descriptors passed to the process with pid.
+// Zero is returned if sockets are passed to another process.
+func systemdListenFDs(pidRaw, fdsRaw string, pid int) (int, error) {
+	if pidRaw == "" || fdsRaw == "" {
+		return 0, nil
+	}
+	listenPid, err := strconv.Atoi(pidRaw)
+	if err != nil {
+		return 0, errors.New("invalid LISTEN_PID: " + pidRaw)
+	}
+	if listenPid != pid {
+		return 0, nil
+	}
+	fds, err := strconv.Atoi(fdsRaw)
+	if err != nil || fds < 0 {
+		return 0, errors.New("invalid LISTEN_FDS: " + fdsRaw)
+	}
+	return fds, nil
+}
+
+// Return listeners passed by systemd (or compatible) socket activation
+// through the LISTEN_FDS protocol. Both TCP and Unix domain sockets are
+// supported. Environment variables are unset, so they are not inherited
+// by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	fds, err := systemdListenFDs(
+		os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid(),
+	)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || fds == 0 {
+		return nil, err
+	}
+	lns := make([]net.Listener, 0, fds)
+	for fd := SystemdListenFDsStart; fd < SystemdListenFDsStart+fds; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, errors.New(
+				"LISTEN_FD " + strconv.Itoa(fd) + ": " + err.Error(),
+			)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
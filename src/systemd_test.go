@@ -0,0 +1,47 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"testing"
+)
+
+func TestSystemdListenFDs(t *testing.T) {
+	for _, c := range []struct {
+		pid, fds string
+		n        int
+		bad      bool
+	}{
+		{"", "", 0, false},
+		{"123", "", 0, false},
+		{"123", "2", 2, false},
+		{"124", "2", 0, false},
+		{"123", "0", 0, false},
+		{"abc", "2", 0, true},
+		{"123", "-1", 0, true},
+		{"123", "two", 0, true},
+	} {
+		n, err := systemdListenFDs(c.pid, c.fds, 123)
+		if (err != nil) != c.bad {
+			t.Fatal(c, err)
+		}
+		if n != c.n {
+			t.Fatal(c, n)
+		}
+	}
+}
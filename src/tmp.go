@@ -133,3 +133,35 @@ func (tmp *TmpFileWHash) Commit(dir string) error {
 	}
 	return DirSync(dir)
 }
+
+// Atomically create or replace the file in dir, creating it if necessary.
+func fileWriteAtomic(dir, name string, data []byte) error {
+	if err := ensureDir(dir); err != nil {
+		return err
+	}
+	fd, err := TempFile(dir, "")
+	if err != nil {
+		return err
+	}
+	if _, err = fd.Write(data); err != nil {
+		fd.Close()
+		os.Remove(fd.Name())
+		return err
+	}
+	if !NoSync {
+		if err = fd.Sync(); err != nil {
+			fd.Close()
+			os.Remove(fd.Name())
+			return err
+		}
+	}
+	if err = fd.Close(); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	if err = os.Rename(fd.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+	return DirSync(dir)
+}
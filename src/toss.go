@@ -20,12 +20,12 @@ package nncp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime"
 	"os"
 	"os/exec"
@@ -69,8 +69,8 @@ func newNotification(fromTo *FromToJSON, subject string, body []byte) io.Reader
 	return strings.NewReader(strings.Join(lines, "\n"))
 }
 
-func pktSizeWithoutEnc(pktSize int64) int64 {
-	pktSize = pktSize - PktEncOverhead - PktOverhead - PktSizeOverhead
+func pktSizeWithoutEnc(pktEnc *PktEnc, pktSize int64) int64 {
+	pktSize = pktSize - pktEncOverhead(pktEnc.Magic) - PktOverhead - PktSizeOverhead
 	pktSizeBlocks := pktSize / (EncBlkSize + poly1305.TagSize)
 	if pktSize%(EncBlkSize+poly1305.TagSize) != 0 {
 		pktSize -= poly1305.TagSize
@@ -79,10 +79,147 @@ func pktSizeWithoutEnc(pktSize int64) int64 {
 	return pktSize
 }
 
-var JobRepeatProcess = errors.New("needs processing repeat")
+var (
+	JobRepeatProcess = errors.New("needs processing repeat")
+
+	NoHandle      = errors.New("No handle found")
+	NoIncoming    = errors.New("incoming is not allowed")
+	NoFreq        = errors.New("freqing is not allowed")
+	UnknownNode   = errors.New("unknown node")
+	UnknownArea   = errors.New("unknown area")
+	UnknownSender = errors.New("unknown sender")
+	Expired       = errors.New("packet is expired")
+)
+
+// Inbound packet being tossed.
+type TossJob struct {
+	Pkt     *Pkt
+	PktName string
+	Sender  *Node
+	Nice    uint8
+	Size    uint64
+
+	// Path to the encrypted packet in the spool. It is empty for the
+	// packets nested in the area ones.
+	Path string
+
+	// Packet's payload following its header. It is zstd-compressed
+	// for PktTypeExec.
+	R io.Reader
+
+	LEs LEs
+
+	DryRun, DoSeen                                bool
+	NoFile, NoFreq, NoExec, NoTrns, NoArea, NoACK bool
+
+	decompressor *zstd.Decoder
+}
+
+// Handler of the specified packet type tossing. It must read the job's
+// payload and, if it is not a dry run, remove the job's packet from the
+// spool after successful processing, like TossJobRemove does.
+type TossHandler interface {
+	Toss(ctx *Ctx, cctx context.Context, job *TossJob) error
+}
+
+type TossHandlerFunc func(ctx *Ctx, cctx context.Context, job *TossJob) error
+
+func (f TossHandlerFunc) Toss(ctx *Ctx, cctx context.Context, job *TossJob) error {
+	return f(ctx, cctx, job)
+}
+
+// Built-in handler of the packet type, nil if there is no such one.
+func DefaultTossHandler(typ PktType) TossHandler {
+	switch typ {
+	case PktTypeExec, PktTypeExecFat:
+		return TossHandlerFunc(tossExec)
+	case PktTypeFile:
+		return TossHandlerFunc(tossFile)
+	case PktTypeFreq:
+		return TossHandlerFunc(tossFreq)
+	case PktTypeTrns:
+		return TossHandlerFunc(tossTrns)
+	case PktTypeArea:
+		return TossHandlerFunc(tossArea)
+	case PktTypeACK:
+		return TossHandlerFunc(tossACK)
+	case PktTypeReceipt:
+		return TossHandlerFunc(tossReceipt)
+	}
+	return nil
+}
+
+// Override the built-in handler of the packet type. nil handler
+// restores the built-in one.
+func (ctx *Ctx) SetTossHandler(typ PktType, handler TossHandler) {
+	if handler == nil {
+		delete(ctx.TossHandlers, typ)
+		return
+	}
+	if ctx.TossHandlers == nil {
+		ctx.TossHandlers = make(map[PktType]TossHandler)
+	}
+	ctx.TossHandlers[typ] = handler
+}
+
+// Leave the seen mark of the job's packet in the spool.
+func (ctx *Ctx) tossJobSeen(job *TossJob) error {
+	if err := ensureDir(filepath.Dir(job.Path), SeenDir); err != nil {
+		return err
+	}
+	fd, err := os.Create(jobPath2Seen(job.Path))
+	if err != nil {
+		// Missing mark only allows the packet to be received again
+		return nil
+	}
+	fd.Close()
+	if err = DirSync(filepath.Dir(job.Path)); err != nil {
+		ctx.LogE("rx-dirsync", job.LEs, err, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tossing %s/%s: dirsyncing",
+				job.Sender.Name, job.PktName,
+			)
+		})
+	}
+	return err
+}
+
+// Mark the job as seen, if requested, and remove it from the spool.
+// That is the only way built-in handlers remove the tossed packets.
+func (ctx *Ctx) TossJobRemove(job *TossJob) error {
+	if job.DryRun || job.Path == "" {
+		return nil
+	}
+	if job.DoSeen {
+		if err := ctx.tossJobSeen(job); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(job.Path); err != nil {
+		ctx.LogE("rx-remove", job.LEs, err, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tossing %s/%s: removing",
+				job.Sender.Name, job.PktName,
+			)
+		})
+		return err
+	} else if ctx.HdrUsage {
+		os.Remove(JobPath2Hdr(job.Path))
+	}
+	return nil
+}
+
+// Outcome of the single inbound packet tossing.
+type TossResult struct {
+	Pkt    string
+	Sender *NodeId
+	Nice   uint8
+	Err    error
+}
 
 func jobProcess(
 	ctx *Ctx,
+	cctx context.Context,
 	pipeR *io.PipeReader,
 	pktName string,
 	les LEs,
@@ -90,11 +227,11 @@ func jobProcess(
 	nice uint8,
 	pktSize uint64,
 	jobPath string,
+	pktEnc *PktEnc,
 	decompressor *zstd.Decoder,
 	dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK bool,
 ) error {
 	defer pipeR.Close()
-	sendmail := ctx.Neigh[*ctx.SelfId].Exec["sendmail"]
 	var pkt Pkt
 	_, err := xdr.Unmarshal(pipeR, &pkt)
 	if err != nil {
@@ -116,871 +253,857 @@ func jobProcess(
 		if noExec {
 			return nil
 		}
-		path := bytes.Split(pkt.Path[:int(pkt.PathLen)], []byte{0})
-		handle := string(path[0])
-		args := make([]string, 0, len(path)-1)
-		for _, p := range path[1:] {
-			args = append(args, string(p))
+	case PktTypeFile:
+		if noFile {
+			return nil
 		}
-		argsStr := strings.Join(append([]string{handle}, args...), " ")
-		les = append(les, LE{"Type", "exec"}, LE{"Dst", argsStr})
-		cmdline := sender.Exec[handle]
-		if len(cmdline) == 0 {
-			err = errors.New("No handle found")
-			ctx.LogE(
-				"rx-no-handle", les, err,
-				func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing exec %s/%s (%s): %s",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), argsStr,
-					)
-				},
-			)
-			return err
+	case PktTypeFreq:
+		if noFreq {
+			return nil
 		}
-		if pkt.Type == PktTypeExec {
-			if err = decompressor.Reset(pipeR); err != nil {
-				log.Fatalln(err)
-			}
+	case PktTypeTrns:
+		if noTrns {
+			return nil
 		}
-		if !dryRun {
-			cmd := exec.Command(cmdline[0], append(cmdline[1:], args...)...)
-			cmd.Env = append(
-				cmd.Env,
-				"NNCP_SELF="+ctx.Self.Id.String(),
-				"NNCP_SENDER="+sender.Id.String(),
-				"NNCP_NICE="+strconv.Itoa(int(pkt.Nice)),
-			)
-			if pkt.Type == PktTypeExec {
-				cmd.Stdin = decompressor
-			} else {
-				cmd.Stdin = pipeR
-			}
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				les = append(les, LE{"Output", strings.Split(
-					strings.Trim(string(output), "\n"), "\n"),
-				})
-				ctx.LogE("rx-handle", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing exec %s/%s (%s): %s: handling",
-						sender.Name, pktName,
-						humanize.IBytes(uint64(pktSize)), argsStr,
-					)
-				})
-				return err
-			}
-			if len(sendmail) > 0 && ctx.NotifyExec != nil {
-				notify := ctx.NotifyExec[sender.Name+"."+handle]
-				if notify == nil {
-					notify = ctx.NotifyExec["*."+handle]
-				}
-				if notify != nil {
-					cmd := exec.Command(
-						sendmail[0],
-						append(sendmail[1:], notify.To)...,
-					)
-					cmd.Stdin = newNotification(notify, fmt.Sprintf(
-						"Exec from %s: %s", sender.Name, argsStr,
-					), output)
-					if err = cmd.Run(); err != nil {
-						ctx.LogE("rx-notify", les, err, func(les LEs) string {
-							return fmt.Sprintf(
-								"Tossing exec %s/%s (%s): %s: notifying",
-								sender.Name, pktName,
-								humanize.IBytes(pktSize), argsStr,
-							)
-						})
-					}
-				}
-			}
+	case PktTypeArea:
+		if noArea {
+			return nil
 		}
-		ctx.LogI("rx", les, func(les LEs) string {
+	case PktTypeACK:
+		if noACK {
+			return nil
+		}
+	}
+	if pktEnc != nil && pktEnc.Expired(time.Now()) {
+		les = append(les, LE{"Expire", pktEnc.Expire})
+		err = Expired
+		ctx.LogE("rx-expired", les, err, func(les LEs) string {
 			return fmt.Sprintf(
-				"Got exec from %s to %s (%s)",
-				sender.Name, argsStr,
-				humanize.IBytes(pktSize),
+				"Tossing %s/%s (%s): expired at %s",
+				sender.Name, pktName, humanize.IBytes(pktSize),
+				time.Unix(int64(pktEnc.Expire), 0).UTC().Format(time.RFC3339),
 			)
 		})
-		if !dryRun && jobPath != "" {
-			if doSeen {
-				if err := ensureDir(filepath.Dir(jobPath), SeenDir); err != nil {
-					return err
-				}
-				if fd, err := os.Create(jobPath2Seen(jobPath)); err == nil {
-					fd.Close()
-					if err = DirSync(filepath.Dir(jobPath)); err != nil {
-						ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-							return fmt.Sprintf(
-								"Tossing file %s/%s (%s): %s: dirsyncing",
-								sender.Name, pktName,
-								humanize.IBytes(pktSize),
-								filepath.Base(jobPath),
-							)
-						})
-						return err
-					}
-				}
-			}
-			if err = os.Remove(jobPath); err != nil {
-				ctx.LogE("rx-notify", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing exec %s/%s (%s): %s: notifying",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), argsStr,
-					)
-				})
-				return err
-			} else if ctx.HdrUsage {
-				os.Remove(JobPath2Hdr(jobPath))
-			}
+		if rerr := ctx.TossJobRemove(&TossJob{
+			PktName: pktName,
+			Sender:  sender,
+			Path:    jobPath,
+			LEs:     les,
+			DryRun:  dryRun,
+			DoSeen:  doSeen,
+		}); rerr != nil {
+			return rerr
 		}
+		return err
+	}
+	handler := ctx.TossHandlers[pkt.Type]
+	if handler == nil {
+		handler = DefaultTossHandler(pkt.Type)
+	}
+	if handler == nil {
+		err = BadPktType
+		ctx.LogE(
+			"rx-type-unknown", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing %s/%s (%s)",
+					sender.Name, pktName, humanize.IBytes(pktSize),
+				)
+			},
+		)
+		return err
+	}
+	err = handler.Toss(ctx, cctx, &TossJob{
+		Pkt:          &pkt,
+		PktName:      pktName,
+		Sender:       sender,
+		Nice:         nice,
+		Size:         pktSize,
+		Path:         jobPath,
+		R:            pipeR,
+		LEs:          les,
+		DryRun:       dryRun,
+		DoSeen:       doSeen,
+		NoFile:       noFile,
+		NoFreq:       noFreq,
+		NoExec:       noExec,
+		NoTrns:       noTrns,
+		NoArea:       noArea,
+		NoACK:        noACK,
+		decompressor: decompressor,
+	})
+	if err == nil && !dryRun && pktEnc != nil &&
+		sender.Receipt && receiptable(pkt.Type) {
+		// Packet is already processed, so failed receipt is only logged
+		ctx.txReceipt(cctx, sender, pktEnc, nice)
+	}
+	return err
+}
 
-	case PktTypeFile:
-		if noFile {
-			return nil
-		}
-		dst := string(pkt.Path[:int(pkt.PathLen)])
-		les = append(les, LE{"Type", "file"}, LE{"Dst", dst})
-		if filepath.IsAbs(dst) {
-			err = errors.New("non-relative destination path")
-			ctx.LogE(
-				"rx-non-rel", les, err,
-				func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				},
-			)
-			return err
-		}
-		incoming := sender.Incoming
-		if incoming == nil {
-			err = errors.New("incoming is not allowed")
-			ctx.LogE(
-				"rx-no-incoming", les, err,
-				func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				},
-			)
-			return err
-		}
-		dir := filepath.Join(*incoming, path.Dir(dst))
-		if err = os.MkdirAll(dir, os.FileMode(0777)); err != nil {
-			ctx.LogE("rx-mkdir", les, err, func(les LEs) string {
+// Default PktTypeExec and PktTypeExecFat handler: feeds the payload to
+// the sender's configured exec handle command.
+func tossExec(ctx *Ctx, cctx context.Context, job *TossJob) error {
+	var err error
+	sendmail := ctx.Neigh[*ctx.SelfId].Exec["sendmail"]
+	les := job.LEs
+
+	path := bytes.Split(job.Pkt.Path[:int(job.Pkt.PathLen)], []byte{0})
+	handle := string(path[0])
+	args := make([]string, 0, len(path)-1)
+	for _, p := range path[1:] {
+		args = append(args, string(p))
+	}
+	argsStr := strings.Join(append([]string{handle}, args...), " ")
+	les = append(les, LE{"Type", "exec"}, LE{"Dst", argsStr})
+	cmdline := job.Sender.Exec[handle]
+	if len(cmdline) == 0 {
+		err = NoHandle
+		ctx.LogE(
+			"rx-no-handle", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing exec %s/%s (%s): %s",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), argsStr,
+				)
+			},
+		)
+		return err
+	}
+	if job.Pkt.Type == PktTypeExec {
+		if err = job.decompressor.Reset(job.R); err != nil {
+			ctx.LogE("rx-decompress", les, err, func(les LEs) string {
 				return fmt.Sprintf(
-					"Tossing file %s/%s (%s): %s: mkdir",
-					sender.Name, pktName,
-					humanize.IBytes(pktSize), dst,
+					"Tossing exec %s/%s (%s): %s: decompressing",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), argsStr,
 				)
 			})
 			return err
 		}
-		if !dryRun {
-			tmp, err := TempFile(dir, "file")
-			if err != nil {
-				ctx.LogE("rx-mktemp", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: mktemp",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			les = append(les, LE{"Tmp", tmp.Name()})
-			ctx.LogD("rx-tmp-created", les, func(les LEs) string {
+	}
+	if !job.DryRun {
+		cmd := exec.CommandContext(
+			cctx, cmdline[0], append(cmdline[1:], args...)...,
+		)
+		cmd.Env = append(
+			cmd.Env,
+			"NNCP_SELF="+ctx.Self.Id.String(),
+			"NNCP_SENDER="+job.Sender.Id.String(),
+			"NNCP_NICE="+strconv.Itoa(int(job.Pkt.Nice)),
+		)
+		if job.Pkt.Type == PktTypeExec {
+			cmd.Stdin = job.decompressor
+		} else {
+			cmd.Stdin = job.R
+		}
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			les = append(les, LE{"Output", strings.Split(
+				strings.Trim(string(output), "\n"), "\n"),
+			})
+			ctx.LogE("rx-handle", les, err, func(les LEs) string {
 				return fmt.Sprintf(
-					"Tossing file %s/%s (%s): %s: created: %s",
-					sender.Name, pktName,
-					humanize.IBytes(pktSize), dst, tmp.Name(),
+					"Tossing exec %s/%s (%s): %s: handling",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(uint64(job.Size)), argsStr,
 				)
 			})
-			bufW := bufio.NewWriter(tmp)
-			if _, err = CopyProgressed(
-				bufW, pipeR, "Rx file",
-				append(les, LE{"FullSize", int64(pktSize)}),
-				ctx.ShowPrgrs,
-			); err != nil {
-				ctx.LogE("rx-copy", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: copying",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			if err = bufW.Flush(); err != nil {
-				tmp.Close()
-				ctx.LogE("rx-flush", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: flushing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			if !NoSync {
-				if err = tmp.Sync(); err != nil {
-					tmp.Close()
-					ctx.LogE("rx-sync", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing file %s/%s (%s): %s: syncing",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), dst,
-						)
-					})
-					return err
-				}
-			}
-			if err = tmp.Close(); err != nil {
-				ctx.LogE("rx-close", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: closing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			dstPathOrig := filepath.Join(*incoming, dst)
-			dstPath := dstPathOrig
-			dstPathCtr := 0
-			for {
-				if _, err = os.Stat(dstPath); err != nil {
-					if os.IsNotExist(err) {
-						break
-					}
-					ctx.LogE("rx-stat", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing file %s/%s (%s): %s: stating: %s",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), dst, dstPath,
-						)
-					})
-					return err
-				}
-				dstPath = dstPathOrig + "." + strconv.Itoa(dstPathCtr)
-				dstPathCtr++
-			}
-			if err = os.Rename(tmp.Name(), dstPath); err != nil {
-				ctx.LogE("rx-rename", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: renaming",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			if err = DirSync(*incoming); err != nil {
-				ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing file %s/%s (%s): %s: dirsyncing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), dst,
-					)
-				})
-				return err
-			}
-			les = les[:len(les)-1] // delete Tmp
+			return err
 		}
-		ctx.LogI("rx", les, func(les LEs) string {
-			return fmt.Sprintf(
-				"Got file %s (%s) from %s",
-				dst, humanize.IBytes(pktSize), sender.Name,
-			)
-		})
-		if !dryRun {
-			if jobPath != "" {
-				if doSeen {
-					if err := ensureDir(filepath.Dir(jobPath), SeenDir); err != nil {
-						return err
-					}
-					if fd, err := os.Create(jobPath2Seen(jobPath)); err == nil {
-						fd.Close()
-						if err = DirSync(filepath.Dir(jobPath)); err != nil {
-							ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-								return fmt.Sprintf(
-									"Tossing file %s/%s (%s): %s: dirsyncing",
-									sender.Name, pktName,
-									humanize.IBytes(pktSize),
-									filepath.Base(jobPath),
-								)
-							})
-							return err
-						}
-					}
-				}
-				if err = os.Remove(jobPath); err != nil {
-					ctx.LogE("rx-remove", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing file %s/%s (%s): %s: removing",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), dst,
-						)
-					})
-					return err
-				} else if ctx.HdrUsage {
-					os.Remove(JobPath2Hdr(jobPath))
-				}
+		if len(sendmail) > 0 && ctx.NotifyExec != nil {
+			notify := ctx.NotifyExec[job.Sender.Name+"."+handle]
+			if notify == nil {
+				notify = ctx.NotifyExec["*."+handle]
 			}
-			if len(sendmail) > 0 && ctx.NotifyFile != nil {
+			if notify != nil {
 				cmd := exec.Command(
 					sendmail[0],
-					append(sendmail[1:], ctx.NotifyFile.To)...,
+					append(sendmail[1:], notify.To)...,
 				)
-				cmd.Stdin = newNotification(ctx.NotifyFile, fmt.Sprintf(
-					"File from %s: %s (%s)",
-					sender.Name, dst, humanize.IBytes(pktSize),
-				), nil)
+				cmd.Stdin = newNotification(notify, fmt.Sprintf(
+					"Exec from %s: %s", job.Sender.Name, argsStr,
+				), output)
 				if err = cmd.Run(); err != nil {
 					ctx.LogE("rx-notify", les, err, func(les LEs) string {
 						return fmt.Sprintf(
-							"Tossing file %s/%s (%s): %s: notifying",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), dst,
+							"Tossing exec %s/%s (%s): %s: notifying",
+							job.Sender.Name, job.PktName,
+							humanize.IBytes(job.Size), argsStr,
 						)
 					})
 				}
 			}
 		}
+	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		return fmt.Sprintf(
+			"Got exec from %s to %s (%s)",
+			job.Sender.Name, argsStr,
+			humanize.IBytes(job.Size),
+		)
+	})
+	return ctx.TossJobRemove(job)
+}
 
-	case PktTypeFreq:
-		if noFreq {
-			return nil
-		}
-		src := string(pkt.Path[:int(pkt.PathLen)])
-		les := append(les, LE{"Type", "freq"}, LE{"Src", src})
-		if filepath.IsAbs(src) {
-			err = errors.New("non-relative source path")
-			ctx.LogE(
-				"rx-non-rel", les, err,
-				func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing freq %s/%s (%s): %s: notifying",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), src,
-					)
-				},
+// Default PktTypeFile handler: saves the file in sender's incoming
+// directory.
+func tossFile(ctx *Ctx, _ context.Context, job *TossJob) error {
+	var err error
+	sendmail := ctx.Neigh[*ctx.SelfId].Exec["sendmail"]
+	les := job.LEs
+
+	dst := string(job.Pkt.Path[:int(job.Pkt.PathLen)])
+	les = append(les, LE{"Type", "file"}, LE{"Dst", dst})
+	if filepath.IsAbs(dst) {
+		err = NonRelPath
+		ctx.LogE(
+			"rx-non-rel", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			},
+		)
+		return err
+	}
+	incoming := job.Sender.Incoming
+	if incoming == nil {
+		err = NoIncoming
+		ctx.LogE(
+			"rx-no-incoming", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			},
+		)
+		return err
+	}
+	dir := filepath.Join(*incoming, path.Dir(dst))
+	if err = os.MkdirAll(dir, os.FileMode(0777)); err != nil {
+		ctx.LogE("rx-mkdir", les, err, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tossing file %s/%s (%s): %s: mkdir",
+				job.Sender.Name, job.PktName,
+				humanize.IBytes(job.Size), dst,
 			)
-			return err
-		}
-		dstRaw, err := ioutil.ReadAll(pipeR)
+		})
+		return err
+	}
+	if !job.DryRun {
+		tmp, err := TempFile(dir, "file")
 		if err != nil {
-			ctx.LogE("rx-read", les, err, func(les LEs) string {
+			ctx.LogE("rx-mktemp", les, err, func(les LEs) string {
 				return fmt.Sprintf(
-					"Tossing freq %s/%s (%s): %s: reading",
-					sender.Name, pktName,
-					humanize.IBytes(pktSize), src,
+					"Tossing file %s/%s (%s): %s: mktemp",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
 				)
 			})
 			return err
 		}
-		dst := string(dstRaw)
-		les = append(les, LE{"Dst", dst})
-		freqPath := sender.FreqPath
-		if freqPath == nil {
-			err = errors.New("freqing is not allowed")
-			ctx.LogE(
-				"rx-no-freq", les, err,
-				func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing freq %s/%s (%s): %s -> %s",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), src, dst,
-					)
-				},
+		les = append(les, LE{"Tmp", tmp.Name()})
+		ctx.LogD("rx-tmp-created", les, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tossing file %s/%s (%s): %s: created: %s",
+				job.Sender.Name, job.PktName,
+				humanize.IBytes(job.Size), dst, tmp.Name(),
 			)
+		})
+		bufW := bufio.NewWriter(tmp)
+		if _, err = CopyProgressed(
+			bufW, job.R, "Rx file",
+			append(les, LE{"FullSize", int64(job.Size)}),
+			ctx.ShowPrgrs,
+		); err != nil {
+			ctx.LogE("rx-copy", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s: copying",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			})
 			return err
 		}
-		if !dryRun {
-			err = ctx.TxFile(
-				sender,
-				pkt.Nice,
-				filepath.Join(*freqPath, src),
-				dst,
-				sender.FreqChunked,
-				sender.FreqMinSize,
-				sender.FreqMaxSize,
-				nil,
-			)
-			if err != nil {
-				ctx.LogE("rx-tx", les, err, func(les LEs) string {
+		if err = bufW.Flush(); err != nil {
+			tmp.Close()
+			ctx.LogE("rx-flush", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s: flushing",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			})
+			return err
+		}
+		if !NoSync {
+			if err = tmp.Sync(); err != nil {
+				tmp.Close()
+				ctx.LogE("rx-sync", les, err, func(les LEs) string {
 					return fmt.Sprintf(
-						"Tossing freq %s/%s (%s): %s -> %s: txing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize), src, dst,
+						"Tossing file %s/%s (%s): %s: syncing",
+						job.Sender.Name, job.PktName,
+						humanize.IBytes(job.Size), dst,
 					)
 				})
 				return err
 			}
 		}
-		ctx.LogI("rx", les, func(les LEs) string {
-			return fmt.Sprintf("Got file request %s to %s", src, sender.Name)
-		})
-		if !dryRun {
-			if jobPath != "" {
-				if doSeen {
-					if err := ensureDir(filepath.Dir(jobPath), SeenDir); err != nil {
-						return err
-					}
-					if fd, err := os.Create(jobPath2Seen(jobPath)); err == nil {
-						fd.Close()
-						if err = DirSync(filepath.Dir(jobPath)); err != nil {
-							ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-								return fmt.Sprintf(
-									"Tossing file %s/%s (%s): %s: dirsyncing",
-									sender.Name, pktName,
-									humanize.IBytes(pktSize),
-									filepath.Base(jobPath),
-								)
-							})
-							return err
-						}
-					}
-				}
-				if err = os.Remove(jobPath); err != nil {
-					ctx.LogE("rx-remove", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing freq %s/%s (%s): %s -> %s: removing",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), src, dst,
-						)
-					})
-					return err
-				} else if ctx.HdrUsage {
-					os.Remove(JobPath2Hdr(jobPath))
-				}
-			}
-			if len(sendmail) > 0 && ctx.NotifyFreq != nil {
-				cmd := exec.Command(
-					sendmail[0],
-					append(sendmail[1:], ctx.NotifyFreq.To)...,
+		if err = tmp.Close(); err != nil {
+			ctx.LogE("rx-close", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s: closing",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
 				)
-				cmd.Stdin = newNotification(ctx.NotifyFreq, fmt.Sprintf(
-					"Freq from %s: %s", sender.Name, src,
-				), nil)
-				if err = cmd.Run(); err != nil {
-					ctx.LogE("rx-notify", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing freq %s/%s (%s): %s -> %s: notifying",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize), src, dst,
-						)
-					})
-				}
-			}
-		}
-
-	case PktTypeTrns:
-		if noTrns {
-			return nil
-		}
-		dst := new([MTHSize]byte)
-		copy(dst[:], pkt.Path[:int(pkt.PathLen)])
-		nodeId := NodeId(*dst)
-		les := append(les, LE{"Type", "trns"}, LE{"Dst", nodeId})
-		logMsg := func(les LEs) string {
-			return fmt.Sprintf(
-				"Tossing trns %s/%s (%s): %s",
-				sender.Name, pktName,
-				humanize.IBytes(pktSize),
-				nodeId.String(),
-			)
-		}
-		node := ctx.Neigh[nodeId]
-		if node == nil {
-			err = errors.New("unknown node")
-			ctx.LogE("rx-unknown", les, err, logMsg)
+			})
 			return err
-		}
-		ctx.LogD("rx-tx", les, logMsg)
-		if !dryRun {
-			if len(node.Via) == 0 {
-				if err = ctx.TxTrns(node, nice, int64(pktSize), pipeR); err != nil {
-					ctx.LogE("rx", les, err, func(les LEs) string {
-						return logMsg(les) + ": txing"
-					})
-					return err
-				}
-			} else {
-				via := node.Via[:len(node.Via)-1]
-				node = ctx.Neigh[*node.Via[len(node.Via)-1]]
-				node = &Node{Id: node.Id, Via: via, ExchPub: node.ExchPub}
-				pktTrns, err := NewPkt(PktTypeTrns, 0, nodeId[:])
-				if err != nil {
-					panic(err)
-				}
-				if _, _, _, err = ctx.Tx(
-					node,
-					pktTrns,
-					nice,
-					int64(pktSize), 0, MaxFileSize,
-					pipeR,
-					pktName,
-					nil,
-				); err != nil {
-					ctx.LogE("rx", les, err, func(les LEs) string {
-						return logMsg(les) + ": txing"
-					})
-					return err
-				}
-			}
-		}
-		ctx.LogI("rx", les, func(les LEs) string {
-			return fmt.Sprintf(
-				"Got transitional packet from %s to %s (%s)",
-				sender.Name,
-				ctx.NodeName(&nodeId),
-				humanize.IBytes(pktSize),
-			)
-		})
-		if !dryRun && jobPath != "" {
-			if doSeen {
-				if err := ensureDir(filepath.Dir(jobPath), SeenDir); err != nil {
-					return err
-				}
-				if fd, err := os.Create(jobPath2Seen(jobPath)); err == nil {
-					fd.Close()
-					if err = DirSync(filepath.Dir(jobPath)); err != nil {
-						ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-							return fmt.Sprintf(
-								"Tossing file %s/%s (%s): %s: dirsyncing",
-								sender.Name, pktName,
-								humanize.IBytes(pktSize),
-								filepath.Base(jobPath),
-							)
-						})
-						return err
-					}
+		}
+		dstPathOrig := filepath.Join(*incoming, dst)
+		dstPath := dstPathOrig
+		dstPathCtr := 0
+		for {
+			if _, err = os.Stat(dstPath); err != nil {
+				if os.IsNotExist(err) {
+					break
 				}
-			}
-			if err = os.Remove(jobPath); err != nil {
-				ctx.LogE("rx", les, err, func(les LEs) string {
+				ctx.LogE("rx-stat", les, err, func(les LEs) string {
 					return fmt.Sprintf(
-						"Tossing trns %s/%s (%s): %s: removing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize),
-						ctx.NodeName(&nodeId),
+						"Tossing file %s/%s (%s): %s: stating: %s",
+						job.Sender.Name, job.PktName,
+						humanize.IBytes(job.Size), dst, dstPath,
 					)
 				})
 				return err
-			} else if ctx.HdrUsage {
-				os.Remove(JobPath2Hdr(jobPath))
 			}
+			dstPath = dstPathOrig + "." + strconv.Itoa(dstPathCtr)
+			dstPathCtr++
 		}
-
-	case PktTypeArea:
-		if noArea {
-			return nil
-		}
-		areaId := new(AreaId)
-		copy(areaId[:], pkt.Path[:int(pkt.PathLen)])
-		les := append(les, LE{"Type", "area"}, LE{"Area", areaId})
-		logMsg := func(les LEs) string {
-			return fmt.Sprintf(
-				"Tossing %s/%s (%s): area %s",
-				sender.Name, pktName,
-				humanize.IBytes(pktSize),
-				ctx.AreaName(areaId),
-			)
+		if err = os.Rename(tmp.Name(), dstPath); err != nil {
+			ctx.LogE("rx-rename", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s: renaming",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			})
+			return err
 		}
-		area := ctx.AreaId2Area[*areaId]
-		if area == nil {
-			err = errors.New("unknown area")
-			ctx.LogE("rx-area-unknown", les, err, logMsg)
+		if err = DirSync(*incoming); err != nil {
+			ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing file %s/%s (%s): %s: dirsyncing",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), dst,
+				)
+			})
 			return err
 		}
-		pktEnc, pktEncRaw, err := ctx.HdrRead(pipeR)
-		fullPipeR := io.MultiReader(bytes.NewReader(pktEncRaw), pipeR)
-		if err != nil {
-			ctx.LogE("rx-area-pkt-enc-read", les, err, logMsg)
+		les = les[:len(les)-1] // delete Tmp
+	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		return fmt.Sprintf(
+			"Got file %s (%s) from %s",
+			dst, humanize.IBytes(job.Size), job.Sender.Name,
+		)
+	})
+	if !job.DryRun {
+		if err = ctx.TossJobRemove(job); err != nil {
 			return err
 		}
-		msgHashRaw := blake2b.Sum256(pktEncRaw)
-		msgHash := Base32Codec.EncodeToString(msgHashRaw[:])
-		les = append(les, LE{"AreaMsg", msgHash})
-		ctx.LogD("rx-area", les, logMsg)
-
-		if dryRun {
-			for _, nodeId := range area.Subs {
-				node := ctx.Neigh[*nodeId]
-				lesEcho := append(les, LE{"Echo", nodeId})
-				seenDir := filepath.Join(
-					ctx.Spool, nodeId.String(), AreaDir, area.Id.String(),
-				)
-				seenPath := filepath.Join(seenDir, msgHash)
-				logMsgNode := func(les LEs) string {
+		if len(sendmail) > 0 && ctx.NotifyFile != nil {
+			cmd := exec.Command(
+				sendmail[0],
+				append(sendmail[1:], ctx.NotifyFile.To)...,
+			)
+			cmd.Stdin = newNotification(ctx.NotifyFile, fmt.Sprintf(
+				"File from %s: %s (%s)",
+				job.Sender.Name, dst, humanize.IBytes(job.Size),
+			), nil)
+			if err = cmd.Run(); err != nil {
+				ctx.LogE("rx-notify", les, err, func(les LEs) string {
 					return fmt.Sprintf(
-						"%s: echoing to: %s", logMsg(les), node.Name,
+						"Tossing file %s/%s (%s): %s: notifying",
+						job.Sender.Name, job.PktName,
+						humanize.IBytes(job.Size), dst,
 					)
-				}
-				if _, err := os.Stat(seenPath); err == nil {
-					ctx.LogD("rx-area-echo-seen", lesEcho, func(les LEs) string {
-						return logMsgNode(les) + ": already sent"
-					})
-					continue
-				}
-				ctx.LogI("rx-area-echo", lesEcho, logMsgNode)
-			}
-		} else {
-			for _, nodeId := range area.Subs {
-				node := ctx.Neigh[*nodeId]
-				lesEcho := append(les, LE{"Echo", nodeId})
-				seenDir := filepath.Join(
-					ctx.Spool, nodeId.String(), AreaDir, area.Id.String(),
-				)
-				seenPath := filepath.Join(seenDir, msgHash)
-				logMsgNode := func(les LEs) string {
-					return fmt.Sprintf("%s: echo to: %s", logMsg(les), node.Name)
-				}
-				if _, err := os.Stat(seenPath); err == nil {
-					ctx.LogD("rx-area-echo-seen", lesEcho, func(les LEs) string {
-						return logMsgNode(les) + ": already sent"
-					})
-					continue
-				}
-				if nodeId != sender.Id && nodeId != pktEnc.Sender {
-					ctx.LogI("rx-area-echo", lesEcho, logMsgNode)
-					if _, _, _, err = ctx.Tx(
-						node,
-						&pkt,
-						nice,
-						int64(pktSize), 0, MaxFileSize,
-						fullPipeR,
-						pktName,
-						nil,
-					); err != nil {
-						ctx.LogE("rx-area", lesEcho, err, logMsgNode)
-						return err
-					}
-				}
-				if err = os.MkdirAll(seenDir, os.FileMode(0777)); err != nil {
-					ctx.LogE("rx-area-mkdir", lesEcho, err, logMsgNode)
-					return err
-				}
-				if fd, err := os.Create(seenPath); err == nil {
-					fd.Close()
-					if err = DirSync(seenDir); err != nil {
-						ctx.LogE("rx-area-dirsync", les, err, logMsgNode)
-						return err
-					}
-				} else {
-					ctx.LogE("rx-area-touch", lesEcho, err, logMsgNode)
-					return err
-				}
-				return JobRepeatProcess
+				})
 			}
 		}
+	}
+	return nil
+}
 
-		seenDir := filepath.Join(
-			ctx.Spool, ctx.SelfId.String(), AreaDir, area.Id.String(),
+// Default PktTypeFreq handler: sends the requested file back to the
+// sender.
+func tossFreq(ctx *Ctx, cctx context.Context, job *TossJob) error {
+	var err error
+	sendmail := ctx.Neigh[*ctx.SelfId].Exec["sendmail"]
+	les := job.LEs
+
+	src := string(job.Pkt.Path[:int(job.Pkt.PathLen)])
+	les = append(les, LE{"Type", "freq"}, LE{"Src", src})
+	if filepath.IsAbs(src) {
+		err = NonRelPath
+		ctx.LogE(
+			"rx-non-rel", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing freq %s/%s (%s): %s: notifying",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), src,
+				)
+			},
+		)
+		return err
+	}
+	dstRaw, err := ioutil.ReadAll(job.R)
+	if err != nil {
+		ctx.LogE("rx-read", les, err, func(les LEs) string {
+			return fmt.Sprintf(
+				"Tossing freq %s/%s (%s): %s: reading",
+				job.Sender.Name, job.PktName,
+				humanize.IBytes(job.Size), src,
+			)
+		})
+		return err
+	}
+	dst := string(dstRaw)
+	les = append(les, LE{"Dst", dst})
+	freqPath := job.Sender.FreqPath
+	if freqPath == nil {
+		err = NoFreq
+		ctx.LogE(
+			"rx-no-freq", les, err,
+			func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing freq %s/%s (%s): %s -> %s",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), src, dst,
+				)
+			},
+		)
+		return err
+	}
+	if !job.DryRun {
+		_, err = ctx.TxFileContext(
+			cctx,
+			job.Sender,
+			job.Pkt.Nice,
+			filepath.Join(*freqPath, src),
+			dst,
+			job.Sender.FreqChunked,
+			job.Sender.FreqMinSize,
+			job.Sender.FreqMaxSize,
+			nil,
 		)
-		seenPath := filepath.Join(seenDir, msgHash)
-		if _, err := os.Stat(seenPath); err == nil {
-			ctx.LogD("rx-area-seen", les, func(les LEs) string {
-				return logMsg(les) + ": already seen"
+		if err != nil {
+			ctx.LogE("rx-tx", les, err, func(les LEs) string {
+				return fmt.Sprintf(
+					"Tossing freq %s/%s (%s): %s -> %s: txing",
+					job.Sender.Name, job.PktName,
+					humanize.IBytes(job.Size), src, dst,
+				)
 			})
-			if !dryRun && jobPath != "" {
-				if err = os.Remove(jobPath); err != nil {
-					ctx.LogE("rx-area-remove", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing area %s/%s (%s): %s: removing",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize),
-							msgHash,
-						)
-					})
-					return err
-				} else if ctx.HdrUsage {
-					os.Remove(JobPath2Hdr(jobPath))
-				}
+			return err
+		}
+	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		return fmt.Sprintf("Got file request %s to %s", src, job.Sender.Name)
+	})
+	if !job.DryRun {
+		if err = ctx.TossJobRemove(job); err != nil {
+			return err
+		}
+		if len(sendmail) > 0 && ctx.NotifyFreq != nil {
+			cmd := exec.Command(
+				sendmail[0],
+				append(sendmail[1:], ctx.NotifyFreq.To)...,
+			)
+			cmd.Stdin = newNotification(ctx.NotifyFreq, fmt.Sprintf(
+				"Freq from %s: %s", job.Sender.Name, src,
+			), nil)
+			if err = cmd.Run(); err != nil {
+				ctx.LogE("rx-notify", les, err, func(les LEs) string {
+					return fmt.Sprintf(
+						"Tossing freq %s/%s (%s): %s -> %s: notifying",
+						job.Sender.Name, job.PktName,
+						humanize.IBytes(job.Size), src, dst,
+					)
+				})
 			}
-			return nil
 		}
+	}
+	return nil
+}
+
+// Default PktTypeTrns handler: relays the packet further.
+func tossTrns(ctx *Ctx, cctx context.Context, job *TossJob) error {
+	var err error
+	les := job.LEs
 
-		if area.Prv == nil {
-			ctx.LogD("rx-area-no-prv", les, func(les LEs) string {
-				return logMsg(les) + ": no private key for decoding"
+	dst := new([MTHSize]byte)
+	copy(dst[:], job.Pkt.Path[:int(job.Pkt.PathLen)])
+	nodeId := NodeId(*dst)
+	les = append(les, LE{"Type", "trns"}, LE{"Dst", nodeId})
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf(
+			"Tossing trns %s/%s (%s): %s",
+			job.Sender.Name, job.PktName,
+			humanize.IBytes(job.Size),
+			nodeId.String(),
+		)
+	}
+	node := ctx.Neigh[nodeId]
+	if node == nil {
+		err = UnknownNode
+		ctx.LogE("rx-unknown", les, err, logMsg)
+		return err
+	}
+	if err = ctx.TransitAllowed(job.Sender, &nodeId, job.Nice, int64(job.Size)); err != nil {
+		// Policy violation is permanent, so the packet is dropped
+		ctx.LogE("rx-trns-denied", les, err, logMsg)
+		if rerr := ctx.TossJobRemove(job); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	if job.DryRun {
+		err = ctx.TransitCheck(job.Sender, &nodeId, job.Nice, int64(job.Size))
+	} else {
+		err = ctx.transitSpend(job.Sender, int64(job.Size))
+	}
+	if err != nil {
+		// Packet is kept until the budget allows relaying it
+		ctx.LogE("rx-trns-budget", les, err, logMsg)
+		return err
+	}
+	// Not relayed packet's size is returned to the budget
+	refund := func() {
+		if rerr := ctx.transitSpend(job.Sender, -int64(job.Size)); rerr != nil {
+			ctx.LogE("rx-trns-budget", les, rerr, func(les LEs) string {
+				return logMsg(les) + ": accounting"
 			})
-		} else {
-			signatureVerify := true
-			if _, senderKnown := ctx.Neigh[*pktEnc.Sender]; !senderKnown {
-				if !area.AllowUnknown {
-					err = errors.New("unknown sender")
-					ctx.LogE(
-						"rx-area-unknown",
-						append(les, LE{"Sender", pktEnc.Sender}),
-						err,
-						func(les LEs) string {
-							return logMsg(les) + ": sender: " + pktEnc.Sender.String()
-						},
-					)
-					return err
-				}
-				signatureVerify = false
+		}
+	}
+	ctx.LogD("rx-tx", les, logMsg)
+	if !job.DryRun {
+		if len(node.Via) == 0 {
+			if err = ctx.TxTrns(node, job.Nice, int64(job.Size), job.R); err != nil {
+				ctx.LogE("rx", les, err, func(les LEs) string {
+					return logMsg(les) + ": txing"
+				})
+				refund()
+				return err
 			}
-			areaNodeOur := NodeOur{Id: new(NodeId), ExchPrv: new([32]byte)}
-			copy(areaNodeOur.Id[:], area.Id[:])
-			copy(areaNodeOur.ExchPrv[:], area.Prv[:])
-			areaNode := Node{
-				Id:       new(NodeId),
-				Name:     area.Name,
-				Incoming: area.Incoming,
-				Exec:     area.Exec,
+		} else {
+			// Packet is queued for the first hop, so its quota applies
+			hopId := node.Via[0]
+			if err = ctx.QuotaCheck(ctx.Neigh[*hopId], TTx, int64(job.Size)); err != nil {
+				ctx.LogE("tx-trns-quota", append(les, LE{"Hop", hopId}), err, logMsg)
+				refund()
+				return err
 			}
-			copy(areaNode.Id[:], area.Id[:])
-			pktName := fmt.Sprintf(
-				"area/%s/%s",
-				Base32Codec.EncodeToString(areaId[:]), msgHash,
-			)
-
-			pipeR, pipeW := io.Pipe()
-			errs := make(chan error, 1)
-			go func() {
-				errs <- jobProcess(
-					ctx,
-					pipeR,
-					pktName,
-					les,
-					&areaNode,
-					nice,
-					uint64(pktSizeWithoutEnc(int64(pktSize))),
-					"",
-					decompressor,
-					dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK,
-				)
-			}()
-			_, _, _, err = PktEncRead(
-				&areaNodeOur,
-				ctx.Neigh,
-				fullPipeR,
-				pipeW,
-				signatureVerify,
-				nil,
-			)
+			via := node.Via[:len(node.Via)-1]
+			node = ctx.Neigh[*node.Via[len(node.Via)-1]]
+			node = &Node{Id: node.Id, Via: via, ExchPub: node.ExchPub}
+			pktTrns, err := NewPkt(PktTypeTrns, 0, nodeId[:])
 			if err != nil {
-				ctx.LogE("rx-area-pkt-enc-read2", les, err, logMsg)
-				pipeW.CloseWithError(err)
-				<-errs
+				ctx.LogE("rx", les, err, logMsg)
+				refund()
 				return err
 			}
-			pipeW.Close()
-			if err = <-errs; err != nil {
+			if _, err = ctx.TxContext(
+				cctx,
+				node,
+				pktTrns,
+				job.Nice,
+				int64(job.Size), 0, MaxFileSize,
+				job.R,
+				job.PktName,
+				nil,
+			); err != nil {
+				ctx.LogE("rx", les, err, func(les LEs) string {
+					return logMsg(les) + ": txing"
+				})
+				refund()
 				return err
 			}
 		}
+	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		return fmt.Sprintf(
+			"Got transitional packet from %s to %s (%s)",
+			job.Sender.Name,
+			ctx.NodeName(&nodeId),
+			humanize.IBytes(job.Size),
+		)
+	})
+	return ctx.TossJobRemove(job)
+}
+
+// Default PktTypeArea handler: echoes the message to area's subscribers
+// and tosses it, if area's private key is known.
+func tossArea(ctx *Ctx, cctx context.Context, job *TossJob) error {
+	var err error
+	les := job.LEs
+
+	areaId := new(AreaId)
+	copy(areaId[:], job.Pkt.Path[:int(job.Pkt.PathLen)])
+	les = append(les, LE{"Type", "area"}, LE{"Area", areaId})
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf(
+			"Tossing %s/%s (%s): area %s",
+			job.Sender.Name, job.PktName,
+			humanize.IBytes(job.Size),
+			ctx.AreaName(areaId),
+		)
+	}
+	area := ctx.AreaId2Area[*areaId]
+	if area == nil {
+		err = UnknownArea
+		ctx.LogE("rx-area-unknown", les, err, logMsg)
+		return err
+	}
+	pktEnc, pktEncRaw, err := ctx.HdrRead(job.R)
+	fullPipeR := io.MultiReader(bytes.NewReader(pktEncRaw), job.R)
+	if err != nil {
+		ctx.LogE("rx-area-job.Pkt-enc-read", les, err, logMsg)
+		return err
+	}
+	msgHashRaw := blake2b.Sum256(pktEncRaw)
+	msgHash := Base32Codec.EncodeToString(msgHashRaw[:])
+	les = append(les, LE{"AreaMsg", msgHash})
+	ctx.LogD("rx-area", les, logMsg)
 
-		if !dryRun && jobPath != "" {
+	if job.DryRun {
+		for _, nodeId := range area.Subs {
+			node := ctx.Neigh[*nodeId]
+			lesEcho := append(les, LE{"Echo", nodeId})
+			seenDir := filepath.Join(
+				ctx.Spool, nodeId.String(), AreaDir, area.Id.String(),
+			)
+			seenPath := filepath.Join(seenDir, msgHash)
+			logMsgNode := func(les LEs) string {
+				return fmt.Sprintf(
+					"%s: echoing to: %s", logMsg(les), node.Name,
+				)
+			}
+			if _, err := os.Stat(seenPath); err == nil {
+				ctx.LogD("rx-area-echo-seen", lesEcho, func(les LEs) string {
+					return logMsgNode(les) + ": already sent"
+				})
+				continue
+			}
+			ctx.LogI("rx-area-echo", lesEcho, logMsgNode)
+		}
+	} else {
+		for _, nodeId := range area.Subs {
+			node := ctx.Neigh[*nodeId]
+			lesEcho := append(les, LE{"Echo", nodeId})
+			seenDir := filepath.Join(
+				ctx.Spool, nodeId.String(), AreaDir, area.Id.String(),
+			)
+			seenPath := filepath.Join(seenDir, msgHash)
+			logMsgNode := func(les LEs) string {
+				return fmt.Sprintf("%s: echo to: %s", logMsg(les), node.Name)
+			}
+			if _, err := os.Stat(seenPath); err == nil {
+				ctx.LogD("rx-area-echo-seen", lesEcho, func(les LEs) string {
+					return logMsgNode(les) + ": already sent"
+				})
+				continue
+			}
+			if nodeId != job.Sender.Id && nodeId != pktEnc.Sender {
+				ctx.LogI("rx-area-echo", lesEcho, logMsgNode)
+				if _, err = ctx.TxContext(
+					cctx,
+					node,
+					job.Pkt,
+					job.Nice,
+					int64(job.Size), 0, MaxFileSize,
+					fullPipeR,
+					job.PktName,
+					nil,
+				); err != nil {
+					ctx.LogE("rx-area", lesEcho, err, logMsgNode)
+					return err
+				}
+			}
 			if err = os.MkdirAll(seenDir, os.FileMode(0777)); err != nil {
-				ctx.LogE("rx-area-mkdir", les, err, logMsg)
+				ctx.LogE("rx-area-mkdir", lesEcho, err, logMsgNode)
 				return err
 			}
 			if fd, err := os.Create(seenPath); err == nil {
 				fd.Close()
 				if err = DirSync(seenDir); err != nil {
-					ctx.LogE("rx-area-dirsync", les, err, logMsg)
+					ctx.LogE("rx-area-dirsync", les, err, logMsgNode)
 					return err
 				}
+			} else {
+				ctx.LogE("rx-area-touch", lesEcho, err, logMsgNode)
+				return err
 			}
-			if err = os.Remove(jobPath); err != nil {
-				ctx.LogE("rx", les, err, func(les LEs) string {
-					return fmt.Sprintf(
-						"Tossing area %s/%s (%s): %s: removing",
-						sender.Name, pktName,
-						humanize.IBytes(pktSize),
-						msgHash,
-					)
-				})
+			return JobRepeatProcess
+		}
+	}
+
+	seenDir := filepath.Join(
+		ctx.Spool, ctx.SelfId.String(), AreaDir, area.Id.String(),
+	)
+	seenPath := filepath.Join(seenDir, msgHash)
+	if _, err := os.Stat(seenPath); err == nil {
+		ctx.LogD("rx-area-seen", les, func(les LEs) string {
+			return logMsg(les) + ": already seen"
+		})
+		return ctx.TossJobRemove(job)
+	}
+
+	if area.Prv == nil {
+		ctx.LogD("rx-area-no-prv", les, func(les LEs) string {
+			return logMsg(les) + ": no private key for decoding"
+		})
+	} else {
+		signatureVerify := true
+		if _, senderKnown := ctx.Neigh[*pktEnc.Sender]; !senderKnown {
+			if !area.AllowUnknown {
+				err = UnknownSender
+				ctx.LogE(
+					"rx-area-unknown",
+					append(les, LE{"Sender", pktEnc.Sender}),
+					err,
+					func(les LEs) string {
+						return logMsg(les) + ": job.Sender: " + pktEnc.Sender.String()
+					},
+				)
 				return err
-			} else if ctx.HdrUsage {
-				os.Remove(JobPath2Hdr(jobPath))
 			}
+			signatureVerify = false
+		}
+		areaNodeOur := NodeOur{Id: new(NodeId), ExchPrv: new([32]byte)}
+		copy(areaNodeOur.Id[:], area.Id[:])
+		copy(areaNodeOur.ExchPrv[:], area.Prv[:])
+		areaNode := Node{
+			Id:       new(NodeId),
+			Name:     area.Name,
+			Incoming: area.Incoming,
+			Exec:     area.Exec,
 		}
+		copy(areaNode.Id[:], area.Id[:])
+		areaPktName := fmt.Sprintf(
+			"area/%s/%s",
+			Base32Codec.EncodeToString(areaId[:]), msgHash,
+		)
 
-	case PktTypeACK:
-		if noACK {
-			return nil
+		areaPipeR, pipeW := io.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- jobProcess(
+				ctx,
+				cctx,
+				areaPipeR,
+				areaPktName,
+				les,
+				&areaNode,
+				job.Nice,
+				uint64(pktSizeWithoutEnc(pktEnc, int64(job.Size))),
+				"",
+				nil,
+				job.decompressor,
+				job.DryRun, job.DoSeen,
+				job.NoFile, job.NoFreq, job.NoExec,
+				job.NoTrns, job.NoArea, job.NoACK,
+			)
+		}()
+		_, _, _, err = PktEncRead(
+			&areaNodeOur,
+			ctx.Neigh,
+			fullPipeR,
+			pipeW,
+			signatureVerify,
+			nil,
+		)
+		if err != nil {
+			ctx.LogE("rx-area-job.Pkt-enc-read2", les, err, logMsg)
+			pipeW.CloseWithError(err)
+			<-errs
+			return err
 		}
-		hsh := Base32Codec.EncodeToString(pkt.Path[:MTHSize])
-		les := append(les, LE{"Type", "ack"}, LE{"Pkt", hsh})
-		logMsg := func(les LEs) string {
-			return fmt.Sprintf("Tossing ack %s/%s: %s", sender.Name, pktName, hsh)
+		pipeW.Close()
+		if err = <-errs; err != nil {
+			return err
 		}
-		ctx.LogD("rx-ack", les, logMsg)
-		pktPath := filepath.Join(ctx.Spool, sender.Id.String(), string(TTx), hsh)
-		if _, err := os.Stat(pktPath); err == nil {
-			if !dryRun {
-				if err = os.Remove(pktPath); err != nil {
-					ctx.LogE("rx-ack", les, err, func(les LEs) string {
-						return logMsg(les) + ": removing packet"
-					})
-					return err
-				} else if ctx.HdrUsage {
-					os.Remove(JobPath2Hdr(pktPath))
-				}
-			}
-		} else {
-			ctx.LogD("rx-ack", les, func(les LEs) string {
-				return logMsg(les) + ": already disappeared"
-			})
+	}
+
+	if !job.DryRun && job.Path != "" {
+		if err = os.MkdirAll(seenDir, os.FileMode(0777)); err != nil {
+			ctx.LogE("rx-area-mkdir", les, err, logMsg)
+			return err
 		}
-		if !dryRun && doSeen {
-			if err := ensureDir(filepath.Dir(jobPath), SeenDir); err != nil {
+		if fd, err := os.Create(seenPath); err == nil {
+			fd.Close()
+			if err = DirSync(seenDir); err != nil {
+				ctx.LogE("rx-area-dirsync", les, err, logMsg)
 				return err
 			}
-			if fd, err := os.Create(jobPath2Seen(jobPath)); err == nil {
-				fd.Close()
-				if err = DirSync(filepath.Dir(jobPath)); err != nil {
-					ctx.LogE("rx-dirsync", les, err, func(les LEs) string {
-						return fmt.Sprintf(
-							"Tossing file %s/%s (%s): %s: dirsyncing",
-							sender.Name, pktName,
-							humanize.IBytes(pktSize),
-							filepath.Base(jobPath),
-						)
-					})
-					return err
-				}
-			}
 		}
-		if !dryRun {
-			if err = os.Remove(jobPath); err != nil {
-				ctx.LogE("rx", les, err, func(les LEs) string {
-					return logMsg(les) + ": removing job"
+	}
+	return ctx.TossJobRemove(job)
+}
+
+// Default PktTypeACK handler: removes the acknowledged outbound packet.
+func tossACK(ctx *Ctx, _ context.Context, job *TossJob) error {
+	var err error
+	les := job.LEs
+
+	hsh := Base32Codec.EncodeToString(job.Pkt.Path[:MTHSize])
+	les = append(les, LE{"Type", "ack"}, LE{"Pkt", hsh})
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf("Tossing ack %s/%s: %s", job.Sender.Name, job.PktName, hsh)
+	}
+	ctx.LogD("rx-ack", les, logMsg)
+	pktPath := filepath.Join(ctx.Spool, job.Sender.Id.String(), string(TTx), hsh)
+	if _, err := os.Stat(pktPath); err == nil {
+		if !job.DryRun {
+			if err = os.Remove(pktPath); err != nil {
+				ctx.LogE("rx-ack", les, err, func(les LEs) string {
+					return logMsg(les) + ": removing packet"
 				})
 				return err
 			} else if ctx.HdrUsage {
-				os.Remove(JobPath2Hdr(jobPath))
+				os.Remove(JobPath2Hdr(pktPath))
 			}
 		}
-		ctx.LogI("rx", les, func(les LEs) string {
-			return fmt.Sprintf("Got ACK packet from %s of %s", sender.Name, hsh)
+	} else {
+		ctx.LogD("rx-ack", les, func(les LEs) string {
+			return logMsg(les) + ": already disappeared"
 		})
-
-	default:
-		err = errors.New("unknown type")
-		ctx.LogE(
-			"rx-type-unknown", les, err,
-			func(les LEs) string {
-				return fmt.Sprintf(
-					"Tossing %s/%s (%s)",
-					sender.Name, pktName, humanize.IBytes(pktSize),
-				)
-			},
-		)
+	}
+	if !job.DryRun {
+		sentPath := filepath.Join(ctx.Spool, job.Sender.Id.String(), SentDir, hsh)
+		if err = os.Remove(sentPath); err == nil {
+			ctx.LogD("rx-ack", les, func(les LEs) string {
+				return logMsg(les) + ": removed from sent"
+			})
+		} else if !os.IsNotExist(err) {
+			ctx.LogE("rx-ack", les, err, func(les LEs) string {
+				return logMsg(les) + ": removing sent packet"
+			})
+			return err
+		}
+		ctx.TrackACKed(job.Sender.Id, hsh)
+	}
+	if err = ctx.TossJobRemove(job); err != nil {
 		return err
 	}
+	ctx.LogI("rx", les, func(les LEs) string {
+		return fmt.Sprintf("Got ACK packet from %s of %s", job.Sender.Name, hsh)
+	})
 	return nil
 }
 
@@ -990,19 +1113,54 @@ func (ctx *Ctx) Toss(
 	nice uint8,
 	dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK bool,
 ) bool {
+	results, _ := ctx.TossContext(
+		context.Background(),
+		nodeId, xx, nice,
+		dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK,
+	)
+	for _, result := range results {
+		if result.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Toss node's packets, returning the outcome of each processed one.
+// Error is returned if tossing can not be started at all (for example
+// someone else already tosses that node), or if cctx is done.
+func (ctx *Ctx) TossContext(
+	cctx context.Context,
+	nodeId *NodeId,
+	xx TRxTx,
+	nice uint8,
+	dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK bool,
+) ([]*TossResult, error) {
 	dirLock, err := ctx.LockDir(nodeId, "toss")
 	if err != nil {
-		return false
+		return nil, err
 	}
 	defer ctx.UnlockDir(dirLock)
-	isBad := false
+	var results []*TossResult
 	decompressor, err := zstd.NewReader(nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer decompressor.Close()
-	for job := range ctx.Jobs(nodeId, xx) {
+	jobs := ctx.Jobs(nodeId, xx)
+	for job := range jobs {
+		if err = cctx.Err(); err != nil {
+			// Drain the jobs, to let their finder finish
+			for range jobs {
+			}
+			return results, err
+		}
 		pktName := filepath.Base(job.Path)
+		result := &TossResult{
+			Pkt:    pktName,
+			Sender: job.PktEnc.Sender,
+			Nice:   job.PktEnc.Nice,
+		}
 		les := LEs{
 			{"Node", job.PktEnc.Sender},
 			{"Pkt", pktName},
@@ -1026,19 +1184,22 @@ func (ctx *Ctx) Toss(
 					ctx.NodeName(job.PktEnc.Sender), pktName, job.Path,
 				)
 			})
-			isBad = true
+			result.Err = err
+			results = append(results, result)
 			continue
 		}
 		sender := ctx.Neigh[*job.PktEnc.Sender]
 		if sender == nil {
-			err := errors.New("unknown node")
+			err := UnknownNode
 			ctx.LogE("rx-open", les, err, func(les LEs) string {
 				return fmt.Sprintf(
 					"Tossing %s/%s",
 					ctx.NodeName(job.PktEnc.Sender), pktName,
 				)
 			})
-			isBad = true
+			fd.Close()
+			result.Err = err
+			results = append(results, result)
 			continue
 		}
 		errs := make(chan error, 1)
@@ -1048,13 +1209,15 @@ func (ctx *Ctx) Toss(
 		go func() {
 			errs <- jobProcess(
 				ctx,
+				cctx,
 				pipeR,
 				pktName,
 				les,
 				sender,
 				job.PktEnc.Nice,
-				uint64(pktSizeWithoutEnc(job.Size)),
+				uint64(pktSizeWithoutEnc(job.PktEnc, job.Size)),
 				job.Path,
+				job.PktEnc,
 				decompressor,
 				dryRun, doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK,
 			)
@@ -1063,7 +1226,7 @@ func (ctx *Ctx) Toss(
 		sharedKey, _, _, err = PktEncRead(
 			ctx.Self,
 			ctx.Neigh,
-			bufio.NewReaderSize(fd, MTHBlockSize),
+			bufio.NewReaderSize(contextReader{cctx, fd}, MTHBlockSize),
 			pipeWB,
 			sharedKey == nil,
 			sharedKey,
@@ -1077,9 +1240,12 @@ func (ctx *Ctx) Toss(
 		pipeW.Close()
 
 		if err != nil {
-			isBad = true
 			fd.Close()
-			<-errs
+			if jobErr := <-errs; jobErr != nil {
+				err = jobErr
+			}
+			result.Err = err
+			results = append(results, result)
 			continue
 		}
 		if err = <-errs; err == JobRepeatProcess {
@@ -1091,29 +1257,31 @@ func (ctx *Ctx) Toss(
 						pktName,
 					)
 				})
-				isBad = true
+				fd.Close()
+				result.Err = err
+				results = append(results, result)
 				break
 			}
 			goto Retry
-		} else if err != nil {
-			isBad = true
 		}
 		fd.Close()
+		result.Err = err
+		results = append(results, result)
 	}
-	return isBad
+	return results, cctx.Err()
 }
 
 func (ctx *Ctx) AutoToss(
 	nodeId *NodeId,
 	nice uint8,
 	doSeen, noFile, noFreq, noExec, noTrns, noArea, noACK bool,
-) (chan struct{}, chan bool) {
+) (chan struct{}, chan bool, error) {
 	dw, err := ctx.NewDirWatcher(
 		filepath.Join(ctx.Spool, nodeId.String(), string(TRx)),
 		time.Second,
 	)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, nil, err
 	}
 	finish := make(chan struct{})
 	badCode := make(chan bool)
@@ -1132,5 +1300,5 @@ func (ctx *Ctx) AutoToss(
 			}
 		}
 	}()
-	return finish, badCode
+	return finish, badCode, nil
 }
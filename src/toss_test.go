@@ -19,6 +19,7 @@ package nncp
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
@@ -27,8 +28,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
+	"time"
 
 	xdr "github.com/davecgh/go-xdr/xdr2"
 )
@@ -157,6 +161,248 @@ func TestTossExec(t *testing.T) {
 	}
 }
 
+func TestTossHandler(t *testing.T) {
+	f := func(handleRaw uint32, data []byte) bool {
+		handle := strconv.Itoa(int(handleRaw))
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeTgt, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+		if err := ctx.TxExec(
+			ctx.Neigh[*nodeTgt.Id],
+			DefaultNiceExec,
+			DefaultNiceExec,
+			handle,
+			[]string{"arg0"},
+			bytes.NewReader(data),
+			1<<15, MaxFileSize,
+			true,
+			nil,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx.Self = nodeTgt
+		rxPath := filepath.Join(spool, ctx.Self.Id.String(), string(TRx))
+		os.Rename(filepath.Join(spool, ctx.Self.Id.String(), string(TTx)), rxPath)
+		var got bytes.Buffer
+		var gotPath []byte
+		ctx.SetTossHandler(PktTypeExecFat, TossHandlerFunc(
+			func(ctx *Ctx, _ context.Context, job *TossJob) error {
+				gotPath = job.Pkt.Path[:job.Pkt.PathLen]
+				if _, err := io.Copy(&got, job.R); err != nil {
+					return err
+				}
+				return ctx.TossJobRemove(job)
+			},
+		))
+		if ctx.Toss(ctx.Self.Id, TRx, DefaultNiceExec,
+			false, false, false, false, false, false, false, false) {
+			return false
+		}
+		if len(dirFiles(rxPath)) != 0 {
+			return false
+		}
+		if bytes.Compare(gotPath, []byte(handle+"\x00arg0")) != 0 {
+			return false
+		}
+		return bytes.Compare(got.Bytes(), data) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTossReceipt(t *testing.T) {
+	f := func(nice uint8) bool {
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeTgt, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		ctx.Neigh[*nodeOur.Id].Receipt = true
+		ctx.Neigh[*nodeOur.Id].Exec = map[string][]string{
+			"sink": {"/bin/sh", "-c", "cat >/dev/null"},
+		}
+		ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+		ctx.Neigh[*nodeTgt.Id].Receipt = true
+		if err := ctx.TxExec(
+			ctx.Neigh[*nodeTgt.Id],
+			nice, nice,
+			"sink", nil,
+			strings.NewReader("BODY\n"),
+			1<<15, MaxFileSize,
+			false,
+			nil,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		receipts, err := ctx.Receipts(nodeTgt.Id)
+		if err != nil || len(receipts) != 1 || receipts[0].Delivered != nil {
+			return false
+		}
+
+		ctx.Self = nodeTgt
+		rxPath := filepath.Join(spool, nodeTgt.Id.String(), string(TRx))
+		os.Rename(filepath.Join(spool, nodeTgt.Id.String(), string(TTx)), rxPath)
+		if ctx.Toss(nodeTgt.Id, TRx, nice,
+			false, false, false, false, false, false, false, false) {
+			return false
+		}
+
+		ctx.Self = nodeOur
+		rxPath = filepath.Join(spool, nodeTgt.Id.String(), string(TRx))
+		os.RemoveAll(rxPath)
+		os.Rename(filepath.Join(spool, nodeOur.Id.String(), string(TTx)), rxPath)
+		if len(dirFiles(rxPath)) != 1 {
+			return false
+		}
+		if ctx.Toss(nodeTgt.Id, TRx, nice,
+			false, false, false, false, false, false, false, false) {
+			return false
+		}
+		if len(dirFiles(rxPath)) != 0 {
+			return false
+		}
+		receipts, err = ctx.Receipts(nodeTgt.Id)
+		return err == nil && len(receipts) == 1 && receipts[0].Delivered != nil
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTossTrack(t *testing.T) {
+	f := func(nice uint8) bool {
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeTgt, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+		if err := ctx.TxExec(
+			ctx.Neigh[*nodeTgt.Id],
+			nice, nice,
+			"sink", nil,
+			strings.NewReader("BODY\n"),
+			1<<15, MaxFileSize,
+			false,
+			nil,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		tracks, err := ctx.Tracks(nodeTgt.Id)
+		if err != nil || len(tracks) != 1 || !tracks[0].InFlight() {
+			return false
+		}
+		if tracks[0].Transmitted != nil ||
+			*tracks[0].Hop != *nodeTgt.Id || tracks[0].HopPkt != tracks[0].Pkt {
+			return false
+		}
+		pktName := tracks[0].Pkt
+		ctx.TrackTransmitted(nodeTgt.Id, pktName)
+
+		ctx.Self = nodeTgt
+		if _, err = ctx.TxACK(ctx.Neigh[*nodeOur.Id], nice, pktName, 0); err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx.Self = nodeOur
+		if tracks, err = ctx.Tracks(nodeOur.Id); err != nil || len(tracks) != 0 {
+			// Service packets are not tracked
+			return false
+		}
+		rxPath := filepath.Join(spool, nodeTgt.Id.String(), string(TRx))
+		os.Rename(filepath.Join(spool, nodeOur.Id.String(), string(TTx)), rxPath)
+		if ctx.Toss(nodeTgt.Id, TRx, nice,
+			false, false, false, false, false, false, false, false) {
+			return false
+		}
+		if len(dirFiles(filepath.Join(spool, nodeTgt.Id.String(), string(TTx)))) != 0 {
+			return false
+		}
+		tracks, err = ctx.Tracks(nodeTgt.Id)
+		if err != nil || len(tracks) != 1 || tracks[0].InFlight() {
+			return false
+		}
+		if tracks[0].Transmitted == nil || tracks[0].Pkt != pktName {
+			return false
+		}
+		if err = ctx.TrackRemove(tracks[0]); err != nil {
+			return false
+		}
+		tracks, err = ctx.Tracks(nodeTgt.Id)
+		return err == nil && len(tracks) == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestTossFile(t *testing.T) {
 	f := func(fileSizes []uint8) bool {
 		if len(fileSizes) == 0 {
@@ -485,7 +731,7 @@ func TestTossTrns(t *testing.T) {
 				ctx.Self,
 				ctx.Neigh[*nodeOur.Id],
 				&pktTrans,
-				123,
+				123, 0,
 				0, MaxFileSize, 1,
 				bytes.NewReader(data),
 				&dst,
@@ -528,3 +774,361 @@ func TestTossTrns(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTossTrnsExpired(t *testing.T) {
+	f := func(data []byte, expired bool) bool {
+		data = append(data, 0)
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		rxPath := filepath.Join(spool, ctx.Self.Id.String(), string(TRx))
+		os.MkdirAll(rxPath, os.FileMode(0700))
+		txPath := filepath.Join(spool, ctx.Self.Id.String(), string(TTx))
+		os.MkdirAll(txPath, os.FileMode(0700))
+		pktTrans := Pkt{
+			Magic:   MagicNNCPPv3.B,
+			Type:    PktTypeTrns,
+			PathLen: MTHSize,
+		}
+		copy(pktTrans.Path[:], nodeOur.Id[:])
+		expire := uint64(time.Now().Add(time.Hour).Unix())
+		if expired {
+			expire = uint64(time.Now().Add(-time.Hour).Unix())
+		}
+		var dst bytes.Buffer
+		if _, _, err := PktEncWrite(
+			ctx.Self,
+			ctx.Neigh[*nodeOur.Id],
+			&pktTrans,
+			123, expire,
+			0, MaxFileSize, 1,
+			bytes.NewReader(data),
+			&dst,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		hasher := MTHNew(0, 0)
+		hasher.Write(dst.Bytes())
+		if err := ioutil.WriteFile(
+			filepath.Join(rxPath, Base32Codec.EncodeToString(hasher.Sum(nil))),
+			dst.Bytes(),
+			os.FileMode(0600),
+		); err != nil {
+			panic(err)
+		}
+		isBad := ctx.Toss(ctx.Self.Id, TRx, 123,
+			false, false, false, false, false, false, false, false)
+		if isBad != expired || len(dirFiles(rxPath)) != 0 {
+			return false
+		}
+		if expired {
+			return len(dirFiles(txPath)) == 0
+		}
+		return len(dirFiles(txPath)) == 1
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTossTrnsTransit(t *testing.T) {
+	f := func(data []byte, mode uint8) bool {
+		// Must exceed MaxSize below
+		data = append(data, 0, 0)
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		node := nodeOur.Their()
+		ctx.Neigh[*nodeOur.Id] = node
+		allowed, kept := true, false
+		switch mode % 6 {
+		case 0:
+			node.Transit = &Transit{
+				Dsts: map[NodeId]struct{}{*nodeOur.Id: {}},
+				Nice: 255,
+			}
+		case 1:
+			node.Transit = &Transit{Dsts: map[NodeId]struct{}{}, Nice: 255}
+			allowed = false
+		case 2:
+			node.Transit = &Transit{Nice: 100}
+			allowed = false
+		case 3:
+			node.Transit = &Transit{MaxSize: 1, Nice: 255}
+			allowed = false
+		case 4:
+			node.Transit = &Transit{Daily: 1 << 20, Nice: 255}
+		case 5:
+			node.Transit = &Transit{Daily: 1, Nice: 255}
+			allowed, kept = false, true
+		}
+		rxPath := filepath.Join(spool, ctx.Self.Id.String(), string(TRx))
+		os.MkdirAll(rxPath, os.FileMode(0700))
+		txPath := filepath.Join(spool, ctx.Self.Id.String(), string(TTx))
+		os.MkdirAll(txPath, os.FileMode(0700))
+		pktTrans := Pkt{
+			Magic:   MagicNNCPPv3.B,
+			Type:    PktTypeTrns,
+			PathLen: MTHSize,
+		}
+		copy(pktTrans.Path[:], nodeOur.Id[:])
+		var dst bytes.Buffer
+		if _, _, err := PktEncWrite(
+			ctx.Self,
+			node,
+			&pktTrans,
+			123, 0,
+			0, MaxFileSize, 1,
+			bytes.NewReader(data),
+			&dst,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		hasher := MTHNew(0, 0)
+		hasher.Write(dst.Bytes())
+		if err := ioutil.WriteFile(
+			filepath.Join(rxPath, Base32Codec.EncodeToString(hasher.Sum(nil))),
+			dst.Bytes(),
+			os.FileMode(0600),
+		); err != nil {
+			panic(err)
+		}
+		isBad := ctx.Toss(ctx.Self.Id, TRx, 123,
+			false, false, false, false, false, false, false, false)
+		if kept {
+			// Exhausted budget can be replenished later
+			return isBad && len(dirFiles(rxPath)) == 1 && len(dirFiles(txPath)) == 0
+		}
+		if !allowed {
+			// Policy violation is permanent, so the packet is dropped
+			return isBad && len(dirFiles(rxPath)) == 0 && len(dirFiles(txPath)) == 0
+		}
+		if isBad || len(dirFiles(rxPath)) != 0 || len(dirFiles(txPath)) != 1 {
+			return false
+		}
+		spent, err := ctx.transitSpent(nodeOur.Id)
+		if err != nil {
+			return false
+		}
+		if node.Transit.Daily > 0 {
+			return spent > 0
+		}
+		return spent == 0
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransitSpendConcurrent(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testtransit")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{Spool: spool, Self: nodeOur, SelfId: nodeOur.Id}
+	node := nodeOur.Their()
+	node.Transit = &Transit{Daily: 10, Nice: 255}
+	if err = os.MkdirAll(filepath.Join(spool, nodeOur.Id.String()), os.FileMode(0700)); err != nil {
+		t.Fatal(err)
+	}
+	var spent int32
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctx.transitSpend(node, 1); err == nil {
+				atomic.AddInt32(&spent, 1)
+			} else if err != TransitBudget {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if spent != 10 {
+		t.Fatal("budget is exceeded:", spent)
+	}
+	if got, err := ctx.transitSpent(nodeOur.Id); err != nil || got != 10 {
+		t.Fatal("lost update:", got, err)
+	}
+	if err = ctx.transitSpend(node, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err = ctx.transitSpend(node, 1); err != nil {
+		t.Fatal("refunded budget is not available:", err)
+	}
+}
+
+func TestTransitCfgDsts(t *testing.T) {
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTgt, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeJSON := func(node *NodeOur) NodeJSON {
+		return NodeJSON{
+			Id:      node.Id.String(),
+			ExchPub: Base32Codec.EncodeToString(node.ExchPub[:]),
+			SignPub: Base32Codec.EncodeToString(node.SignPub[:]),
+		}
+	}
+	for dsts, allowed := range map[string]bool{"": true, "[]": false, "[tgt]": true} {
+		tgt := nodeJSON(nodeTgt)
+		if dsts != "" {
+			tgt.Transit = &NodeTransitJSON{Dsts: []string{}}
+			if dsts == "[tgt]" {
+				tgt.Transit.Dsts = []string{"tgt"}
+			}
+		} else {
+			tgt.Transit = &NodeTransitJSON{}
+		}
+		ctx, err := Cfg2Ctx(&CfgJSON{
+			Spool: "/spool",
+			Log:   "/log",
+			Neigh: map[string]NodeJSON{"self": nodeJSON(nodeOur), "tgt": tgt},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ctx.TransitAllowed(ctx.Neigh[*nodeTgt.Id], nodeTgt.Id, 1, 1)
+		if (err == nil) != allowed {
+			t.Fatal("unexpected transit policy of dsts", dsts, err)
+		}
+	}
+}
+
+func TestTossTrnsViaQuota(t *testing.T) {
+	f := func(data []byte, full bool) bool {
+		spool, err := ioutil.TempDir("", "testtoss")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeHop, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeDst, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		node := nodeOur.Their()
+		ctx.Neigh[*nodeOur.Id] = node
+		hop := nodeHop.Their()
+		hop.Quota.TxPkts = 2
+		ctx.Neigh[*nodeHop.Id] = hop
+		dstNode := nodeDst.Their()
+		dstNode.Via = []*NodeId{nodeHop.Id}
+		ctx.Neigh[*nodeDst.Id] = dstNode
+		rxPath := filepath.Join(spool, ctx.Self.Id.String(), string(TRx))
+		os.MkdirAll(rxPath, os.FileMode(0700))
+		hopTxPath := filepath.Join(spool, nodeHop.Id.String(), string(TTx))
+		os.MkdirAll(hopTxPath, os.FileMode(0700))
+		queued := 1
+		if full {
+			queued = 2
+		}
+		for i := 0; i < queued; i++ {
+			if err = ctx.TxTrns(hop, 123, 1, bytes.NewReader([]byte{byte(i)})); err != nil {
+				t.Error(err)
+				return false
+			}
+		}
+		pktTrans := Pkt{
+			Magic:   MagicNNCPPv3.B,
+			Type:    PktTypeTrns,
+			PathLen: MTHSize,
+		}
+		copy(pktTrans.Path[:], nodeDst.Id[:])
+		var dst bytes.Buffer
+		if _, _, err := PktEncWrite(
+			ctx.Self,
+			node,
+			&pktTrans,
+			123, 0,
+			0, MaxFileSize, 1,
+			bytes.NewReader(data),
+			&dst,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		hasher := MTHNew(0, 0)
+		hasher.Write(dst.Bytes())
+		if err := ioutil.WriteFile(
+			filepath.Join(rxPath, Base32Codec.EncodeToString(hasher.Sum(nil))),
+			dst.Bytes(),
+			os.FileMode(0600),
+		); err != nil {
+			panic(err)
+		}
+		isBad := ctx.Toss(ctx.Self.Id, TRx, 123,
+			false, false, false, false, false, false, false, false)
+		if full {
+			return isBad && len(dirFiles(rxPath)) == 1 && len(dirFiles(hopTxPath)) == 2
+		}
+		return !isBad && len(dirFiles(rxPath)) == 0 && len(dirFiles(hopTxPath)) == 2
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.cypherpunks.ru/recfile"
+)
+
+const TrackDir = "track"
+
+// State of the outbound packet created by us. It is stored in the
+// spool of its destination node under the name of the packet the
+// destination receives and acknowledges. Multi-hop packet is queued for
+// the first hop under another name, so hop's spool contains the symbolic
+// link to the state under that name.
+type Track struct {
+	Node        *NodeId // destination node
+	Pkt         string  // packet's name at the destination
+	Hop         *NodeId // node the packet is queued for
+	HopPkt      string  // packet's name in the hop's outbound queue
+	Type        string
+	Path        string
+	Size        int64
+	Nice        uint8
+	Created     time.Time
+	Transmitted *time.Time
+	Delivered   *time.Time
+	ACKed       *time.Time
+	Resends     int
+}
+
+// Packet is in flight until it is either sent online (with the
+// confirmation of its receipt) or acknowledged.
+func (t *Track) InFlight() bool {
+	return t.ACKed == nil && t.Delivered == nil
+}
+
+func (t *Track) fields() []recfile.Field {
+	fields := []recfile.Field{
+		{Name: "Pkt", Value: t.Pkt},
+		{Name: "Type", Value: t.Type},
+		{Name: "Path", Value: t.Path},
+		{Name: "Size", Value: strconv.FormatInt(t.Size, 10)},
+		{Name: "Nice", Value: strconv.Itoa(int(t.Nice))},
+		recTime("Created", t.Created),
+	}
+	if t.HopPkt != t.Pkt {
+		fields = append(fields,
+			recfile.Field{Name: "Hop", Value: t.Hop.String()},
+			recfile.Field{Name: "HopPkt", Value: t.HopPkt},
+		)
+	}
+	if t.Transmitted != nil {
+		fields = append(fields, recTime("Transmitted", *t.Transmitted))
+	}
+	if t.Delivered != nil {
+		fields = append(fields, recTime("Delivered", *t.Delivered))
+	}
+	if t.ACKed != nil {
+		fields = append(fields, recTime("ACKed", *t.ACKed))
+	}
+	if t.Resends > 0 {
+		fields = append(fields, recfile.Field{
+			Name:  "Resends",
+			Value: strconv.Itoa(t.Resends),
+		})
+	}
+	return fields
+}
+
+func (ctx *Ctx) trackPath(nodeId *NodeId, pktName string) string {
+	return filepath.Join(ctx.Spool, nodeId.String(), TrackDir, pktName)
+}
+
+func (ctx *Ctx) trackWrite(t *Track) error {
+	return recWrite(
+		filepath.Join(ctx.Spool, t.Node.String(), TrackDir), t.Pkt, t.fields(),
+	)
+}
+
+func (ctx *Ctx) trackRead(nodeId *NodeId, pktName string) (*Track, error) {
+	m, err := recRead(ctx.trackPath(nodeId, pktName))
+	if err != nil {
+		return nil, err
+	}
+	t := Track{
+		Node:   nodeId,
+		Pkt:    pktName,
+		Hop:    nodeId,
+		HopPkt: pktName,
+		Type:   m["Type"],
+		Path:   m["Path"],
+	}
+	if v, exists := m["Hop"]; exists {
+		if t.Hop, err = NodeIdFromString(v); err != nil {
+			return nil, err
+		}
+		t.HopPkt = m["HopPkt"]
+	}
+	if t.Size, err = strconv.ParseInt(m["Size"], 10, 64); err != nil {
+		return nil, err
+	}
+	nice, err := strconv.ParseUint(m["Nice"], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	t.Nice = uint8(nice)
+	if t.Created, err = recTimeParse(m, "Created"); err != nil {
+		return nil, err
+	}
+	if t.Transmitted, err = recTimeParseOpt(m, "Transmitted"); err != nil {
+		return nil, err
+	}
+	if t.Delivered, err = recTimeParseOpt(m, "Delivered"); err != nil {
+		return nil, err
+	}
+	if t.ACKed, err = recTimeParseOpt(m, "ACKed"); err != nil {
+		return nil, err
+	}
+	if v, exists := m["Resends"]; exists {
+		if t.Resends, err = strconv.Atoi(v); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// States of the packets created for the node, sorted by creation time.
+func (ctx *Ctx) Tracks(nodeId *NodeId) ([]*Track, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(ctx.Spool, nodeId.String(), TrackDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ts := make([]*Track, 0, len(fis))
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || len(fi.Name()) != Base32Codec.EncodedLen(MTHSize) {
+			// Links to the multi-hop packets' states are skipped
+			continue
+		}
+		t, err := ctx.trackRead(nodeId, fi.Name())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fi.Name(), err)
+		}
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Created.Before(ts[j].Created) })
+	return ts, nil
+}
+
+// Forget about the packet.
+func (ctx *Ctx) TrackRemove(t *Track) error {
+	if t.HopPkt != t.Pkt {
+		err := os.Remove(ctx.trackPath(t.Hop, t.HopPkt))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(ctx.trackPath(t.Node, t.Pkt)); err != nil {
+		return err
+	}
+	return DirSync(filepath.Join(ctx.Spool, t.Node.String(), TrackDir))
+}
+
+// Tracking state location of the packet queued for the node: either its
+// own one, or the one of the multi-hop packet linked to it.
+func (ctx *Ctx) trackResolve(nodeId *NodeId, pktName string) (*NodeId, string) {
+	target, err := os.Readlink(ctx.trackPath(nodeId, pktName))
+	if err != nil {
+		return nodeId, pktName
+	}
+	dstId, err := NodeIdFromString(filepath.Base(filepath.Dir(filepath.Dir(target))))
+	if err != nil {
+		return nodeId, pktName
+	}
+	return dstId, filepath.Base(target)
+}
+
+// Exclusively lock the node's tracking states for modification.
+func (ctx *Ctx) trackLock(nodeId *NodeId) (*os.File, error) {
+	if err := ensureDir(ctx.Spool, nodeId.String()); err != nil {
+		return nil, err
+	}
+	return lockFileWait(
+		filepath.Join(ctx.Spool, nodeId.String(), TrackDir) + ".lock",
+	)
+}
+
+// Start tracking the just created packet, queued for the hop. pktEnd is
+// the name of the innermost packet, received by the destination.
+func (ctx *Ctx) trackCreate(
+	hop, dst *Node,
+	pkt *Pkt,
+	nice uint8,
+	res *TxResult,
+	pktEnd string,
+) {
+	path := pkt.Path[:int(pkt.PathLen)]
+	switch pkt.Type {
+	case PktTypeExec, PktTypeExecFat:
+		path = bytes.Replace(path, []byte{0}, []byte(" "), -1)
+	case PktTypeFile, PktTypeFreq:
+	default:
+		// Only packets with user's payload are tracked, not the
+		// service (ACKs, receipts), transitional and area echo ones
+		return
+	}
+	t := Track{
+		Node:    dst.Id,
+		Pkt:     pktEnd,
+		Hop:     hop.Id,
+		HopPkt:  res.Pkt,
+		Type:    pktTypeName(pkt.Type),
+		Path:    string(path),
+		Size:    res.Size,
+		Nice:    nice,
+		Created: time.Now(),
+	}
+	les := LEs{{"Node", dst.Id}, {"Pkt", t.Pkt}}
+	logMsg := func(les LEs) string {
+		return fmt.Sprintf("Tx packet %s to %s: tracking", t.Pkt, dst.Name)
+	}
+	if err := ctx.trackWrite(&t); err != nil {
+		ctx.LogE("tx-track", les, err, logMsg)
+		return
+	}
+	if t.HopPkt == t.Pkt {
+		return
+	}
+	err := ensureDir(ctx.Spool, hop.Id.String(), TrackDir)
+	if err == nil {
+		err = os.Symlink(
+			filepath.Join("..", "..", dst.Id.String(), TrackDir, t.Pkt),
+			ctx.trackPath(hop.Id, t.HopPkt),
+		)
+	}
+	if err != nil {
+		ctx.LogE("tx-track", append(les, LE{"Hop", hop.Id}), err, logMsg)
+	}
+}
+
+// Atomically update the tracking state of the packet queued for the
+// node. Missing state is made with create, if it is not nil.
+func (ctx *Ctx) trackUpdate(
+	nodeId *NodeId,
+	pktName string,
+	create func() *Track,
+	update func(t *Track),
+) {
+	nodeId, pktName = ctx.trackResolve(nodeId, pktName)
+	les := LEs{{"Node", nodeId}, {"Pkt", pktName}}
+	logMsg := func(action string) func(les LEs) string {
+		return func(les LEs) string {
+			return fmt.Sprintf(
+				"Tracking %s/%s: %s", ctx.NodeName(nodeId), pktName, action,
+			)
+		}
+	}
+	lock, err := ctx.trackLock(nodeId)
+	if err != nil {
+		ctx.LogE("track", les, err, logMsg("locking"))
+		return
+	}
+	defer ctx.UnlockDir(lock)
+	t, err := ctx.trackRead(nodeId, pktName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.LogE("track", les, err, logMsg("reading"))
+			return
+		}
+		if create == nil {
+			return
+		}
+		t = create()
+	}
+	update(t)
+	if err = ctx.trackWrite(t); err != nil {
+		ctx.LogE("track", les, err, logMsg("writing"))
+	}
+}
+
+// Mark the tracked packet as transmitted to the node: copied to
+// nncp-xfer's directory or nncp-bundle.
+func (ctx *Ctx) TrackTransmitted(nodeId *NodeId, pktName string) {
+	ctx.trackUpdate(nodeId, pktName, nil, func(t *Track) {
+		if t.Transmitted == nil {
+			now := time.Now()
+			t.Transmitted = &now
+		}
+	})
+}
+
+// Mark the tracked packet as delivered to the node during the online
+// session: the node confirmed its receipt. Multi-hop packet is only
+// transmitted, as it is not delivered to its destination yet.
+func (ctx *Ctx) TrackDelivered(nodeId *NodeId, pktName string) {
+	ctx.trackUpdate(nodeId, pktName, nil, func(t *Track) {
+		now := time.Now()
+		if t.Transmitted == nil {
+			t.Transmitted = &now
+		}
+		if t.Delivered == nil && *t.Node == *nodeId {
+			t.Delivered = &now
+		}
+	})
+}
+
+// Mark the tracked packet as acknowledged by the node. Multi-hop packet
+// acknowledged by its hop is only transmitted.
+func (ctx *Ctx) TrackACKed(nodeId *NodeId, pktName string) {
+	ctx.trackUpdate(nodeId, pktName, nil, func(t *Track) {
+		now := time.Now()
+		if *t.Node != *nodeId {
+			if t.Transmitted == nil {
+				t.Transmitted = &now
+			}
+			return
+		}
+		if t.ACKed == nil {
+			t.ACKed = &now
+		}
+	})
+}
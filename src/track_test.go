@@ -0,0 +1,244 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	xdr "github.com/davecgh/go-xdr/xdr2"
+)
+
+func TestTrackDelivered(t *testing.T) {
+	f := func(nice uint8) bool {
+		spool, err := ioutil.TempDir("", "testtrack")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		nodeTgt, err := NewNodeGenerate()
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		ctx := Ctx{
+			Spool:   spool,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+			LogPath: filepath.Join(spool, "log.log"),
+			Debug:   TDebug,
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+		if err := ctx.TxExec(
+			ctx.Neigh[*nodeTgt.Id],
+			nice, nice,
+			"sink", nil,
+			strings.NewReader("BODY\n"),
+			1<<15, MaxFileSize,
+			false,
+			nil,
+		); err != nil {
+			t.Error(err)
+			return false
+		}
+		tracks, err := ctx.Tracks(nodeTgt.Id)
+		if err != nil || len(tracks) != 1 {
+			return false
+		}
+		pktName := tracks[0].Pkt
+		ctx.TrackTransmitted(nodeTgt.Id, pktName)
+		tracks, err = ctx.Tracks(nodeTgt.Id)
+		if err != nil || len(tracks) != 1 || !tracks[0].InFlight() {
+			return false
+		}
+		ctx.TrackDelivered(nodeTgt.Id, pktName)
+		tracks, err = ctx.Tracks(nodeTgt.Id)
+		if err != nil || len(tracks) != 1 || tracks[0].InFlight() {
+			return false
+		}
+		return tracks[0].Transmitted != nil &&
+			tracks[0].Delivered != nil &&
+			tracks[0].ACKed == nil
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTrackVia(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testtrack")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeHop, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTgt, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   make(map[NodeId]*Node),
+		Alias:   make(map[string]*NodeId),
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+	ctx.Neigh[*nodeHop.Id] = nodeHop.Their()
+	ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+	ctx.Neigh[*nodeTgt.Id].Via = []*NodeId{nodeHop.Id}
+	if err = ctx.TxExec(
+		ctx.Neigh[*nodeTgt.Id], 123, 123, "sink", nil,
+		strings.NewReader("BODY\n"), 1<<15, MaxFileSize, false, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if tracks, err := ctx.Tracks(nodeHop.Id); err != nil || len(tracks) != 0 {
+		t.Fatal("hop has its own tracking state", err)
+	}
+	tracks, err := ctx.Tracks(nodeTgt.Id)
+	if err != nil || len(tracks) != 1 {
+		t.Fatal("no destination's tracking state", err)
+	}
+	track := tracks[0]
+	txPath := filepath.Join(spool, nodeHop.Id.String(), string(TTx))
+	if *track.Hop != *nodeHop.Id || dirFiles(txPath)[0] != track.HopPkt {
+		t.Fatal("invalid hop", track.Hop, track.HopPkt)
+	}
+
+	// Destination acknowledges the innermost packet
+	fd, err := os.Open(filepath.Join(txPath, track.HopPkt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, _, _, err = PktEncRead(nodeHop, ctx.Neigh, fd, &buf, true, nil)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkt Pkt
+	if _, err = xdr.Unmarshal(&buf, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	hsh := MTHNew(0, 0)
+	hsh.Write(buf.Bytes())
+	if Base32Codec.EncodeToString(hsh.Sum(nil)) != track.Pkt {
+		t.Fatal("tracked not by the innermost packet")
+	}
+
+	ctx.TrackACKed(nodeHop.Id, track.HopPkt)
+	ctx.TrackDelivered(nodeHop.Id, track.HopPkt)
+	tracks, err = ctx.Tracks(nodeTgt.Id)
+	if err != nil || len(tracks) != 1 || !tracks[0].InFlight() {
+		t.Fatal("delivered to the hop only")
+	}
+	if tracks[0].Transmitted == nil {
+		t.Fatal("not transmitted to the hop")
+	}
+	ctx.TrackACKed(nodeTgt.Id, track.Pkt)
+	tracks, err = ctx.Tracks(nodeTgt.Id)
+	if err != nil || len(tracks) != 1 || tracks[0].InFlight() || tracks[0].ACKed == nil {
+		t.Fatal("not acknowledged by the destination")
+	}
+	if err = ctx.TrackRemove(tracks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(ctx.trackPath(nodeHop.Id, track.HopPkt)); !os.IsNotExist(err) {
+		t.Fatal("hop's link is left", err)
+	}
+}
+
+func TestTrackUpdateConcurrent(t *testing.T) {
+	spool, err := ioutil.TempDir("", "testtrack")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(spool)
+	nodeOur, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeTgt, err := NewNodeGenerate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := Ctx{
+		Spool:   spool,
+		Self:    nodeOur,
+		SelfId:  nodeOur.Id,
+		Neigh:   make(map[NodeId]*Node),
+		Alias:   make(map[string]*NodeId),
+		LogPath: filepath.Join(spool, "log.log"),
+		Debug:   TDebug,
+	}
+	ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+	ctx.Neigh[*nodeTgt.Id] = nodeTgt.Their()
+	if err = ctx.TxExec(
+		ctx.Neigh[*nodeTgt.Id], 123, 123, "sink", nil,
+		strings.NewReader("BODY\n"), 1<<15, MaxFileSize, false, nil,
+	); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := ctx.Tracks(nodeTgt.Id)
+	if err != nil || len(tracks) != 1 {
+		t.Fatal(err)
+	}
+	const updaters = 8
+	const updates = 16
+	var wg sync.WaitGroup
+	for i := 0; i < updaters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				ctx.trackUpdate(nodeTgt.Id, tracks[0].Pkt, nil, func(t *Track) {
+					t.Resends++
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	tracks, err = ctx.Tracks(nodeTgt.Id)
+	if err != nil || len(tracks) != 1 || tracks[0].Resends != updaters*updates {
+		t.Fatal("updates are lost", err)
+	}
+}
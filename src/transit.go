@@ -0,0 +1,136 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.cypherpunks.ru/recfile"
+)
+
+const TransitFile = "transit"
+
+var (
+	TransitDenied  = errors.New("transit to that node is not allowed")
+	TransitTooNice = errors.New("too nice for transit")
+	TransitBudget  = errors.New("transit daily budget is exhausted")
+)
+
+// Policy of relaying transitional packets received from the node.
+type Transit struct {
+	Dsts    map[NodeId]struct{} // allowed destinations, any if nil
+	MaxSize int64               // maximal packet size, unlimited if zero
+	Nice    uint8               // maximal accepted niceness
+	Daily   int64               // bytes allowed per day, unlimited if zero
+}
+
+func transitDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// Amount of bytes relayed from the node today.
+func (ctx *Ctx) transitSpent(nodeId *NodeId) (int64, error) {
+	m, err := recRead(filepath.Join(ctx.Spool, nodeId.String(), TransitFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if m["Day"] != transitDay(time.Now()) {
+		return 0, nil
+	}
+	return strconv.ParseInt(m["Size"], 10, 64)
+}
+
+// Check if the node's policy allows relaying the packet through us at
+// all. Unlike exhausted daily budget, violation of it is permanent.
+func (ctx *Ctx) TransitAllowed(sender *Node, dst *NodeId, nice uint8, size int64) error {
+	t := sender.Transit
+	if t == nil {
+		return nil
+	}
+	if t.Dsts != nil {
+		if _, allowed := t.Dsts[*dst]; !allowed {
+			return TransitDenied
+		}
+	}
+	if t.MaxSize > 0 && size > t.MaxSize {
+		return TooBig
+	}
+	if nice > t.Nice {
+		return TransitTooNice
+	}
+	return nil
+}
+
+// Check if the node is allowed to relay the packet through us.
+func (ctx *Ctx) TransitCheck(sender *Node, dst *NodeId, nice uint8, size int64) error {
+	if err := ctx.TransitAllowed(sender, dst, nice, size); err != nil {
+		return err
+	}
+	t := sender.Transit
+	if t != nil && t.Daily > 0 {
+		spent, err := ctx.transitSpent(sender.Id)
+		if err != nil {
+			return err
+		}
+		if spent+size > t.Daily {
+			return TransitBudget
+		}
+	}
+	return nil
+}
+
+// Account relayed packet in the node's daily transit budget, returning
+// TransitBudget if it is exhausted. Check and accounting are done under
+// the lock, so simultaneous tossers can not exceed the budget. Negative
+// size returns the bytes to the budget.
+func (ctx *Ctx) transitSpend(sender *Node, size int64) error {
+	if sender.Transit == nil || sender.Transit.Daily == 0 {
+		return nil
+	}
+	lock, err := lockFileWait(filepath.Join(
+		ctx.Spool, sender.Id.String(), TransitFile+".lock",
+	))
+	if err != nil {
+		return err
+	}
+	defer ctx.UnlockDir(lock)
+	spent, err := ctx.transitSpent(sender.Id)
+	if err != nil {
+		return err
+	}
+	if size > 0 && spent+size > sender.Transit.Daily {
+		return TransitBudget
+	}
+	if spent+size < 0 {
+		size = -spent
+	}
+	return recWrite(
+		filepath.Join(ctx.Spool, sender.Id.String()), TransitFile,
+		[]recfile.Field{
+			{Name: "Day", Value: transitDay(time.Now())},
+			{Name: "Size", Value: strconv.FormatInt(spent+size, 10)},
+		},
+	)
+}
@@ -21,6 +21,7 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -43,12 +44,39 @@ const (
 	TarExt       = ".tar"
 )
 
+var (
+	NotEnoughSpace = errors.New("is not enough space")
+	AreaNoKeys     = errors.New("area has no encryption keys")
+	NoDstPath      = errors.New("Must provide destination filename")
+	NonRelPath     = errors.New("Relative path required")
+)
+
 type PktEncWriteResult struct {
 	pktEncRaw []byte
 	size      int64
 	err       error
 }
 
+// Outcome of the packet creation: where it is queued and its name.
+type TxResult struct {
+	Node *Node  // the hop packet is placed in the outbound queue for
+	Pkt  string // packet's name (its MTH checksum) in the spool
+	Size int64  // payload size
+}
+
+// Reader failing with context's error as soon as it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 func (ctx *Ctx) Tx(
 	node *Node,
 	pkt *Pkt,
@@ -58,11 +86,34 @@ func (ctx *Ctx) Tx(
 	pktName string,
 	areaId *AreaId,
 ) (*Node, int64, string, error) {
+	res, err := ctx.TxContext(
+		context.Background(),
+		node, pkt, nice, srcSize, minSize, maxSize, src, pktName, areaId,
+	)
+	if res == nil {
+		return nil, 0, "", err
+	}
+	return res.Node, res.Size, res.Pkt, err
+}
+
+func (ctx *Ctx) TxContext(
+	cctx context.Context,
+	node *Node,
+	pkt *Pkt,
+	nice uint8,
+	srcSize, minSize, maxSize int64,
+	src io.Reader,
+	pktName string,
+	areaId *AreaId,
+) (*TxResult, error) {
 	var area *Area
 	if areaId != nil {
 		area = ctx.AreaId2Area[*areaId]
+		if area == nil {
+			return nil, UnknownArea
+		}
 		if area.Prv == nil {
-			return nil, 0, "", errors.New("area has no encryption keys")
+			return nil, AreaNoKeys
 		}
 	}
 	hops := make([]*Node, 0, 1+len(node.Via))
@@ -76,28 +127,48 @@ func (ctx *Ctx) Tx(
 	if area != nil {
 		wrappers++
 	}
+	var expire uint64
+	if node.Expire > 0 {
+		expire = uint64(time.Now().Add(node.Expire).Unix())
+	}
 	var expectedSize int64
 	if srcSize > 0 {
 		expectedSize = srcSize + PktOverhead
-		expectedSize += sizePadCalc(expectedSize, minSize, wrappers)
-		expectedSize = PktEncOverhead + sizeWithTags(expectedSize)
+		expectedSize += sizePadCalc(expectedSize, minSize, wrappers, expire)
+		expectedSize = pktEncOverhead(pktEncMagic(expire)) + sizeWithTags(expectedSize)
 		if maxSize != 0 && expectedSize > maxSize {
-			return nil, 0, "", TooBig
+			return nil, TooBig
 		}
 		if !ctx.IsEnoughSpace(expectedSize) {
-			return nil, 0, "", errors.New("is not enough space")
+			return nil, NotEnoughSpace
 		}
 	}
 	tmp, err := ctx.NewTmpFileWHash()
 	if err != nil {
-		return nil, 0, "", err
+		return nil, err
 	}
+	src = contextReader{cctx, src}
+
+	// Enough room for all encrypters and the copier, so none of them
+	// stays blocked if we return early
+	results := make(chan PktEncWriteResult, len(hops)+2)
 
-	results := make(chan PktEncWriteResult)
+	// Multi-hop packet's destination receives the innermost packet,
+	// whose name differs from the queued one
+	var pktEndHsh MTH
+	if len(hops) > 1 {
+		pktEndHsh = MTHNew(0, 0)
+	}
+	pktEndWriter := func(w io.Writer) io.Writer {
+		if pktEndHsh == nil {
+			return w
+		}
+		return io.MultiWriter(w, pktEndHsh)
+	}
 	pipeR, pipeW := io.Pipe()
-	var pipeRPrev io.Reader
+	var pipeRPrev *io.PipeReader
 	if area == nil {
-		go func(src io.Reader, dst io.WriteCloser) {
+		go func(src io.Reader, dst *io.PipeWriter) {
 			ctx.LogD("tx", LEs{
 				{"Node", hops[0].Id},
 				{"Nice", int(nice)},
@@ -111,13 +182,14 @@ func (ctx *Ctx) Tx(
 				)
 			})
 			pktEncRaw, size, err := PktEncWrite(
-				ctx.Self, hops[0], pkt, nice, minSize, maxSize, wrappers, src, dst,
+				ctx.Self, hops[0], pkt, nice, expire, minSize, maxSize, wrappers,
+				src, pktEndWriter(dst),
 			)
 			results <- PktEncWriteResult{pktEncRaw, size, err}
-			dst.Close()
+			dst.CloseWithError(err)
 		}(src, pipeW)
 	} else {
-		go func(src io.Reader, dst io.WriteCloser) {
+		go func(src io.Reader, dst *io.PipeWriter) {
 			ctx.LogD("tx", LEs{
 				{"Area", area.Id},
 				{"Nice", int(nice)},
@@ -134,18 +206,20 @@ func (ctx *Ctx) Tx(
 			copy(areaNode.Id[:], area.Id[:])
 			copy(areaNode.ExchPub[:], area.Pub[:])
 			pktEncRaw, size, err := PktEncWrite(
-				ctx.Self, &areaNode, pkt, nice, 0, maxSize, 0, src, dst,
+				ctx.Self, &areaNode, pkt, nice, expire, 0, maxSize, 0, src, dst,
 			)
 			results <- PktEncWriteResult{pktEncRaw, size, err}
-			dst.Close()
+			dst.CloseWithError(err)
 		}(src, pipeW)
+		pktArea, err := NewPkt(PktTypeArea, 0, area.Id[:])
+		if err != nil {
+			pipeR.CloseWithError(err)
+			tmp.Cancel()
+			return nil, err
+		}
 		pipeRPrev = pipeR
 		pipeR, pipeW = io.Pipe()
-		go func(src io.Reader, dst io.WriteCloser) {
-			pktArea, err := NewPkt(PktTypeArea, 0, area.Id[:])
-			if err != nil {
-				panic(err)
-			}
+		go func(src *io.PipeReader, dst *io.PipeWriter) {
 			ctx.LogD("tx", LEs{
 				{"Node", hops[0].Id},
 				{"Nice", int(nice)},
@@ -159,20 +233,24 @@ func (ctx *Ctx) Tx(
 				)
 			})
 			pktEncRaw, size, err := PktEncWrite(
-				ctx.Self, hops[0], pktArea, nice, minSize, maxSize, wrappers, src, dst,
+				ctx.Self, hops[0], pktArea, nice, expire, minSize, maxSize, wrappers,
+				src, pktEndWriter(dst),
 			)
 			results <- PktEncWriteResult{pktEncRaw, size, err}
-			dst.Close()
+			src.CloseWithError(err)
+			dst.CloseWithError(err)
 		}(pipeRPrev, pipeW)
 	}
 	for i := 1; i < len(hops); i++ {
 		pktTrns, err := NewPkt(PktTypeTrns, 0, hops[i-1].Id[:])
 		if err != nil {
-			panic(err)
+			pipeR.CloseWithError(err)
+			tmp.Cancel()
+			return nil, err
 		}
 		pipeRPrev = pipeR
 		pipeR, pipeW = io.Pipe()
-		go func(node *Node, pkt *Pkt, src io.Reader, dst io.WriteCloser) {
+		go func(node *Node, pkt *Pkt, src *io.PipeReader, dst *io.PipeWriter) {
 			ctx.LogD("tx", LEs{
 				{"Node", node.Id},
 				{"Nice", int(nice)},
@@ -184,25 +262,33 @@ func (ctx *Ctx) Tx(
 				)
 			})
 			pktEncRaw, size, err := PktEncWrite(
-				ctx.Self, node, pkt, nice, 0, MaxFileSize, 0, src, dst,
+				ctx.Self, node, pkt, nice, expire, 0, MaxFileSize, 0, src, dst,
 			)
 			results <- PktEncWriteResult{pktEncRaw, size, err}
-			dst.Close()
+			src.CloseWithError(err)
+			dst.CloseWithError(err)
 		}(hops[i], pktTrns, pipeRPrev, pipeW)
 	}
-	go func() {
+	go func(src *io.PipeReader) {
 		_, err := CopyProgressed(
-			tmp.W, pipeR, "Tx",
+			tmp.W, src, "Tx",
 			LEs{{"Pkt", pktName}, {"FullSize", expectedSize}},
 			ctx.ShowPrgrs,
 		)
 		results <- PktEncWriteResult{err: err}
-	}()
+		src.CloseWithError(err)
+	}(pipeR)
 	var pktEncRaw []byte
 	var pktEncMsg []byte
+	var pktEncEnd []byte
 	var payloadSize int64
 	if area != nil {
 		r := <-results
+		if r.err != nil {
+			pipeR.CloseWithError(r.err)
+			tmp.Cancel()
+			return nil, r.err
+		}
 		payloadSize = r.size
 		pktEncMsg = r.pktEncRaw
 		wrappers--
@@ -210,21 +296,30 @@ func (ctx *Ctx) Tx(
 	for i := 0; i <= wrappers; i++ {
 		r := <-results
 		if r.err != nil {
-			tmp.Fd.Close()
-			return nil, 0, "", r.err
+			pipeR.CloseWithError(r.err)
+			tmp.Cancel()
+			return nil, r.err
 		}
 		if r.pktEncRaw != nil {
+			// Inner encrypter always finishes before the outer one
+			if pktEncEnd == nil {
+				pktEncEnd = r.pktEncRaw
+			}
 			pktEncRaw = r.pktEncRaw
 			if payloadSize == 0 {
 				payloadSize = r.size
 			}
 		}
 	}
+	if err = cctx.Err(); err != nil {
+		tmp.Cancel()
+		return nil, err
+	}
 	nodePath := filepath.Join(ctx.Spool, lastNode.Id.String())
 	err = tmp.Commit(filepath.Join(nodePath, string(TTx)))
 	os.Symlink(nodePath, filepath.Join(ctx.Spool, lastNode.Name))
 	if err != nil {
-		return lastNode, 0, "", err
+		return &TxResult{Node: lastNode}, err
 	}
 	if ctx.HdrUsage {
 		ctx.HdrWrite(pktEncRaw, filepath.Join(nodePath, string(TTx), tmp.Checksum()))
@@ -255,18 +350,27 @@ func (ctx *Ctx) Tx(
 		}
 		if err = ensureDir(seenDir); err != nil {
 			ctx.LogE("tx-mkdir", les, err, logMsg)
-			return lastNode, 0, "", err
+			return &TxResult{Node: lastNode}, err
 		}
 		if fd, err := os.Create(seenPath); err == nil {
 			fd.Close()
 			if err = DirSync(seenDir); err != nil {
 				ctx.LogE("tx-dirsync", les, err, logMsg)
-				return lastNode, 0, "", err
+				return &TxResult{Node: lastNode}, err
 			}
 		}
 		ctx.LogI("tx-area", les, logMsg)
 	}
-	return lastNode, payloadSize, tmp.Checksum(), err
+	res := &TxResult{Node: lastNode, Pkt: tmp.Checksum(), Size: payloadSize}
+	pktEnd := res.Pkt
+	if pktEndHsh != nil {
+		pktEnd = Base32Codec.EncodeToString(pktEndHsh.Sum(nil))
+	}
+	ctx.trackCreate(lastNode, node, pkt, nice, res, pktEnd)
+	if area == nil && node.Receipt && receiptable(pkt.Type) {
+		ctx.receiptExpect(node, pkt, nice, pktEncEnd, res)
+	}
+	return res, err
 }
 
 type DummyCloser struct{}
@@ -411,10 +515,27 @@ func (ctx *Ctx) TxFile(
 	chunkSize, minSize, maxSize int64,
 	areaId *AreaId,
 ) error {
+	_, err := ctx.TxFileContext(
+		context.Background(),
+		node, nice, srcPath, dstPath, chunkSize, minSize, maxSize, areaId,
+	)
+	return err
+}
+
+// Send the file, returning all created packets: either the single one,
+// or the chunks followed by the .meta one.
+func (ctx *Ctx) TxFileContext(
+	cctx context.Context,
+	node *Node,
+	nice uint8,
+	srcPath, dstPath string,
+	chunkSize, minSize, maxSize int64,
+	areaId *AreaId,
+) ([]*TxResult, error) {
 	dstPathSpecified := false
 	if dstPath == "" {
 		if srcPath == "-" {
-			return errors.New("Must provide destination filename")
+			return nil, NoDstPath
 		}
 		dstPath = filepath.Base(srcPath)
 	} else {
@@ -422,14 +543,14 @@ func (ctx *Ctx) TxFile(
 	}
 	dstPath = filepath.Clean(dstPath)
 	if filepath.IsAbs(dstPath) {
-		return errors.New("Relative destination path required")
+		return nil, NonRelPath
 	}
 	reader, closer, srcSize, archived, err := prepareTxFile(srcPath)
 	if closer != nil {
 		defer closer.Close()
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if archived && !dstPathSpecified {
 		dstPath += TarExt
@@ -438,13 +559,18 @@ func (ctx *Ctx) TxFile(
 	if chunkSize == 0 || (srcSize > 0 && srcSize <= chunkSize) {
 		pkt, err := NewPkt(PktTypeFile, nice, []byte(dstPath))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		_, finalSize, pktName, err := ctx.Tx(
-			node, pkt, nice,
+		res, err := ctx.TxContext(
+			cctx, node, pkt, nice,
 			srcSize, minSize, maxSize,
 			bufio.NewReaderSize(reader, MTHBlockSize), dstPath, areaId,
 		)
+		var finalSize int64
+		var pktName string
+		if err == nil {
+			finalSize, pktName = res.Size, res.Pkt
+		}
 		les := LEs{
 			{"Type", "file"},
 			{"Node", node.Id},
@@ -463,32 +589,38 @@ func (ctx *Ctx) TxFile(
 				dstPath,
 			)
 		}
-		if err == nil {
-			ctx.LogI("tx", les, logMsg)
-		} else {
+		if err != nil {
 			ctx.LogE("tx", les, err, logMsg)
+			return nil, err
 		}
-		return err
+		ctx.LogI("tx", les, logMsg)
+		return []*TxResult{res}, nil
 	}
 
 	br := bufio.NewReaderSize(reader, MTHBlockSize)
 	var sizeFull int64
 	var chunkNum int
 	checksums := [][MTHSize]byte{}
+	var results []*TxResult
 	for {
 		lr := io.LimitReader(br, chunkSize)
 		path := dstPath + ChunkedSuffixPart + strconv.Itoa(chunkNum)
 		pkt, err := NewPkt(PktTypeFile, nice, []byte(path))
 		if err != nil {
-			return err
+			return results, err
 		}
 		hsh := MTHNew(0, 0)
-		_, size, pktName, err := ctx.Tx(
-			node, pkt, nice,
+		res, err := ctx.TxContext(
+			cctx, node, pkt, nice,
 			0, minSize, maxSize,
 			io.TeeReader(lr, hsh),
 			path, areaId,
 		)
+		var size int64
+		var pktName string
+		if err == nil {
+			size, pktName = res.Size, res.Pkt
+		}
 
 		les := LEs{
 			{"Type", "file"},
@@ -512,8 +644,9 @@ func (ctx *Ctx) TxFile(
 			ctx.LogI("tx", les, logMsg)
 		} else {
 			ctx.LogE("tx", les, err, logMsg)
-			return err
+			return results, err
 		}
+		results = append(results, res)
 
 		sizeFull += size - PktOverhead
 		var checksum [MTHSize]byte
@@ -537,21 +670,26 @@ func (ctx *Ctx) TxFile(
 	var buf bytes.Buffer
 	_, err = xdr.Marshal(&buf, metaPkt)
 	if err != nil {
-		return err
+		return results, err
 	}
 	path := dstPath + ChunkedSuffixMeta
 	pkt, err := NewPkt(PktTypeFile, nice, []byte(path))
 	if err != nil {
-		return err
+		return results, err
 	}
 	metaPktSize := int64(buf.Len())
-	_, _, pktName, err := ctx.Tx(
+	res, err := ctx.TxContext(
+		cctx,
 		node,
 		pkt,
 		nice,
 		metaPktSize, minSize, maxSize,
 		&buf, path, areaId,
 	)
+	var pktName string
+	if err == nil {
+		pktName = res.Pkt
+	}
 	les := LEs{
 		{"Type", "file"},
 		{"Node", node.Id},
@@ -570,12 +708,12 @@ func (ctx *Ctx) TxFile(
 			path,
 		)
 	}
-	if err == nil {
-		ctx.LogI("tx", les, logMsg)
-	} else {
+	if err != nil {
 		ctx.LogE("tx", les, err, logMsg)
+		return results, err
 	}
-	return err
+	ctx.LogI("tx", les, logMsg)
+	return append(results, res), nil
 }
 
 func (ctx *Ctx) TxFreq(
@@ -584,23 +722,41 @@ func (ctx *Ctx) TxFreq(
 	srcPath, dstPath string,
 	minSize int64,
 ) error {
+	_, err := ctx.TxFreqContext(
+		context.Background(),
+		node, nice, replyNice, srcPath, dstPath, minSize,
+	)
+	return err
+}
+
+func (ctx *Ctx) TxFreqContext(
+	cctx context.Context,
+	node *Node,
+	nice, replyNice uint8,
+	srcPath, dstPath string,
+	minSize int64,
+) (*TxResult, error) {
 	dstPath = filepath.Clean(dstPath)
 	if filepath.IsAbs(dstPath) {
-		return errors.New("Relative destination path required")
+		return nil, NonRelPath
 	}
 	srcPath = filepath.Clean(srcPath)
 	if filepath.IsAbs(srcPath) {
-		return errors.New("Relative source path required")
+		return nil, NonRelPath
 	}
 	pkt, err := NewPkt(PktTypeFreq, replyNice, []byte(srcPath))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	src := strings.NewReader(dstPath)
 	size := int64(src.Len())
-	_, _, pktName, err := ctx.Tx(
-		node, pkt, nice, size, minSize, MaxFileSize, src, srcPath, nil,
+	res, err := ctx.TxContext(
+		cctx, node, pkt, nice, size, minSize, MaxFileSize, src, srcPath, nil,
 	)
+	var pktName string
+	if err == nil {
+		pktName = res.Pkt
+	}
 	les := LEs{
 		{"Type", "freq"},
 		{"Node", node.Id},
@@ -617,12 +773,12 @@ func (ctx *Ctx) TxFreq(
 			dstPath,
 		)
 	}
-	if err == nil {
-		ctx.LogI("tx", les, logMsg)
-	} else {
+	if err != nil {
 		ctx.LogE("tx", les, err, logMsg)
+		return nil, err
 	}
-	return err
+	ctx.LogI("tx", les, logMsg)
+	return res, nil
 }
 
 func (ctx *Ctx) TxExec(
@@ -635,6 +791,25 @@ func (ctx *Ctx) TxExec(
 	noCompress bool,
 	areaId *AreaId,
 ) error {
+	_, err := ctx.TxExecContext(
+		context.Background(),
+		node, nice, replyNice, handle, args, in,
+		minSize, maxSize, noCompress, areaId,
+	)
+	return err
+}
+
+func (ctx *Ctx) TxExecContext(
+	cctx context.Context,
+	node *Node,
+	nice, replyNice uint8,
+	handle string,
+	args []string,
+	in io.Reader,
+	minSize int64, maxSize int64,
+	noCompress bool,
+	areaId *AreaId,
+) (*TxResult, error) {
 	path := make([][]byte, 0, 1+len(args))
 	path = append(path, []byte(handle))
 	for _, arg := range args {
@@ -646,18 +821,21 @@ func (ctx *Ctx) TxExec(
 	}
 	pkt, err := NewPkt(pktType, replyNice, bytes.Join(path, []byte{0}))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	compressErr := make(chan error, 1)
+	var pr *io.PipeReader
 	if !noCompress {
-		pr, pw := io.Pipe()
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
 		compressor, err := zstd.NewWriter(pw, zstd.WithEncoderLevel(zstd.SpeedDefault))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		go func(r io.Reader) {
 			if _, err := io.Copy(compressor, r); err != nil {
 				compressErr <- err
+				pw.CloseWithError(err)
 				return
 			}
 			compressErr <- compressor.Close()
@@ -665,15 +843,24 @@ func (ctx *Ctx) TxExec(
 		}(in)
 		in = pr
 	}
-	_, size, pktName, err := ctx.Tx(
-		node, pkt, nice, 0, minSize, maxSize, in, handle, areaId,
+	res, err := ctx.TxContext(
+		cctx, node, pkt, nice, 0, minSize, maxSize, in, handle, areaId,
 	)
 	if !noCompress {
+		if err != nil {
+			// Unblock the compressor if packet creation failed
+			pr.CloseWithError(err)
+		}
 		e := <-compressErr
 		if err == nil {
 			err = e
 		}
 	}
+	var size int64
+	var pktName string
+	if res != nil {
+		size, pktName = res.Size, res.Pkt
+	}
 	dst := strings.Join(append([]string{handle}, args...), " ")
 	les := LEs{
 		{"Type", "exec"},
@@ -690,12 +877,12 @@ func (ctx *Ctx) TxExec(
 			ctx.NodeName(node.Id), dst, humanize.IBytes(uint64(size)),
 		)
 	}
-	if err == nil {
-		ctx.LogI("tx", les, logMsg)
-	} else {
+	if err != nil {
 		ctx.LogE("tx", les, err, logMsg)
+		return nil, err
 	}
-	return err
+	ctx.LogI("tx", les, logMsg)
+	return res, nil
 }
 
 func (ctx *Ctx) TxTrns(node *Node, nice uint8, size int64, src io.Reader) error {
@@ -715,10 +902,14 @@ func (ctx *Ctx) TxTrns(node *Node, nice uint8, size int64, src io.Reader) error
 	}
 	ctx.LogD("tx", les, logMsg)
 	if !ctx.IsEnoughSpace(size) {
-		err := errors.New("is not enough space")
+		err := NotEnoughSpace
 		ctx.LogE("tx", les, err, logMsg)
 		return err
 	}
+	if err := ctx.QuotaCheck(node, TTx, size); err != nil {
+		ctx.LogE("tx-trns-quota", les, err, logMsg)
+		return err
+	}
 	tmp, err := ctx.NewTmpFileWHash()
 	if err != nil {
 		return err
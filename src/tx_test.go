@@ -19,6 +19,7 @@ package nncp
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"io"
 	"io/ioutil"
@@ -166,3 +167,66 @@ func TestTx(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTxContextCanceled(t *testing.T) {
+	f := func(dataSize uint32) bool {
+		dataSize %= 1 << 20
+		data := make([]byte, dataSize)
+		if _, err := io.ReadFull(rand.Reader, data); err != nil {
+			panic(err)
+		}
+		spool, err := ioutil.TempDir("", "testtx")
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(spool)
+		nodeOur, err := NewNodeGenerate()
+		if err != nil {
+			panic(err)
+		}
+		nodeTgtOur, err := NewNodeGenerate()
+		if err != nil {
+			panic(err)
+		}
+		nodeTgt := nodeTgtOur.Their()
+		ctx := Ctx{
+			Spool:   spool,
+			LogPath: path.Join(spool, "log.log"),
+			Debug:   true,
+			Self:    nodeOur,
+			SelfId:  nodeOur.Id,
+			Neigh:   make(map[NodeId]*Node),
+			Alias:   make(map[string]*NodeId),
+		}
+		ctx.Neigh[*nodeOur.Id] = nodeOur.Their()
+		ctx.Neigh[*nodeTgt.Id] = nodeTgt
+		pkt, err := NewPkt(PktTypeExec, 0, []byte("whatever"))
+		if err != nil {
+			panic(err)
+		}
+		cctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		src := bytes.NewReader(data)
+		if _, err = ctx.TxContext(
+			cctx,
+			nodeTgt,
+			pkt,
+			123,
+			int64(src.Len()),
+			0,
+			MaxFileSize,
+			src,
+			"pktName",
+			nil,
+		); err == nil {
+			return false
+		}
+		for range ctx.Jobs(nodeTgt.Id, TTx) {
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
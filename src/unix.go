@@ -0,0 +1,101 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Address prefix of the Unix domain socket: unix:///path/to/socket
+const UnixScheme = "unix://"
+
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme)
+}
+
+func UnixDial(addr string) (net.Conn, error) {
+	return net.Dial("unix", strings.TrimPrefix(addr, UnixScheme))
+}
+
+// Unix domain socket listener, created under another name.
+type unixListener struct {
+	*net.UnixListener
+	pth string
+}
+
+func (ln unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: ln.pth, Net: "unix"}
+}
+
+func (ln unixListener) Close() error {
+	err := ln.UnixListener.Close()
+	os.Remove(ln.pth)
+	return err
+}
+
+// Listen on Unix domain socket. Stale socket file, left for example
+// after the crash, is removed. If mode is not zero, then socket's file
+// permissions are set to it, allowing access control. Socket is created
+// in the temporary directory accessible only by us and is moved to its
+// place after that, so it is never accessible with default permissions.
+func UnixListen(addr string, mode os.FileMode) (net.Listener, error) {
+	pth := strings.TrimPrefix(addr, UnixScheme)
+	if pth == "" {
+		return nil, errors.New("empty Unix socket path")
+	}
+	if fi, err := os.Lstat(pth); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(pth + " exists and is not a socket")
+		}
+		if conn, err := net.Dial("unix", pth); err == nil {
+			conn.Close()
+			return nil, errors.New(pth + " is already in use")
+		}
+		if err = os.Remove(pth); err != nil {
+			return nil, err
+		}
+	}
+	if mode == 0 {
+		return net.Listen("unix", pth)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(pth), ".sock")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPth := filepath.Join(tmpDir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPth, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPth, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err = os.Rename(tmpPth, pth); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return unixListener{ln, pth}, nil
+}
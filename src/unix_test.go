@@ -0,0 +1,120 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testunix")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "nncp.sock")
+
+	stale, err := net.Listen("unix", pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := UnixListen(UnixScheme+pth, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatal("bad permissions", fi.Mode())
+	}
+
+	accepted := make(chan error)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_, err = conn.Write([]byte("ok"))
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := UnixDial(UnixScheme + pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(data) != "ok" {
+		t.Fatal("bad data", err)
+	}
+	if err = <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnixListen(UnixScheme+pth, 0); err == nil {
+		t.Fatal("socket in use is replaced")
+	}
+
+	regular := filepath.Join(dir, "regular")
+	if err = ioutil.WriteFile(regular, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnixListen(UnixScheme+regular, 0); err == nil {
+		t.Fatal("regular file is replaced")
+	}
+}
+
+func TestUnixListenMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testunix")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, "nncp.sock")
+	ln, err := UnixListen(UnixScheme+pth, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "nncp.sock" {
+		t.Fatal("temporary directory is left")
+	}
+	if fis[0].Mode().Perm() != 0660 {
+		t.Fatal("bad permissions", fis[0].Mode())
+	}
+	if ln.Addr().String() != pth {
+		t.Fatal("bad address", ln.Addr())
+	}
+	if err = ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Lstat(pth); !os.IsNotExist(err) {
+		t.Fatal("socket is left after closing", err)
+	}
+}
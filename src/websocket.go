@@ -0,0 +1,110 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Origin sent by WebSocket client. It is required by the protocol, but
+// is not checked by the daemon.
+const WSOrigin = "http://nncp/"
+
+func IsWSAddr(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// Connect to ws:// or wss:// URL. SP frames are carried inside binary
+// WebSocket messages unchanged. Connection is made through the proxy,
+// if it is not empty, like TCP addresses are.
+func WSDial(addr, proxyURL string) (ConnDeadlined, error) {
+	cfg, err := websocket.NewConfig(addr, WSOrigin)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Dialer = &net.Dialer{Timeout: DefaultDeadline}
+	hostPort := cfg.Location.Host
+	if cfg.Location.Port() == "" {
+		port := "80"
+		if cfg.Location.Scheme == "wss" {
+			port = "443"
+		}
+		hostPort = net.JoinHostPort(cfg.Location.Hostname(), port)
+	}
+	var ws *websocket.Conn
+	if proxyNeeded(proxyURL, hostPort) {
+		conn, err := proxyDial(proxyURL, hostPort)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Location.Scheme == "wss" {
+			conn = tls.Client(conn, &tls.Config{ServerName: cfg.Location.Hostname()})
+		}
+		conn.SetDeadline(time.Now().Add(DefaultDeadline))
+		if ws, err = websocket.NewClient(cfg, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	} else if ws, err = websocket.DialConfig(cfg); err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// Server side WebSocket connection. HTTP handler must not return until
+// the connection is closed.
+type wsConn struct {
+	*websocket.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return wsAddr(c.Request().RemoteAddr)
+}
+
+// HTTP handler accepting WebSocket connections and passing them to
+// conns channel, as ordinary listeners do.
+func WSHandler(conns chan<- net.Conn) http.Handler {
+	return websocket.Server{Handler: func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		c := &wsConn{Conn: ws, done: make(chan struct{})}
+		conns <- c
+		<-c.done
+	}}
+}
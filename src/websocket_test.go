@@ -0,0 +1,124 @@
+/*
+NNCP -- Node to Node copy, utilities for store-and-forward data exchange
+Copyright (C) 2016-2022 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, version 3 of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package nncp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestWS(t *testing.T) {
+	conns := make(chan net.Conn)
+	srv := httptest.NewServer(WSHandler(conns))
+	defer srv.Close()
+	go func() {
+		for conn := range conns {
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	addr := "ws://" + strings.TrimPrefix(srv.URL, "http://")
+	if !IsWSAddr(addr) {
+		t.FailNow()
+	}
+	f := func(size uint16) bool {
+		data := make([]byte, int(size)+1)
+		rand.Read(data)
+		conn, err := WSDial(addr, "")
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+		defer conn.Close()
+		go conn.Write(data)
+		got := make([]byte, len(data))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Error(err)
+			return false
+		}
+		return bytes.Equal(got, data)
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWSProxy(t *testing.T) {
+	conns := make(chan net.Conn)
+	srv := httptest.NewServer(WSHandler(conns))
+	defer srv.Close()
+	go func() {
+		for conn := range conns {
+			go func(conn net.Conn) {
+				io.Copy(conn, conn)
+				conn.Close()
+			}(conn)
+		}
+	}()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != "nncp.example:80" {
+			conn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+			return
+		}
+		dst, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		if err != nil {
+			return
+		}
+		defer dst.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(dst, conn)
+		io.Copy(conn, dst)
+	}()
+	conn, err := WSDial("ws://nncp.example/", "http://"+ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("hello"))
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatal("unexpected data", got)
+	}
+}